@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jwalton/pixdl/internal/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// envPrefix is the prefix for environment variables which override config
+// file settings.  For example, PIXDL_MAX_PAGES sets "max-pages".
+const envPrefix = "PIXDL_"
+
+// getStringOption returns the value of a string option for a URL on the given
+// host.  Values are taken from, in order of precedence:
+//
+// * The command line flag, if it was specified.
+// * An environment variable (e.g. PIXDL_TEMPLATE).
+// * The entry for the host in the "hosts" section of the config file.
+// * The top level of the config file.
+// * The flag's default value.
+//
+// Pass "" for host to skip the "hosts" section.
+func getStringOption(cmd *cobra.Command, name string, host string) string {
+	value, _ := lookupOption(cmd, name, host)
+	return value
+}
+
+// lookupOption is like getStringOption, but also returns false if the option
+// wasn't set anywhere and the value is the flag's default.
+func lookupOption(cmd *cobra.Command, name string, host string) (string, bool) {
+	flag := cmd.Flags().Lookup(name)
+	if flag == nil {
+		panic("unknown flag: " + name)
+	}
+
+	if flag.Changed {
+		return flag.Value.String(), true
+	}
+
+	envName := envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+	if value, ok := os.LookupEnv(envName); ok {
+		return value, true
+	}
+
+	if value, ok := getHostConfig(host)[name]; ok {
+		return fmt.Sprint(value), true
+	}
+
+	if viper.IsSet(name) {
+		return viper.GetString(name), true
+	}
+
+	return flag.DefValue, false
+}
+
+// getIntOption is like getStringOption, but for integer options.
+func getIntOption(cmd *cobra.Command, name string, host string) int {
+	value := getStringOption(cmd, name, host)
+	result, err := strconv.Atoi(value)
+	if err != nil {
+		log.PixdlFatalf("Invalid value for %s: %s", name, value)
+	}
+	return result
+}
+
+// getFloatOption is like getStringOption, but for floating point options.
+func getFloatOption(cmd *cobra.Command, name string, host string) float64 {
+	value := getStringOption(cmd, name, host)
+	result, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.PixdlFatalf("Invalid value for %s: %s", name, value)
+	}
+	return result
+}
+
+// getBoolOption is like getStringOption, but for boolean options.
+func getBoolOption(cmd *cobra.Command, name string, host string) bool {
+	value := getStringOption(cmd, name, host)
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		log.PixdlFatalf("Invalid value for %s: %s", name, value)
+	}
+	return result
+}
+
+// getStringListOption is like getStringOption, but for options which can be
+// given more than once.  In the config file these can be a list or a single
+// string.  For flags which accept comma separated values, strings from the
+// environment or the config file are split on commas too.
+func getStringListOption(cmd *cobra.Command, name string, host string) []string {
+	flag := cmd.Flags().Lookup(name)
+	if flag == nil {
+		panic("unknown flag: " + name)
+	}
+
+	if flag.Changed {
+		if value, ok := flag.Value.(pflag.SliceValue); ok {
+			return value.GetSlice()
+		}
+		return []string{flag.Value.String()}
+	}
+
+	splitCommas := flag.Value.Type() == "stringSlice"
+
+	envName := envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+	if value, ok := os.LookupEnv(envName); ok {
+		return toStringList(value, splitCommas)
+	}
+
+	if value, ok := getHostConfig(host)[name]; ok {
+		return toStringList(value, splitCommas)
+	}
+
+	if viper.IsSet(name) {
+		return toStringList(viper.Get(name), splitCommas)
+	}
+
+	return []string{}
+}
+
+// toStringList converts a value from the config file into a list of strings.
+func toStringList(value interface{}, splitCommas bool) []string {
+	result := []string{}
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			result = append(result, fmt.Sprint(item))
+		}
+	case []string:
+		result = append(result, v...)
+	default:
+		str := fmt.Sprint(v)
+		if splitCommas {
+			for _, item := range strings.Split(str, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					result = append(result, item)
+				}
+			}
+		} else if str != "" {
+			result = append(result, str)
+		}
+	}
+	return result
+}
+
+// getParamsOption returns the parameters to pass to providers for a URL on
+// the given host.  Parameters are merged from, in increasing order of
+// precedence, the "params" and "providers" sections of the config file, the
+// "params" section for the host in the "hosts" section, and the `--param`
+// command line flag.
+//
+// The "providers" section is a convenient way to write parameters for a given
+// provider, so `providers: {gofile: {token: xxx}}` is the same as
+// `params: {gofile.token: xxx}`.
+func getParamsOption(cmd *cobra.Command, host string) map[string]string {
+	result := map[string]string{}
+
+	for provider, providerConfig := range viper.GetStringMap("providers") {
+		for key, value := range toStringMap(providerConfig) {
+			result[provider+"."+key] = fmt.Sprint(value)
+		}
+	}
+	for key, value := range viper.GetStringMap("params") {
+		result[key] = fmt.Sprint(value)
+	}
+	for key, value := range toStringMap(getHostConfig(host)["params"]) {
+		result[key] = fmt.Sprint(value)
+	}
+
+	params, err := cmd.Flags().GetStringArray("param")
+	log.PixdlDieOnError(err)
+	for key, value := range parseParams(params) {
+		result[key] = value
+	}
+
+	return result
+}
+
+// getHostConfig returns the section of the config file for the given host.
+// This will never return nil.
+func getHostConfig(host string) map[string]interface{} {
+	if host == "" {
+		return map[string]interface{}{}
+	}
+
+	// Note that we can't use `viper.Get("hosts." + host)` here, because host
+	// names contain ".", which viper treats as a key delimiter.
+	hosts := viper.GetStringMap("hosts")
+	return toStringMap(hosts[strings.ToLower(host)])
+}
+
+// toStringMap converts a map from the config file into a map[string]interface{},
+// or returns an empty map if the value is not a map.
+func toStringMap(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			result[fmt.Sprint(key)] = val
+		}
+		return result
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// getHost returns the host name for a URL, or "" if the URL can't be parsed.
+func getHost(urlStr string) string {
+	parsed, err := url.Parse(urlStr)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsed.Hostname())
+}
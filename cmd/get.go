@@ -1,101 +1,205 @@
 package cmd
 
 import (
-	"fmt"
+	"bufio"
+	"context"
+	"io"
 	"os"
+	"os/signal"
 	"regexp"
+	"strings"
 
 	"github.com/MakeNowJust/heredoc"
+	"github.com/jwalton/pixdl/cmd/reporters"
 	"github.com/jwalton/pixdl/internal/log"
 	"github.com/jwalton/pixdl/pkg/pixdl"
+	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 )
 
 // getCmd represents the get command
 var getCmd = &cobra.Command{
-	Use:   "get [url]",
-	Short: "Download an album",
+	Use:   "get [url...]",
+	Short: "Download one or more albums",
 	Example: heredoc.Doc(`
 		# Download images from an imgur gallery
 		pixdl get https://imgur.com/gallery/88wOh
 
 		# Download files from gofile.io
 		pixdl get --param gofile.token=xxx https://gofile.io/d/abdef
-	`),
-	Args: func(cmd *cobra.Command, args []string) error {
-		if len(args) < 1 {
-			return fmt.Errorf("requires a URL to download from")
-		}
 
-		return nil
-	},
+		# Download every album listed in urls.txt, each into its own folder
+		pixdl get --input-file urls.txt --album-folder "{{.Album.Provider}}/{{.Album.Name}}"
+	`),
 	Run: func(cmd *cobra.Command, args []string) {
-		url := args[0]
-
-		verbose, err := cmd.Flags().GetBool("verbose")
-		log.PixdlDieOnError(err)
+		urls := getURLs(cmd, args)
 
-		toFolder, err := cmd.Flags().GetString("out")
-		log.PixdlDieOnError(err)
+		reporter := reporters.NewSummaryReporter(getReporter(cmd))
 
-		filenameTemplate, err := cmd.Flags().GetString("template")
-		log.PixdlDieOnError(err)
+		cwd, err := os.Getwd()
+		if err != nil {
+			log.PixdlFatalf("Unable to determine working directory: %v", err)
+		}
 
-		maxImages, err := cmd.Flags().GetInt("max")
-		log.PixdlDieOnError(err)
+		// Stop downloading on Ctrl-C.  Any partially downloaded files will be
+		// left on disk, so they can be resumed next time.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
 
-		maxPages, err := cmd.Flags().GetInt("max-pages")
-		log.PixdlDieOnError(err)
+		downloader := newDownloader(cmd)
+		for _, url := range urls {
+			downloader.DownloadAlbumContext(ctx, url, getDownloadOptions(cmd, url, cwd), reporter)
+		}
+		downloader.Wait()
+		downloader.Close()
 
-		filterSubAlbum, err := cmd.Flags().GetString("subalbum")
-		log.PixdlDieOnError(err)
+		if ctx.Err() != nil {
+			stop()
+			log.PixdlFatal("Download cancelled - run the same command again to resume")
+		}
 
-		params, err := cmd.Flags().GetStringArray("param")
-		log.PixdlDieOnError(err)
+		printSummary(cmd, reporter)
+		if reporter.FailedAlbums() > 0 {
+			os.Exit(1)
+		}
+	},
+}
 
-		parallel, err := cmd.Flags().GetInt("parallel")
-		log.PixdlDieOnError(err)
+func init() {
+	rootCmd.AddCommand(getCmd)
+	addAlbumFlags(getCmd)
+	addDownloaderFlags(getCmd)
+	getCmd.Flags().StringArrayP("param", "p", []string{}, "Specify a parameter to pass to providers")
+}
 
-		reporter := getReporter(verbose)
+// addAlbumFlags adds flags used by getURLs and getDownloadOptions to the
+// given command.
+func addAlbumFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("out", "o", "", "Output directory to put files in")
+	cmd.Flags().StringP("template", "t", "", `Template to use to generate filenames.
+e.g. "{{.Album.Name}}/{{.Image.SubAlbum}}/{{.Filename}}"`)
+	cmd.Flags().String("album-folder", "", `Template to use to generate a folder for each album, relative to the output directory.
+e.g. "{{.Album.Provider}}/{{.Album.Name}}"`)
+	cmd.Flags().StringP("input-file", "i", "", `Read URLs to download from a file, one per line ("-" for stdin)`)
+	cmd.Flags().IntP("max", "n", 0, "Maximum number of images to download from album (0 for all)")
+	cmd.Flags().Int("max-pages", 0, "Maximum number of pages to download from album (0 for all)")
+	cmd.Flags().String("subalbum", "", `Only download images from the specified sub-albums or posts.
+Accepts a comma separated list of names and ranges, e.g. "22,30-45"`)
+	cmd.Flags().StringArray("include", []string{}, "Only download images whose URL or filename matches this regular expression (may be repeated)")
+	cmd.Flags().StringArray("exclude", []string{}, "Skip images whose URL or filename matches this regular expression (may be repeated)")
+	cmd.Flags().StringSlice("allow-type", []string{}, `Only download images with these extensions or MIME types, e.g. "jpg,png" or "image/*"`)
+	cmd.Flags().StringSlice("deny-type", []string{}, `Skip images with these extensions or MIME types, e.g. "gif,video/*"`)
+	cmd.Flags().String("min-size", "0", "Skip images smaller than this many bytes (e.g. 50K), 0 for no limit")
+	cmd.Flags().String("max-size", "0", "Skip images larger than this many bytes (e.g. 20M), 0 for no limit")
+	cmd.Flags().Int("min-width", 0, "Skip images narrower than this many pixels, 0 for no limit")
+	cmd.Flags().Int("min-height", 0, "Skip images shorter than this many pixels, 0 for no limit")
+	cmd.Flags().Int("max-width", 0, "Skip images wider than this many pixels, 0 for no limit")
+	cmd.Flags().Int("max-height", 0, "Skip images taller than this many pixels, 0 for no limit")
+	cmd.Flags().String("since", "", `Skip images posted before this date, e.g. "2021-05-01", "2021-05-01 13:30", or "7d" for the last week`)
+	cmd.Flags().String("until", "", `Skip images posted after this date, e.g. "2021-05-31" (includes the whole day)`)
+}
 
-		if toFolder == "" {
-			toFolder, err = os.Getwd()
-			if err != nil {
-				log.PixdlFatalf("Unable to determine working directory: %v", err)
-			}
+// getURLs returns the URLs passed on the command line, along with any URLs
+// read from the "--input-file".  Exits if there are no URLs.
+func getURLs(cmd *cobra.Command, args []string) []string {
+	inputFile, err := cmd.Flags().GetString("input-file")
+	log.PixdlDieOnError(err)
+
+	urls := args
+	if inputFile != "" {
+		fileURLs, err := readURLFile(inputFile)
+		if err != nil {
+			log.PixdlFatalf("Error reading %s: %v", inputFile, err)
 		}
+		urls = append(urls, fileURLs...)
+	}
 
-		// TODO: Add option for this.
-		maxConcurrency := uint(parallel)
+	if len(urls) == 0 {
+		log.PixdlFatal("requires a URL to download from")
+	}
 
-		options := pixdl.DownloadOptions{
-			ToFolder:         toFolder,
-			FilenameTemplate: filenameTemplate,
-			MaxPages:         maxPages,
-			MaxImages:        maxImages,
-			FilterSubAlbum:   filterSubAlbum,
-			Params:           parseParams(params),
-		}
+	return urls
+}
 
-		downloader := pixdl.NewConcurrentDownloader(pixdl.SetMaxConcurrency(maxConcurrency))
-		downloader.DownloadAlbum(url, options, reporter)
-		downloader.Wait()
-		downloader.Close()
+// getDownloadOptions returns the options to use to download the given URL,
+// taking into account command line flags and the config file.
+func getDownloadOptions(cmd *cobra.Command, url string, cwd string) pixdl.DownloadOptions {
+	host := getHost(url)
 
-		fmt.Println("All done")
-	},
+	toFolder := getStringOption(cmd, "out", host)
+	if toFolder == "" {
+		toFolder = cwd
+	} else if expanded, err := homedir.Expand(toFolder); err == nil {
+		toFolder = expanded
+	}
+
+	minSize, err := parseSize(getStringOption(cmd, "min-size", host))
+	if err != nil {
+		log.PixdlFatalf("Invalid value for min-size: %v", err)
+	}
+	maxSize, err := parseSize(getStringOption(cmd, "max-size", host))
+	if err != nil {
+		log.PixdlFatalf("Invalid value for max-size: %v", err)
+	}
+
+	since, err := parseDate(getStringOption(cmd, "since", host), false)
+	if err != nil {
+		log.PixdlFatalf("Invalid value for since: %v", err)
+	}
+	until, err := parseDate(getStringOption(cmd, "until", host), true)
+	if err != nil {
+		log.PixdlFatalf("Invalid value for until: %v", err)
+	}
+
+	return pixdl.DownloadOptions{
+		ToFolder:            toFolder,
+		FilenameTemplate:    getStringOption(cmd, "template", host),
+		AlbumFolderTemplate: getStringOption(cmd, "album-folder", host),
+		MaxPages:            getIntOption(cmd, "max-pages", host),
+		MaxImages:           getIntOption(cmd, "max", host),
+		FilterSubAlbum:      getStringOption(cmd, "subalbum", host),
+		Include:             getStringListOption(cmd, "include", host),
+		Exclude:             getStringListOption(cmd, "exclude", host),
+		AllowTypes:          getStringListOption(cmd, "allow-type", host),
+		DenyTypes:           getStringListOption(cmd, "deny-type", host),
+		MinSize:             minSize,
+		MaxSize:             maxSize,
+		MinWidth:            int64(getIntOption(cmd, "min-width", host)),
+		MinHeight:           int64(getIntOption(cmd, "min-height", host)),
+		MaxWidth:            int64(getIntOption(cmd, "max-width", host)),
+		MaxHeight:           int64(getIntOption(cmd, "max-height", host)),
+		Since:               since,
+		Until:               until,
+		Params:              getParamsOption(cmd, host),
+	}
 }
 
-func init() {
-	rootCmd.AddCommand(getCmd)
-	getCmd.Flags().StringP("out", "o", "", "Output directory to put files in")
-	getCmd.Flags().StringP("template", "t", "", `Template to use to generate filenames.
-e.g. "{{.Album.Name}}/{{.Image.SubAlbum}}/{{.Filename}}"`)
-	getCmd.Flags().IntP("max", "n", 0, "Maximum number of images to download from album (0 for all)")
-	getCmd.Flags().Int("max-pages", 0, "Maximum number of pages to download from album (0 for all)")
-	getCmd.Flags().String("subalbum", "", "Only download images from the specified sub-album or post")
-	getCmd.Flags().Int("parallel", 4, "Maximum number of files to download concurrently")
-	getCmd.Flags().StringArrayP("param", "p", []string{}, "Specify a parameter to pass to providers")
+// readURLFile reads a list of URLs from a file, one per line.  Blank lines
+// and lines starting with "#" are ignored.  If filename is "-", URLs are
+// read from stdin.
+func readURLFile(filename string) ([]string, error) {
+	var reader io.Reader
+	if filename == "-" {
+		reader = os.Stdin
+	} else {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	result := []string{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			result = append(result, line)
+		}
+	}
+
+	return result, scanner.Err()
 }
 
 var paramRegex = regexp.MustCompile(`^([a-zA-Z\.-_]*)=(.*)$`)
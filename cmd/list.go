@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/jwalton/pixdl/internal/log"
+	"github.com/jwalton/pixdl/pkg/download"
+	"github.com/jwalton/pixdl/pkg/pixdl"
+	"github.com/spf13/cobra"
+)
+
+// listCmd represents the list command
+var listCmd = &cobra.Command{
+	Use:   "list [url...]",
+	Short: "List the images in one or more albums without downloading them",
+	Long: heredoc.Doc(`
+		Fetches one or more albums and prints every image that "pixdl get" would
+		download, along with the file it would be saved to.  Accepts the same
+		limits, filters, and templates as "pixdl get".  Nothing is downloaded or
+		written to disk.
+
+		Use "--output json" for one JSON object per image, or "--output csv"
+		for CSV.
+	`),
+	Example: heredoc.Doc(`
+		# See where images from a thread would be saved
+		pixdl list --template "{{.Image.SubAlbum}}/{{.Filename}}" https://www.cyclechat.net/threads/fixie-pics.12345/
+
+		# Save a list of images as a spreadsheet
+		pixdl list --output csv https://imgur.com/gallery/88wOh > images.csv
+	`),
+	Run: func(cmd *cobra.Command, args []string) {
+		urls := getURLs(cmd, args)
+
+		writer, err := newListWriter(cmd, os.Stdout)
+		if err != nil {
+			log.PixdlFatal(err)
+		}
+
+		cwd, err := os.Getwd()
+		if err != nil {
+			log.PixdlFatalf("Unable to determine working directory: %v", err)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		scheduler := newScheduler(cmd, 1)
+		downloader := pixdl.NewConcurrentDownloader(
+			pixdl.SetClient(download.NewClient(download.WithScheduler(scheduler))),
+			pixdl.SetScheduler(scheduler),
+		)
+		defer downloader.Close()
+
+		failed := 0
+		for _, url := range urls {
+			err := downloader.ListAlbumContext(ctx, url, getDownloadOptions(cmd, url, cwd), func(image *pixdl.ListedImage) {
+				if err := writer.write(image); err != nil {
+					log.PixdlFatalf("Error writing output: %v", err)
+				}
+			})
+			if err != nil {
+				log.PixdlErrorf("Error listing %s: %v", url, err)
+				failed++
+			}
+		}
+
+		if err := writer.close(); err != nil {
+			log.PixdlFatalf("Error writing output: %v", err)
+		}
+
+		if failed > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+	addAlbumFlags(listCmd)
+	addSchedulerFlags(listCmd)
+	listCmd.Flags().StringArrayP("param", "p", []string{}, "Specify a parameter to pass to providers")
+}
+
+// listWriter writes images from `pixdl list` in some format.
+type listWriter interface {
+	write(image *pixdl.ListedImage) error
+	close() error
+}
+
+// newListWriter returns a listWriter for the "--output" format.
+func newListWriter(cmd *cobra.Command, out io.Writer) (listWriter, error) {
+	output, err := cmd.Flags().GetString("output")
+	log.PixdlDieOnError(err)
+
+	switch output {
+	case "text":
+		return newTableListWriter(out), nil
+	case "json":
+		return &jsonListWriter{encoder: json.NewEncoder(out)}, nil
+	case "csv":
+		return newCSVListWriter(out), nil
+	default:
+		return nil, fmt.Errorf("invalid output format: %s", output)
+	}
+}
+
+// tableListWriter writes images as a table, followed by a total.
+type tableListWriter struct {
+	writer  *tabwriter.Writer
+	count   int
+	total   int64
+	unknown int
+}
+
+func newTableListWriter(out io.Writer) *tableListWriter {
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "URL\tSUBALBUM\tPAGE\tSIZE\tDESTINATION")
+	return &tableListWriter{writer: writer}
+}
+
+func (w *tableListWriter) write(image *pixdl.ListedImage) error {
+	w.count++
+	if image.Size > -1 {
+		w.total += image.Size
+	} else {
+		w.unknown++
+	}
+
+	destination := image.Filename
+	if image.Err != nil {
+		destination = "error: " + image.Err.Error()
+	}
+
+	_, err := fmt.Fprintf(w.writer, "%s\t%s\t%d\t%s\t%s\n",
+		image.Image.URL,
+		image.Image.SubAlbum,
+		image.Image.Page,
+		formatSize(image.Size),
+		destination,
+	)
+	return err
+}
+
+func (w *tableListWriter) close() error {
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+
+	unknown := ""
+	if w.unknown > 0 {
+		unknown = fmt.Sprintf(" (%d of unknown size)", w.unknown)
+	}
+	_, err := fmt.Fprintf(w.writer, "\n%d images, %s%s\n", w.count, formatSize(w.total), unknown)
+	if err == nil {
+		err = w.writer.Flush()
+	}
+	return err
+}
+
+// jsonListImage is a single line of output from `pixdl list --output json`.
+type jsonListImage struct {
+	URL         string `json:"url"`
+	AlbumURL    string `json:"albumUrl,omitempty"`
+	SubAlbum    string `json:"subAlbum"`
+	Page        int    `json:"page"`
+	Size        int64  `json:"size"`
+	Destination string `json:"destination,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// jsonListWriter writes one JSON object per image.
+type jsonListWriter struct {
+	encoder *json.Encoder
+}
+
+func (w *jsonListWriter) write(image *pixdl.ListedImage) error {
+	item := jsonListImage{
+		URL:         image.Image.URL,
+		SubAlbum:    image.Image.SubAlbum,
+		Page:        image.Image.Page,
+		Size:        image.Size,
+		Destination: image.Filename,
+	}
+	if image.Image.Album != nil {
+		item.AlbumURL = image.Image.Album.URL
+	}
+	if image.Err != nil {
+		item.Error = image.Err.Error()
+	}
+	return w.encoder.Encode(item)
+}
+
+func (w *jsonListWriter) close() error {
+	return nil
+}
+
+// csvListWriter writes images as CSV, with a header row.
+type csvListWriter struct {
+	writer *csv.Writer
+}
+
+func newCSVListWriter(out io.Writer) *csvListWriter {
+	writer := csv.NewWriter(out)
+	_ = writer.Write([]string{"url", "subAlbum", "page", "size", "destination", "error"})
+	return &csvListWriter{writer: writer}
+}
+
+func (w *csvListWriter) write(image *pixdl.ListedImage) error {
+	errMessage := ""
+	if image.Err != nil {
+		errMessage = image.Err.Error()
+	}
+	return w.writer.Write([]string{
+		image.Image.URL,
+		image.Image.SubAlbum,
+		strconv.Itoa(image.Image.Page),
+		strconv.FormatInt(image.Size, 10),
+		image.Filename,
+		errMessage,
+	})
+}
+
+func (w *csvListWriter) close() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
@@ -0,0 +1,228 @@
+package reporters
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jwalton/pixdl/pkg/download"
+	"github.com/jwalton/pixdl/pkg/pixdl"
+)
+
+// minTimeBetweenJSONProgress is the minimum time between "imageProgress" events
+// for a single image.
+const minTimeBetweenJSONProgress = 500 * time.Millisecond
+
+type jsonAlbum struct {
+	URL             string `json:"url"`
+	AlbumID         string `json:"albumId"`
+	Name            string `json:"name"`
+	Author          string `json:"author"`
+	Provider        string `json:"provider"`
+	TotalImageCount int    `json:"totalImageCount"`
+}
+
+type jsonImage struct {
+	Album     *jsonAlbum `json:"album,omitempty"`
+	SubAlbum  string     `json:"subAlbum"`
+	URL       string     `json:"url"`
+	Filename  string     `json:"filename"`
+	Title     string     `json:"title"`
+	Size      int64      `json:"size"`
+	Width     int64      `json:"width"`
+	Height    int64      `json:"height"`
+	MD5       string     `json:"md5"`
+	Timestamp *time.Time `json:"timestamp"`
+	Index     int        `json:"index"`
+	Page      int        `json:"page"`
+	SourceURL string     `json:"sourceUrl"`
+}
+
+type jsonProgress struct {
+	File            string  `json:"file"`
+	Total           int64   `json:"total"`
+	Written         int64   `json:"written"`
+	PercentComplete float64 `json:"percentComplete"`
+	Done            bool    `json:"done"`
+}
+
+// jsonEvent is a single line of output from the JSON reporter.
+type jsonEvent struct {
+	Event      string        `json:"event"`
+	Time       time.Time     `json:"time"`
+	URL        string        `json:"url,omitempty"`
+	Album      *jsonAlbum    `json:"album,omitempty"`
+	Image      *jsonImage    `json:"image,omitempty"`
+	Progress   *jsonProgress `json:"progress,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	StatusCode int           `json:"statusCode,omitempty"`
+	Warning    string        `json:"warning,omitempty"`
+}
+
+type jsonReporter struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+	// lastProgress is the last time we sent a progress event for each image,
+	// indexed by progressKey.
+	lastProgress map[string]time.Time
+	// progress is the most recent progress for each image, indexed by
+	// progressKey.
+	progress map[string]*jsonProgress
+}
+
+// progressKey returns the key for an image in jsonReporter's maps.  The same
+// URL can be downloaded from two albums at once, so this includes the album.
+func progressKey(image *pixdl.ImageMetadata) string {
+	if image.Album == nil {
+		return image.URL
+	}
+	return image.Album.URL + " " + image.URL
+}
+
+func toJSONAlbum(album *pixdl.AlbumMetadata) *jsonAlbum {
+	if album == nil {
+		return nil
+	}
+	return &jsonAlbum{
+		URL:             album.URL,
+		AlbumID:         album.AlbumID,
+		Name:            album.Name,
+		Author:          album.Author,
+		Provider:        album.Provider,
+		TotalImageCount: album.TotalImageCount,
+	}
+}
+
+func toJSONImage(image *pixdl.ImageMetadata) *jsonImage {
+	if image == nil {
+		return nil
+	}
+	return &jsonImage{
+		Album:     toJSONAlbum(image.Album),
+		SubAlbum:  image.SubAlbum,
+		URL:       image.URL,
+		Filename:  image.Filename,
+		Title:     image.Title,
+		Size:      image.Size,
+		Width:     image.Width,
+		Height:    image.Height,
+		MD5:       image.MD5,
+		Timestamp: image.Timestamp,
+		Index:     image.Index,
+		Page:      image.Page,
+		SourceURL: image.SourceURL,
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// errorStatusCode returns the HTTP status code for a failed download, or 0
+// if there is none.
+func errorStatusCode(err error) int {
+	var downloadErr *download.Error
+	if errors.As(err, &downloadErr) {
+		return downloadErr.StatusCode
+	}
+	return 0
+}
+
+func (p *jsonReporter) write(event *jsonEvent) {
+	event.Time = time.Now()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// Nothing useful we can do if this fails.
+	_ = p.encoder.Encode(event)
+}
+
+func (p *jsonReporter) AlbumFetch(url string) {
+	p.write(&jsonEvent{Event: "albumFetch", URL: url})
+}
+
+func (p *jsonReporter) AlbumStart(album *pixdl.AlbumMetadata) {
+	p.write(&jsonEvent{Event: "albumStart", URL: album.URL, Album: toJSONAlbum(album)})
+}
+
+func (p *jsonReporter) AlbumEnd(album *pixdl.AlbumMetadata, err error) {
+	p.write(&jsonEvent{Event: "albumEnd", URL: album.URL, Album: toJSONAlbum(album), Error: errorString(err)})
+}
+
+func (p *jsonReporter) ImageSkip(image *pixdl.ImageMetadata, err error) {
+	p.write(&jsonEvent{Event: "imageSkip", URL: image.URL, Image: toJSONImage(image), Error: errorString(err)})
+}
+
+func (p *jsonReporter) ImageStart(image *pixdl.ImageMetadata) {
+	p.write(&jsonEvent{Event: "imageStart", URL: image.URL, Image: toJSONImage(image)})
+}
+
+func (p *jsonReporter) ImageProgress(image *pixdl.ImageMetadata, progress *download.Progress) {
+	current := &jsonProgress{
+		File:            progress.File,
+		Total:           progress.Total,
+		Written:         progress.Written,
+		PercentComplete: progress.PercentComplete,
+		Done:            progress.Done,
+	}
+
+	// Always send warnings and the final progress report, but throttle
+	// everything else.
+	now := time.Now()
+	key := progressKey(image)
+	p.mutex.Lock()
+	p.progress[key] = current
+	last, seen := p.lastProgress[key]
+	throttled := seen && now.Sub(last) < minTimeBetweenJSONProgress
+	if !throttled {
+		p.lastProgress[key] = now
+	}
+	p.mutex.Unlock()
+
+	if throttled && progress.Warning == "" && !progress.Done {
+		return
+	}
+
+	p.write(&jsonEvent{
+		Event:    "imageProgress",
+		URL:      image.URL,
+		Image:    toJSONImage(image),
+		Progress: current,
+		Error:    errorString(progress.Err),
+		Warning:  progress.Warning,
+	})
+}
+
+func (p *jsonReporter) ImageEnd(image *pixdl.ImageMetadata, err error) {
+	key := progressKey(image)
+	p.mutex.Lock()
+	progress := p.progress[key]
+	delete(p.progress, key)
+	delete(p.lastProgress, key)
+	p.mutex.Unlock()
+
+	p.write(&jsonEvent{
+		Event:      "imageEnd",
+		URL:        image.URL,
+		Image:      toJSONImage(image),
+		Progress:   progress,
+		Error:      errorString(err),
+		StatusCode: errorStatusCode(err),
+	})
+}
+
+// NewJSONReporter returns a new ProgressReporter which writes one JSON object
+// per line to `out` for each event.
+func NewJSONReporter(out io.Writer) pixdl.ProgressReporter {
+	return &jsonReporter{
+		encoder:      json.NewEncoder(out),
+		lastProgress: map[string]time.Time{},
+		progress:     map[string]*jsonProgress{},
+	}
+}
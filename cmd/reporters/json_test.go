@@ -0,0 +1,101 @@
+package reporters
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/jwalton/pixdl/pkg/download"
+	"github.com/jwalton/pixdl/pkg/pixdl"
+	"github.com/stretchr/testify/assert"
+)
+
+// readJSONEvents decodes every line written by a jsonReporter.
+func readJSONEvents(t *testing.T, out *bytes.Buffer) []jsonEvent {
+	result := []jsonEvent{}
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		var event jsonEvent
+		if assert.NoError(t, json.Unmarshal(scanner.Bytes(), &event), scanner.Text()) {
+			result = append(result, event)
+		}
+	}
+	return result
+}
+
+func TestJSONReporter(t *testing.T) {
+	out := &bytes.Buffer{}
+	reporter := NewJSONReporter(out)
+
+	album := &pixdl.AlbumMetadata{URL: "https://example.com/threads/1", Name: "Bikes"}
+	other := &pixdl.AlbumMetadata{URL: "https://example.com/threads/2", Name: "More bikes"}
+	image := &pixdl.ImageMetadata{
+		Album:     album,
+		URL:       "https://example.com/1.jpg",
+		Filename:  "1.jpg",
+		Size:      100,
+		Width:     640,
+		Height:    480,
+		MD5:       "abc123",
+		SourceURL: "https://example.com/threads/1/post-22",
+	}
+	// The same image, posted in another album.
+	otherImage := &pixdl.ImageMetadata{Album: other, URL: image.URL, Filename: "1.jpg"}
+
+	reporter.AlbumStart(album)
+	reporter.ImageStart(image)
+	reporter.ImageStart(otherImage)
+	reporter.ImageProgress(image, &download.Progress{Total: 100, Written: 10})
+	reporter.ImageProgress(otherImage, &download.Progress{Total: 100, Written: 20})
+	// Should be throttled.
+	reporter.ImageProgress(image, &download.Progress{Total: 100, Written: 50})
+	reporter.ImageProgress(image, &download.Progress{Total: 100, Written: 100, Done: true})
+	reporter.ImageEnd(image, nil)
+	reporter.ImageEnd(otherImage, &download.Error{StatusCode: http.StatusNotFound})
+	reporter.AlbumEnd(album, nil)
+
+	events := readJSONEvents(t, out)
+	names := make([]string, len(events))
+	for index, event := range events {
+		names[index] = event.Event
+	}
+	assert.Equal(t, []string{
+		"albumStart",
+		"imageStart",
+		"imageStart",
+		"imageProgress",
+		"imageProgress",
+		"imageProgress",
+		"imageEnd",
+		"imageEnd",
+		"albumEnd",
+	}, names)
+	if !assert.Len(t, events, 9) {
+		return
+	}
+
+	assert.Equal(t, "Bikes", events[0].Album.Name)
+
+	started := events[1].Image
+	assert.Equal(t, int64(640), started.Width)
+	assert.Equal(t, int64(480), started.Height)
+	assert.Equal(t, "abc123", started.MD5)
+	assert.Equal(t, "https://example.com/threads/1/post-22", started.SourceURL)
+	assert.Equal(t, album.URL, started.Album.URL)
+
+	// Progress for the second album shouldn't be throttled by the first.
+	assert.Equal(t, int64(10), events[3].Progress.Written)
+	assert.Equal(t, other.URL, events[4].Image.Album.URL)
+	assert.Equal(t, int64(20), events[4].Progress.Written)
+	assert.True(t, events[5].Progress.Done)
+
+	assert.Equal(t, album.URL, events[6].Image.Album.URL)
+	assert.Equal(t, int64(100), events[6].Progress.Written)
+	assert.Equal(t, "", events[6].Error)
+
+	assert.Equal(t, other.URL, events[7].Image.Album.URL)
+	assert.Equal(t, int64(20), events[7].Progress.Written)
+	assert.Equal(t, http.StatusNotFound, events[7].StatusCode)
+}
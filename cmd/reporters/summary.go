@@ -0,0 +1,164 @@
+package reporters
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jwalton/gchalk"
+	"github.com/jwalton/pixdl/pkg/download"
+	"github.com/jwalton/pixdl/pkg/pixdl"
+)
+
+// AlbumResult is the result of downloading a single album.
+type AlbumResult struct {
+	// URL is the URL the album was downloaded from.
+	URL string
+	// Name is the name of the album.
+	Name string
+	// Err is the error that caused the album to fail, or nil if the album
+	// was downloaded successfully.
+	Err error
+}
+
+// SummaryReporter is a ProgressReporter which keeps track of which albums and
+// images were downloaded successfully, and forwards every event on to
+// another ProgressReporter.
+type SummaryReporter struct {
+	mutex sync.Mutex
+	next  pixdl.ProgressReporter
+
+	// Albums is the result of every album that has finished downloading.
+	Albums []AlbumResult
+	// Downloaded is the number of images downloaded successfully.
+	Downloaded int
+	// Skipped is the number of images that were skipped.
+	Skipped int
+	// Failed is the number of images which could not be downloaded.
+	Failed int
+}
+
+// NewSummaryReporter returns a new SummaryReporter which forwards all events
+// to `next`.
+func NewSummaryReporter(next pixdl.ProgressReporter) *SummaryReporter {
+	return &SummaryReporter{next: next}
+}
+
+// FailedAlbums returns the number of albums which failed to download.
+func (p *SummaryReporter) FailedAlbums() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	failed := 0
+	for _, album := range p.Albums {
+		if album.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Print writes a summary of all albums and images to stdout.
+func (p *SummaryReporter) Print() {
+	failedAlbums := p.FailedAlbums()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	fmt.Printf("All done - %d albums (%d failed), %d images downloaded, %d skipped, %d failed\n",
+		len(p.Albums),
+		failedAlbums,
+		p.Downloaded,
+		p.Skipped,
+		p.Failed,
+	)
+
+	if failedAlbums > 0 {
+		fmt.Println("Failed albums:")
+		for _, album := range p.Albums {
+			if album.Err != nil {
+				fmt.Printf("  %s: %s\n", album.URL, gchalk.BrightRed(album.Err.Error()))
+			}
+		}
+	}
+}
+
+// PrintJSON writes a summary of all albums and images to stdout as a single
+// line of JSON, in the same format as the JSON reporter.
+func (p *SummaryReporter) PrintJSON() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	type jsonAlbumResult struct {
+		URL   string `json:"url"`
+		Name  string `json:"name"`
+		Error string `json:"error,omitempty"`
+	}
+
+	albums := make([]jsonAlbumResult, 0, len(p.Albums))
+	for _, album := range p.Albums {
+		albums = append(albums, jsonAlbumResult{URL: album.URL, Name: album.Name, Error: errorString(album.Err)})
+	}
+
+	_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+		"event":      "summary",
+		"time":       time.Now(),
+		"albums":     albums,
+		"downloaded": p.Downloaded,
+		"skipped":    p.Skipped,
+		"failed":     p.Failed,
+	})
+}
+
+// AlbumFetch implements pixdl.ProgressReporter.
+func (p *SummaryReporter) AlbumFetch(url string) {
+	p.next.AlbumFetch(url)
+}
+
+// AlbumStart implements pixdl.ProgressReporter.
+func (p *SummaryReporter) AlbumStart(album *pixdl.AlbumMetadata) {
+	p.next.AlbumStart(album)
+}
+
+// AlbumEnd implements pixdl.ProgressReporter.
+func (p *SummaryReporter) AlbumEnd(album *pixdl.AlbumMetadata, err error) {
+	p.mutex.Lock()
+	p.Albums = append(p.Albums, AlbumResult{URL: album.URL, Name: album.Name, Err: err})
+	p.mutex.Unlock()
+
+	p.next.AlbumEnd(album, err)
+}
+
+// ImageSkip implements pixdl.ProgressReporter.
+func (p *SummaryReporter) ImageSkip(image *pixdl.ImageMetadata, err error) {
+	p.mutex.Lock()
+	p.Skipped++
+	p.mutex.Unlock()
+
+	p.next.ImageSkip(image, err)
+}
+
+// ImageStart implements pixdl.ProgressReporter.
+func (p *SummaryReporter) ImageStart(image *pixdl.ImageMetadata) {
+	p.next.ImageStart(image)
+}
+
+// ImageProgress implements pixdl.ProgressReporter.
+func (p *SummaryReporter) ImageProgress(image *pixdl.ImageMetadata, progress *download.Progress) {
+	p.next.ImageProgress(image, progress)
+}
+
+// ImageEnd implements pixdl.ProgressReporter.
+func (p *SummaryReporter) ImageEnd(image *pixdl.ImageMetadata, err error) {
+	p.mutex.Lock()
+	if err == nil {
+		p.Downloaded++
+	} else {
+		p.Failed++
+	}
+	p.mutex.Unlock()
+
+	p.next.ImageEnd(image, err)
+}
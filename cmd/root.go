@@ -4,6 +4,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/MakeNowJust/heredoc"
 	"github.com/jwalton/pixdl/internal/log"
@@ -42,6 +43,7 @@ func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.pixdl.yaml)")
 	rootCmd.PersistentFlags().BoolP("verbose", "d", false, "Use verbose output")
+	rootCmd.PersistentFlags().String("output", "text", `Output format - "text" or "json" (one JSON object per line), or "csv" for "pixdl list"`)
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -59,11 +61,14 @@ func initConfig() {
 		viper.SetConfigName(".pixdl")
 	}
 
-	viper.AutomaticEnv() // read in environment variables that match
+	// read in environment variables that match (e.g. PIXDL_MAX_PAGES for "max-pages").
+	viper.SetEnvPrefix("pixdl")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 	}
 
 }
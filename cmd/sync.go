@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/jwalton/pixdl/cmd/reporters"
+	"github.com/jwalton/pixdl/internal/log"
+	"github.com/jwalton/pixdl/pkg/pixdl"
+	"github.com/spf13/cobra"
+)
+
+// syncCmd represents the sync command
+var syncCmd = &cobra.Command{
+	Use:   "sync [folder...]",
+	Short: "Download new images for every album previously downloaded into a folder",
+	Long: heredoc.Doc(`
+		Searches each folder (and all subfolders) for albums that were previously
+		downloaded with "pixdl get", and downloads any new images from those albums
+		using the same filename template and filters that were originally used.
+
+		If no folder is specified, the current directory is used.
+	`),
+	Example: heredoc.Doc(`
+		# Fetch new images for every album in the current directory
+		pixdl sync
+
+		# Fetch new images for every album under ~/forums and ~/galleries
+		pixdl sync ~/forums ~/galleries
+	`),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		roots := args
+		if len(roots) == 0 {
+			cwd, err := os.Getwd()
+			if err != nil {
+				log.PixdlFatalf("Unable to determine working directory: %v", err)
+			}
+			roots = []string{cwd}
+		}
+
+		manifests := []*pixdl.Manifest{}
+		// rootFolders is the folder holding the dedupe index for each manifest.
+		rootFolders := map[*pixdl.Manifest]string{}
+		for _, root := range roots {
+			found, err := pixdl.FindManifests(root)
+			if err != nil {
+				log.PixdlFatalf("Error searching %s: %v", root, err)
+			}
+			for _, manifest := range found {
+				rootFolders[manifest] = findDedupeRoot(manifest.Folder(), root)
+			}
+			manifests = append(manifests, found...)
+		}
+
+		reporter := reporters.NewSummaryReporter(getReporter(cmd))
+
+		// Stop downloading on Ctrl-C.  Any partially downloaded files will be
+		// left on disk, so they can be resumed next time.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		downloader := newDownloader(cmd)
+
+		for _, manifest := range manifests {
+			for _, album := range sortedAlbums(manifest) {
+				options := album.DownloadOptions(manifest.Folder())
+				options.RootFolder = rootFolders[manifest]
+				options.Params = getParamsOption(cmd, getHost(album.URL))
+				downloader.DownloadAlbumContext(ctx, album.URL, options, reporter)
+			}
+		}
+
+		downloader.Wait()
+		downloader.Close()
+
+		if ctx.Err() != nil {
+			stop()
+			log.PixdlFatal("Sync cancelled - run the same command again to resume")
+		}
+
+		printSummary(cmd, reporter)
+		if reporter.FailedAlbums() > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// findDedupeRoot returns the folder whose dedupe index should be used for
+// albums in `folder`.  This is the closest folder at or above `folder` which
+// already has a dedupe index (usually the folder passed to "pixdl get"), or
+// `root` if there isn't one.
+func findDedupeRoot(folder string, root string) string {
+	dir, err := filepath.Abs(folder)
+	if err != nil {
+		return root
+	}
+
+	for {
+		if _, err := os.Stat(pixdl.DedupeIndexPath(dir)); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return root
+		}
+		dir = parent
+	}
+}
+
+// sortedAlbums returns all albums in the manifest, sorted by URL.
+func sortedAlbums(manifest *pixdl.Manifest) []*pixdl.AlbumManifest {
+	result := make([]*pixdl.AlbumManifest, 0, len(manifest.Albums))
+	for _, album := range manifest.Albums {
+		result = append(result, album)
+	}
+	sort.Slice(result, func(i int, j int) bool {
+		return result[i].URL < result[j].URL
+	})
+	return result
+}
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+	addDownloaderFlags(syncCmd)
+	syncCmd.Flags().StringArrayP("param", "p", []string{}, "Specify a parameter to pass to providers")
+}
@@ -1,15 +1,32 @@
 package cmd
 
 import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/jwalton/go-supportscolor"
 	"github.com/jwalton/pixdl/cmd/reporters"
+	"github.com/jwalton/pixdl/internal/log"
+	"github.com/jwalton/pixdl/pkg/download"
 	"github.com/jwalton/pixdl/pkg/pixdl"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
-func getReporter(verbose bool) pixdl.ProgressReporter {
+// getReporter returns the ProgressReporter to use, based on the "--verbose"
+// and "--output" flags.
+func getReporter(cmd *cobra.Command) pixdl.ProgressReporter {
 	var result pixdl.ProgressReporter
 
-	if verbose || !supportscolor.Stdout().SupportsColor {
+	verbose, err := cmd.Flags().GetBool("verbose")
+	log.PixdlDieOnError(err)
+
+	if isJSONOutput(cmd) {
+		result = reporters.NewJSONReporter(os.Stdout)
+	} else if verbose || !supportscolor.Stdout().SupportsColor {
 		result = reporters.NewVerboseReporter()
 	} else {
 		var err error
@@ -21,3 +38,291 @@ func getReporter(verbose bool) pixdl.ProgressReporter {
 
 	return result
 }
+
+// newDownloader creates a new ImageDownloader configured from the command
+// line flags and the config file.
+func newDownloader(cmd *cobra.Command) pixdl.ImageDownloader {
+	retryTimeout, err := time.ParseDuration(getStringOption(cmd, "retry-timeout", ""))
+	if err != nil {
+		log.PixdlFatalf("Invalid value for retry-timeout: %v", err)
+	}
+	retryPolicy := download.NewBackoffPolicy()
+	retryPolicy.MaxRetries = uint(getIntOption(cmd, "retries", ""))
+	retryPolicy.MaxElapsed = retryTimeout
+
+	onConflict, err := pixdl.ParseConflictPolicy(getStringOption(cmd, "on-conflict", ""))
+	if err != nil {
+		log.PixdlFatalf("Invalid value for on-conflict: %v", err)
+	}
+
+	dedupe, err := pixdl.ParseDedupeMode(getStringOption(cmd, "dedupe", ""))
+	if err != nil {
+		log.PixdlFatalf("Invalid value for dedupe: %v", err)
+	}
+
+	sidecars, err := pixdl.ParseSidecarMode(getStringOption(cmd, "sidecars", ""))
+	if err != nil {
+		log.PixdlFatalf("Invalid value for sidecars: %v", err)
+	}
+
+	parallel := getIntOption(cmd, "parallel", "")
+	segments := getIntOption(cmd, "segments", "")
+	minConnections := parallel
+	if segments > minConnections {
+		minConnections = segments
+	}
+
+	scheduler := newScheduler(cmd, minConnections)
+	client := download.NewClient(
+		download.WithRetryPolicy(retryPolicy),
+		download.Verify(getBoolOption(cmd, "verify", "")),
+		download.Segments(uint(segments), 0),
+		download.WithRateLimiter(newRateLimiter(cmd)),
+		download.WithScheduler(scheduler),
+		download.ComputeSHA256(dedupe != pixdl.DedupeOff),
+	)
+
+	return pixdl.NewConcurrentDownloader(
+		pixdl.SetMaxConcurrency(uint(parallel)),
+		pixdl.SetClient(client),
+		pixdl.SetScheduler(scheduler),
+		pixdl.SetConflictPolicy(onConflict),
+		pixdl.SetDedupe(dedupe),
+		pixdl.SetSidecars(sidecars),
+		pixdl.SetEmbedMetadata(getBoolOption(cmd, "embed-metadata", "")),
+	)
+}
+
+// addDownloaderFlags adds flags used by newDownloader to the given command.
+func addDownloaderFlags(cmd *cobra.Command) {
+	cmd.Flags().Int("parallel", 4, "Maximum number of files to download concurrently")
+	cmd.Flags().Bool("verify", false, "Verify the size (and checksum, if known) of each file after downloading")
+	cmd.Flags().Int("segments", 1, "Number of connections to use to download each large file")
+	cmd.Flags().Int("retries", 20, "Maximum number of times to retry a failed download")
+	cmd.Flags().String("retry-timeout", "0s", "Give up retrying a file after this long (e.g. 10m), 0 for no limit")
+	cmd.Flags().String("limit-rate", "0", "Maximum download speed in bytes per second (e.g. 500K, 2M), 0 for no limit")
+	addSchedulerFlags(cmd)
+	cmd.Flags().String("on-conflict", "skip", `What to do when a file already exists: "skip", "overwrite",
+"rename-with-suffix", "rename-with-index", or "compare-size-then-decide"`)
+	cmd.Flags().String("dedupe", "off", `What to do with files identical to one already downloaded: "off", "hardlink",
+"symlink", or "skip" (delete the duplicate)`)
+	cmd.Flags().String("sidecars", "none", `Metadata files to write: "none", "album" (an album.json in each album's folder),
+or "all" (album.json, and a <file>.json next to each image)`)
+	cmd.Flags().Bool("embed-metadata", false, "Write the source URL, album, author, title, and timestamp into each JPEG and PNG file")
+}
+
+// addSchedulerFlags adds flags used by newScheduler to the given command.
+func addSchedulerFlags(cmd *cobra.Command) {
+	cmd.Flags().Float64("requests-per-second", 5, "Maximum number of requests per second to any one host, 0 for no limit")
+	cmd.Flags().Int("connections-per-host", 4, "Maximum number of concurrent connections to any one host, 0 for no limit\n(raised to --parallel or --segments if either is larger, unless set explicitly)")
+}
+
+// newScheduler creates a Scheduler from the "--requests-per-second" and
+// "--connections-per-host" flags, and from the same settings for each host
+// in the config file.
+//
+// minConnections is the number of connections pixdl wants to make to a host
+// at once (e.g. the larger of "--parallel" and "--segments").  If
+// "connections-per-host" hasn't been set, the default is raised to
+// minConnections.  If it has been set to something smaller, a warning is
+// printed.
+func newScheduler(cmd *cobra.Command, minConnections int) *download.Scheduler {
+	getLimits := func(host string) download.HostLimits {
+		value, isSet := lookupOption(cmd, "connections-per-host", host)
+		maxConnections, err := strconv.Atoi(value)
+		if err != nil {
+			log.PixdlFatalf("Invalid value for connections-per-host: %s", value)
+		}
+
+		if maxConnections > 0 && maxConnections < minConnections {
+			if !isSet {
+				maxConnections = minConnections
+			} else if _, hostSet := getHostConfig(host)["connections-per-host"]; host == "" || hostSet {
+				hostName := host
+				if hostName == "" {
+					hostName = "any one host"
+				}
+				log.PixdlWarnf(
+					"Warning: connections-per-host is %d, so at most %d of %d connections will be made to %s at once",
+					maxConnections, maxConnections, minConnections, hostName,
+				)
+			}
+		}
+
+		return download.HostLimits{
+			RequestsPerSecond: getFloatOption(cmd, "requests-per-second", host),
+			MaxConnections:    maxConnections,
+		}
+	}
+
+	scheduler := download.NewScheduler(getLimits(""))
+	for host, hostConfig := range viper.GetStringMap("hosts") {
+		config := toStringMap(hostConfig)
+		_, hasRequests := config["requests-per-second"]
+		_, hasConnections := config["connections-per-host"]
+		if hasRequests || hasConnections {
+			scheduler.SetHostLimits(host, getLimits(host))
+		}
+	}
+
+	return scheduler
+}
+
+// newRateLimiter creates a RateLimiter from the "--limit-rate" flag, and from
+// the "limit-rate" setting for each host in the config file.
+func newRateLimiter(cmd *cobra.Command) *download.RateLimiter {
+	limiter := download.NewRateLimiter()
+
+	limit, err := parseSize(getStringOption(cmd, "limit-rate", ""))
+	if err != nil {
+		log.PixdlFatalf("Invalid value for limit-rate: %v", err)
+	}
+	limiter.SetLimit(limit)
+
+	for host, hostConfig := range viper.GetStringMap("hosts") {
+		value, ok := toStringMap(hostConfig)["limit-rate"]
+		if !ok {
+			continue
+		}
+		hostLimit, err := parseSize(fmt.Sprint(value))
+		if err != nil {
+			log.PixdlFatalf("Invalid value for limit-rate for %s: %v", host, err)
+		}
+		limiter.SetHostLimit(host, hostLimit)
+	}
+
+	return limiter
+}
+
+// parseSize parses a size in bytes, such as "1024", "500K", "2M", or "1.5GB".
+// Suffixes are powers of 1024.
+func parseSize(value string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(value))
+	str = strings.TrimSuffix(str, "B")
+
+	multiplier := int64(1)
+	if len(str) > 0 {
+		switch str[len(str)-1] {
+		case 'K':
+			multiplier = 1024
+		case 'M':
+			multiplier = 1024 * 1024
+		case 'G':
+			multiplier = 1024 * 1024 * 1024
+		}
+		if multiplier != 1 {
+			str = str[:len(str)-1]
+		}
+	}
+
+	number, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return int64(number * float64(multiplier)), nil
+}
+
+// formatSize formats a size in bytes the same way parseSize reads it, such as
+// "512", "1.5K", or "2.0G".  Returns "-" for an unknown size.
+func formatSize(size int64) string {
+	if size < 0 {
+		return "-"
+	}
+
+	value := float64(size)
+	for _, suffix := range []string{"", "K", "M", "G"} {
+		if value < 1024 || suffix == "G" {
+			if suffix == "" {
+				return strconv.FormatInt(size, 10)
+			}
+			return fmt.Sprintf("%.1f%s", value, suffix)
+		}
+		value /= 1024
+	}
+	return ""
+}
+
+// isJSONOutput returns true if the user asked for JSON output.
+func isJSONOutput(cmd *cobra.Command) bool {
+	output, err := cmd.Flags().GetString("output")
+	log.PixdlDieOnError(err)
+
+	switch output {
+	case "json":
+		return true
+	case "text":
+		return false
+	default:
+		log.PixdlFatalf("Invalid output format: %s", output)
+		return false
+	}
+}
+
+// printSummary prints the summary of all downloaded albums, in the format
+// requested by the user.
+func printSummary(cmd *cobra.Command, reporter *reporters.SummaryReporter) {
+	if isJSONOutput(cmd) {
+		reporter.PrintJSON()
+	} else {
+		reporter.Print()
+	}
+}
+
+// dateFormats are the formats accepted by parseDate, other than RFC 3339.
+var dateFormats = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+}
+
+// parseDate parses a date for "--since" or "--until".  This can be an RFC 3339
+// timestamp, a date and time in local time (e.g. "2021-05-01 13:30"), a date
+// (e.g. "2021-05-01"), or an age such as "36h" or "7d" which is subtracted from
+// the current time.  A date on its own is the start of that day, or the end of
+// that day if `endOfDay` is true.  Returns nil for "".
+func parseDate(value string, endOfDay bool) (*time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
+	}
+	for _, format := range dateFormats {
+		if t, err := time.ParseInLocation(format, value, time.Local); err == nil {
+			return &t, nil
+		}
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return &t, nil
+	}
+
+	age, err := parseAge(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid date: %s", value)
+	}
+	t := time.Now().Add(-age)
+	return &t, nil
+}
+
+// parseAge parses a duration like "36h" or "7d".
+func parseAge(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(value, "d"), 64)
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid duration: %s", value)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid duration: %s", value)
+	}
+	return age, nil
+}
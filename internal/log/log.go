@@ -17,6 +17,11 @@ func PixdlErrorf(message string, a ...interface{}) {
 	os.Stderr.Write([]byte(gchalk.Stderr.BrightRed(fmt.Sprintf(message, a...)) + "\n"))
 }
 
+// PixdlWarnf writes a formatted warning message to stderr.
+func PixdlWarnf(message string, a ...interface{}) {
+	os.Stderr.Write([]byte(gchalk.Stderr.BrightYellow(fmt.Sprintf(message, a...)) + "\n"))
+}
+
 // PixdlFatal writes an error message to stderr, and then exits with a non-zero status code.
 func PixdlFatal(message interface{}) {
 	PixdlFatalf("%v", message)
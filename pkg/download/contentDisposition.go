@@ -0,0 +1,147 @@
+package download
+
+import (
+	"mime"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseContentDisposition returns the filename from a Content-Disposition
+// header, as per RFC 6266.  If the header has both a `filename*` (RFC 5987)
+// and a `filename` parameter, `filename*` is preferred.  Any directory
+// components are removed from the filename.  Returns "" if the header has no
+// filename.
+func parseContentDisposition(header string) string {
+	if strings.TrimSpace(header) == "" {
+		return ""
+	}
+
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		// Lots of servers send headers that aren't quite right, so fall back
+		// to a more forgiving parser.
+		params = parseParamsLenient(header)
+	}
+
+	// mime.ParseMediaType will decode `filename*`, but only for UTF-8, and if
+	// it can't decode it, it'll quietly use `filename` instead.
+	if encoded, ok := parseParamsLenient(header)["filename*"]; ok {
+		if decoded, ok := decodeExtValue(encoded); ok {
+			params["filename"] = decoded
+		}
+	}
+
+	return stripPath(params["filename"])
+}
+
+// parseParamsLenient parses the parameters from a header such as
+// `attachment; filename="foo.jpg"`.  This accepts unquoted values with
+// spaces in them, and other common mistakes.  Parameter names are lowercased.
+func parseParamsLenient(header string) map[string]string {
+	result := map[string]string{}
+
+	for _, part := range splitParams(header) {
+		eq := strings.Index(part, "=")
+		if eq == -1 {
+			continue
+		}
+
+		name := strings.ToLower(strings.TrimSpace(part[:eq]))
+		value := strings.TrimSpace(part[eq+1:])
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = unquote(value[1 : len(value)-1])
+		}
+
+		if _, exists := result[name]; !exists {
+			result[name] = value
+		}
+	}
+
+	return result
+}
+
+// splitParams splits a header on ";", ignoring any ";" in quoted strings.
+func splitParams(header string) []string {
+	result := []string{}
+	start := 0
+	inQuotes := false
+	escaped := false
+
+	for i := 0; i < len(header); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case header[i] == '\\' && inQuotes:
+			escaped = true
+		case header[i] == '"':
+			inQuotes = !inQuotes
+		case header[i] == ';' && !inQuotes:
+			result = append(result, header[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(result, header[start:])
+}
+
+// unquote removes backslash escapes from the contents of a quoted string.
+func unquote(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+
+	result := strings.Builder{}
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+		}
+		result.WriteByte(value[i])
+	}
+	return result.String()
+}
+
+// decodeExtValue decodes an RFC 5987 "ext-value", such as
+// `UTF-8'en'na%C3%AFve.jpg`.  Supports UTF-8 and ISO-8859-1.
+func decodeExtValue(value string) (string, bool) {
+	parts := strings.SplitN(value, "'", 3)
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	charset := strings.ToLower(strings.TrimSpace(parts[0]))
+	decoded, err := url.PathUnescape(parts[2])
+	if err != nil {
+		return "", false
+	}
+
+	switch charset {
+	case "utf-8", "us-ascii", "":
+		if !utf8.ValidString(decoded) {
+			return "", false
+		}
+		return decoded, true
+	case "iso-8859-1", "latin1":
+		runes := make([]rune, len(decoded))
+		for i := 0; i < len(decoded); i++ {
+			runes[i] = rune(decoded[i])
+		}
+		return string(runes), true
+	default:
+		return "", false
+	}
+}
+
+// stripPath removes any directory components from a filename, so a server
+// can't send us something like "../../.bashrc".
+func stripPath(filename string) string {
+	if index := strings.LastIndexAny(filename, `/\`); index != -1 {
+		filename = filename[index+1:]
+	}
+
+	filename = strings.TrimSpace(filename)
+	if filename == "." || filename == ".." {
+		return ""
+	}
+	return filename
+}
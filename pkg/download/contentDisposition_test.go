@@ -0,0 +1,49 @@
+package download
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseContentDisposition(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{``, ``},
+		{`attachment`, ``},
+		{`inline`, ``},
+		{`attachment; filename="foo.jpg"`, `foo.jpg`},
+		{`inline; filename="foo.jpg"`, `foo.jpg`},
+		{`attachment; filename=foo.jpg`, `foo.jpg`},
+		{`Attachment; FILENAME="foo.jpg"`, `foo.jpg`},
+		{`attachment; filename="foo.jpg";`, `foo.jpg`},
+		{`attachment; filename="foo; bar.jpg"`, `foo; bar.jpg`},
+		{`attachment; filename="foo \"bar\".jpg"`, `foo "bar".jpg`},
+		{`attachment; filename=foo bar.jpg`, `foo bar.jpg`},
+		{`filename="foo.jpg"`, `foo.jpg`},
+		{`attachment; size=123; filename="foo.jpg"`, `foo.jpg`},
+
+		// RFC 5987 encoded filenames.
+		{`attachment; filename*=UTF-8''na%C3%AFve%20file.jpg`, `naïve file.jpg`},
+		{`attachment; filename*=utf-8''%E2%82%AC%20rates.jpg`, `€ rates.jpg`},
+		{`attachment; filename*=UTF-8'en'foo.jpg`, `foo.jpg`},
+		{`attachment; filename*=ISO-8859-1''caf%E9.jpg`, `café.jpg`},
+		{`attachment; filename="fallback.jpg"; filename*=UTF-8''%E2%82%AC.jpg`, `€.jpg`},
+		{`attachment; filename*=UTF-8''%E2%82%AC.jpg; filename="fallback.jpg"`, `€.jpg`},
+		{`attachment; filename="fallback.jpg"; filename*=ISO-8859-1''caf%E9.jpg`, `café.jpg`},
+		{`attachment; filename="fallback.jpg"; filename*=KOI8-R''%E6.jpg`, `fallback.jpg`},
+
+		// Path components should be removed.
+		{`attachment; filename="../../etc/passwd"`, `passwd`},
+		{`attachment; filename="/tmp/foo.jpg"`, `foo.jpg`},
+		{`attachment; filename="C:\\Users\\me\\foo.jpg"`, `foo.jpg`},
+		{`attachment; filename*=UTF-8''..%2F..%2Ffoo.jpg`, `foo.jpg`},
+		{`attachment; filename=".."`, ``},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, parseContentDisposition(test.header), test.header)
+	}
+}
@@ -1,8 +1,11 @@
 package download
 
 import (
+	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"os"
@@ -12,14 +15,32 @@ import (
 
 const partialSuffix = ".part"
 const defaultMaxRetries = 20
-const defaultRetryDelay = 5 * time.Second
 
 // Client is a client to use for downloading files.  Note that you must
 // construct a Client via `NewClient`.
 type Client struct {
 	httpClient *http.Client
-	MaxRetries uint
-	RetryDelay time.Duration
+	// RetryPolicy decides when to retry failed downloads.
+	RetryPolicy RetryPolicy
+	// Verify, if true, will cause the client to verify the size (and the MD5
+	// hash, if known) of each file once it has been downloaded.
+	Verify bool
+	// ComputeSHA256, if true, will cause the client to compute the SHA-256
+	// hash of each file as it is downloaded.
+	ComputeSHA256 bool
+	// Segments is the number of concurrent connections to use when downloading
+	// large files.  0 or 1 to download every file over a single connection.
+	Segments uint
+	// SegmentMinSize is the minimum size, in bytes, of a file before we
+	// will download it in segments.
+	SegmentMinSize int64
+	// RateLimiter, if set, limits how fast files are downloaded.
+	RateLimiter *RateLimiter
+	// scheduler, if set, limits how many requests are made to each host.
+	scheduler *Scheduler
+	// maxRetries, if set, is applied to RetryPolicy once all options have
+	// been applied.
+	maxRetries *uint
 }
 
 // Option is an option that can be passed to NewClient.
@@ -37,31 +58,92 @@ func WithClient(httpClient *http.Client) Option {
 // MaxRetries is an option for NewClient that sets the maximum number
 // of times the DownloadClient will attempt to download the same file before
 // giving up.  DownloadClient will only attempt to retry for "recoverable"
-// errors, such as 5xx errors from the server, or similar.
+// errors, such as 5xx errors from the server, or similar.  This only has
+// an effect if the client is using a BackoffPolicy, and takes effect after
+// all other options, so it can be passed before or after WithRetryPolicy.
 func MaxRetries(retries uint) Option {
 	return func(client *Client) {
-		client.MaxRetries = retries
+		client.maxRetries = &retries
+	}
+}
+
+// WithRetryPolicy is an option for NewClient that sets the RetryPolicy used to
+// decide when to retry failed downloads.  If unspecified, the client will use
+// a BackoffPolicy with default settings.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(client *Client) {
+		client.RetryPolicy = policy
+	}
+}
+
+// Verify is an option for NewClient that makes the client verify each file
+// after it has been downloaded.  The size of the file will be checked against
+// the size reported by the server, and if `RemoteFileInfo.MD5` is set the MD5
+// hash of the file will be checked as well.  If a file fails verification,
+// it will be deleted and downloaded again.
+func Verify(verify bool) Option {
+	return func(client *Client) {
+		client.Verify = verify
+	}
+}
+
+// WithRateLimiter is an option for NewClient which limits the rate at which
+// files will be downloaded.  The limits on the RateLimiter can be changed
+// at any time.
+func WithRateLimiter(limiter *RateLimiter) Option {
+	return func(client *Client) {
+		client.RateLimiter = limiter
+	}
+}
+
+// WithScheduler is an option for NewClient which sends all requests via
+// the given Scheduler.
+func WithScheduler(scheduler *Scheduler) Option {
+	return func(client *Client) {
+		client.scheduler = scheduler
 	}
 }
 
 // NewClient creates a new DownloadClient.
 func NewClient(options ...Option) *Client {
 	client := &Client{
-		httpClient: http.DefaultClient,
-		MaxRetries: defaultMaxRetries,
-		RetryDelay: defaultRetryDelay,
+		httpClient:     http.DefaultClient,
+		RetryPolicy:    NewBackoffPolicy(),
+		SegmentMinSize: defaultSegmentMinSize,
 	}
 
 	for _, option := range options {
 		option(client)
 	}
 
+	if policy, ok := client.RetryPolicy.(*BackoffPolicy); ok && client.maxRetries != nil {
+		// Copy the policy, so we don't change a policy passed to WithRetryPolicy.
+		withMaxRetries := *policy
+		withMaxRetries.MaxRetries = *client.maxRetries
+		client.RetryPolicy = &withMaxRetries
+	}
+
+	if client.scheduler != nil {
+		client.httpClient = client.scheduler.Client(client.httpClient)
+	}
+
 	return client
 }
 
 // GetFile downloads a file using a simple GET request to the specified URL.
 func (client *Client) GetFile(url string, filename string, reporter FileProgressCallback) (written int64, err error) {
-	request, err := http.NewRequest("GET", url, nil)
+	return client.GetFileContext(context.Background(), url, filename, reporter)
+}
+
+// GetFileContext is like GetFile, but the download will be aborted if the
+// given context is cancelled.
+func (client *Client) GetFileContext(
+	ctx context.Context,
+	url string,
+	filename string,
+	reporter FileProgressCallback,
+) (written int64, err error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		reporter(newErrorProgress(request, url, filename, nil, err))
 		return 0, err
@@ -85,6 +167,18 @@ func (client *Client) Do(
 	return client.DoWithFileInfo(request, filename, nil, reporter)
 }
 
+// DoContext is like Do, but the download will be aborted if the given context
+// is cancelled.  If the download is aborted, any partially downloaded file
+// will be left on disk so the download can be resumed later.
+func (client *Client) DoContext(
+	ctx context.Context,
+	request *http.Request,
+	filename string,
+	reporter FileProgressCallback,
+) (written int64, err error) {
+	return client.DoWithFileInfoContext(ctx, request, filename, nil, reporter)
+}
+
 // DoWithFileInfo is simliar to Do(), but will not try to fetch RemoteFileInfo from the
 // remote server - this is handy when you've already fetched the file info.  If
 // you pass `nil` for remoteInfo, then DoWithFileInfo will still try to fetch
@@ -95,6 +189,20 @@ func (client *Client) DoWithFileInfo(
 	remoteInfo *RemoteFileInfo,
 	reporter FileProgressCallback,
 ) (written int64, err error) {
+	return client.DoWithFileInfoContext(request.Context(), request, filename, remoteInfo, reporter)
+}
+
+// DoWithFileInfoContext is like DoWithFileInfo, but the download will be aborted
+// if the given context is cancelled.
+func (client *Client) DoWithFileInfoContext(
+	ctx context.Context,
+	request *http.Request,
+	filename string,
+	remoteInfo *RemoteFileInfo,
+	reporter FileProgressCallback,
+) (written int64, err error) {
+	request = request.WithContext(ctx)
+
 	if remoteInfo == nil {
 		// Ignore error from DoFileInfo - possibly the remote doesn't support HEAD.
 		// Press on, and we'll probably error out down below.
@@ -102,36 +210,54 @@ func (client *Client) DoWithFileInfo(
 	}
 	pw := newProgressWriter(request, filename, remoteInfo, reporter)
 	var totalWritten int64 = 0
-
-	triesLeft := client.MaxRetries + 1
-	downloading := true
-	for downloading {
-		written, httpErr := client.doDownload(request, filename, remoteInfo, pw)
-		totalWritten += written
-
-		if httpErr != nil {
-			if httpErr.canRetry {
-				if strings.Contains(httpErr.Error(), "INTERNAL_ERROR") && written > 0 && remoteInfo.CanResume {
-					// See these fairly often from some servers - if we see these
-					// and `remoteInfo.CanResume`, then don't count against retriesLeft,
-					// keep going.
-				} else if strings.Contains(httpErr.Error(), "connection reset by peer") && written > 0 && remoteInfo.CanResume {
-					// Retry immediately.
-				} else {
-					pw.Warn(fmt.Sprintf("Error: %v - will retry", httpErr))
-					triesLeft--
-					// Short pause here, to give the server time to think about it's life choices...
-					<-time.After(client.RetryDelay)
-				}
+	segmented := client.shouldSegment(filename, remoteInfo)
+
+	retries := newRetrier(client.RetryPolicy)
+	for {
+		retries.attempt()
+
+		var written int64
+		var httpErr *Error
+		if segmented {
+			written, httpErr = client.doSegmentedDownload(ctx, request, filename, remoteInfo, pw)
+			if isRangeNotSupported(httpErr) {
+				// Server doesn't really support ranges - fall back to a single connection.
+				segmented = false
+				totalWritten += written
 			}
+		}
+		if !segmented {
+			written, httpErr = client.doDownload(request, filename, remoteInfo, pw)
+		}
+		totalWritten += written
 
-			if !httpErr.canRetry || triesLeft <= 0 {
-				downloading = false
-				err = httpErr
-			}
-		} else {
+		if httpErr == nil {
 			// We're done!
-			downloading = false
+			break
+		}
+
+		if ctx.Err() != nil {
+			// Cancelled - leave the partial file where it is so we can resume later.
+			err = ctx.Err()
+			break
+		}
+
+		if !httpErr.canRetry() {
+			err = httpErr.withDetails(request.URL.String(), retries.attempts)
+			break
+		}
+
+		delay, retry := retries.next(httpErr, written > 0 && remoteInfo.CanResume)
+		pw.Warn(retryMessage(httpErr, delay, retry))
+		if !retry {
+			err = httpErr.withDetails(request.URL.String(), retries.attempts)
+			break
+		}
+
+		// Short pause here, to give the server time to think about it's life choices...
+		if sleepErr := sleepContext(ctx, delay); sleepErr != nil {
+			err = sleepErr
+			break
 		}
 	}
 
@@ -145,18 +271,18 @@ func (client *Client) DoWithFileInfo(
 // If canResume is true, and the file already exists, we'll open it for appending.
 // Returns the file, the place we would like to start writing in the file, and
 // an error.
-func openFileForWriting(filename string, canResume bool) (file *os.File, size int64, httpErr *httpError) {
+func openFileForWriting(filename string, canResume bool) (file *os.File, size int64, httpErr *Error) {
 	// See if the file already exists.
 	info, err := os.Stat(filename)
 	if errors.Is(err, os.ErrNotExist) {
 		// Drop throught to create a new file case below.
 	} else if err != nil {
-		return nil, 0, &httpError{message: "Could not stat file " + filename}
+		return nil, 0, &Error{message: "Could not stat file " + filename}
 	} else if canResume {
 		// We can resume!
 		file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 		if err != nil {
-			return nil, 0, &httpError{message: "Could not open file for appending"}
+			return nil, 0, &Error{message: "Could not open file for appending"}
 		}
 		return file, info.Size(), nil
 	}
@@ -164,17 +290,26 @@ func openFileForWriting(filename string, canResume bool) (file *os.File, size in
 	// Create a new file
 	file, err = os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
-		return nil, 0, &httpError{message: "Could not open file"}
+		return nil, 0, &Error{message: "Could not open file"}
 	}
 	return file, 0, nil
 }
 
+// discardPartialFile closes a partial file that we're not going to write to,
+// and deletes it if it was empty.
+func discardPartialFile(file *os.File, existingSize int64) {
+	_ = file.Close()
+	if existingSize == 0 {
+		_ = os.Remove(file.Name())
+	}
+}
+
 func (client *Client) doDownload(
 	request *http.Request,
 	filename string,
 	remoteInfo *RemoteFileInfo,
 	pw *progressWriter,
-) (written int64, httpErr *httpError) {
+) (written int64, httpErr *Error) {
 	file, existingSize, httpErr := openFileForWriting(filename+partialSuffix, remoteInfo.CanResume)
 	// Don't defer close of the file so we can rename the file after we close it.
 
@@ -182,71 +317,246 @@ func (client *Client) doDownload(
 		return 0, httpErr
 	}
 
+	// If the file has changed on the server since we started downloading it,
+	// then the partial file is no good to us.
+	saved := readPartialInfo(filename)
+	if existingSize > 0 && saved != nil {
+		if warning := saved.mismatch(request.URL.String(), remoteInfo); warning != "" {
+			pw.Warn(warning)
+			if httpErr = truncatePartialFile(file); httpErr != nil {
+				return 0, httpErr
+			}
+			existingSize = 0
+		}
+	}
+
+	if existingSize > 0 && remoteInfo.Size > -1 && existingSize > remoteInfo.Size {
+		pw.Warn("Partial file is larger than the file on the server - restarting download")
+		if httpErr = truncatePartialFile(file); httpErr != nil {
+			return 0, httpErr
+		}
+		existingSize = 0
+	}
+
+	if existingSize > 0 && existingSize == remoteInfo.Size {
+		// We already have the whole file - we must have been interrupted
+		// before we could rename it.  There's nothing left to request (and
+		// asking for an empty range would get us a 416), so just finish up.
+		pw.progress.Total = existingSize
+		pw.setSize(existingSize)
+		hashes := client.newFileHashes(remoteInfo)
+		if httpErr = hashes.hashExisting(filename+partialSuffix, existingSize); httpErr != nil {
+			_ = file.Close()
+			return 0, httpErr
+		}
+		return 0, client.finishDownload(file, filename, existingSize, -1, hashes, remoteInfo, pw)
+	}
+
 	// Start the HTTP request.
 	var err error
 	var resp *http.Response
 	if existingSize > 0 {
-		resp, err = client.resumeDownload(request, existingSize, remoteInfo.Size-1)
+		ifRange := ""
+		if saved != nil {
+			ifRange = saved.ifRange()
+		}
+		resp, err = client.resumeDownload(request, existingSize, remoteInfo.Size-1, ifRange)
 		pw.setSize(existingSize)
+
+		if err == nil && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			// The server doesn't think the range we asked for exists, so the
+			// partial file doesn't match what's on the server.  Start over.
+			resp.Body.Close()
+			pw.Warn("Server rejected resume range - restarting download")
+			if httpErr = truncatePartialFile(file); httpErr != nil {
+				return 0, httpErr
+			}
+			existingSize = 0
+			resp, err = client.httpClient.Do(request)
+			pw.setSize(0)
+		}
 	} else {
 		resp, err = client.httpClient.Do(request)
 		pw.setSize(0)
 	}
 
 	if err != nil {
-		return 0, &httpError{canRetry: true, message: err.Error()}
+		discardPartialFile(file, existingSize)
+		return 0, &Error{Class: classifyRequestError(err), message: err.Error(), Cause: err}
 	}
 
 	defer resp.Body.Close()
 
-	// Verify the response code.
-	if resp.StatusCode >= 500 && resp.StatusCode < 600 {
-		// Server error - should retry
-		return 0, &httpError{canRetry: true, message: fmt.Sprintf("Server replied with %d", resp.StatusCode)}
-	} else if resp.StatusCode < 200 && resp.StatusCode >= 300 {
-		return 0, &httpError{canRetry: false, message: fmt.Sprintf("Server replied with %d", resp.StatusCode)}
+	// Verify the response code.  Anything other than a 2xx is an error - we
+	// don't want to write a 404 page to disk as if it were the file.
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		discardPartialFile(file, existingSize)
+		return 0, statusCodeError(resp)
+	}
+
+	if existingSize > 0 && resp.StatusCode != http.StatusPartialContent {
+		// The server ignored our range request, or the file has changed
+		// and the If-Range check failed.  Either way, the server is sending
+		// us the whole file, so start again from the beginning.
+		pw.Warn("Server sent the whole file - restarting download")
+		if httpErr = truncatePartialFile(file); httpErr != nil {
+			return 0, httpErr
+		}
+		existingSize = 0
+		pw.setSize(0)
+	} else if existingSize > 0 {
+		if start, _, _, ok := parseContentRange(resp.Header.Get("content-range")); ok && start != existingSize {
+			_ = file.Close()
+			return 0, &Error{
+				Class:   ErrorServer,
+				message: fmt.Sprintf("Server sent range starting at %d, expected %d", start, existingSize),
+			}
+		}
+	}
+
+	if existingSize == 0 {
+		writePartialInfo(filename, newPartialInfo(request.URL.String(), resp))
 	}
 
+	expectedSize := int64(-1)
 	if resp.ContentLength > -1 {
 		pw.progress.Total = existingSize + resp.ContentLength
+		expectedSize = pw.progress.Total
 	} else {
 		pw.progress.Total = -1
 	}
 
+	var progressWriter io.Writer = pw
+	hashes := client.newFileHashes(remoteInfo)
+	if !hashes.empty() {
+		if httpErr = hashes.hashExisting(filename+partialSuffix, existingSize); httpErr != nil {
+			_ = file.Close()
+			return 0, httpErr
+		}
+		progressWriter = io.MultiWriter(pw, hashes)
+	}
+
 	// Copy data from the HTTP request to the file.
-	written, err = io.Copy(file, io.TeeReader(resp.Body, pw))
+	body := &readErrorRecorder{
+		reader: newRateLimitedReader(request.Context(), client.RateLimiter, request.URL.Hostname(), resp.Body),
+	}
+	written, err = io.Copy(file, io.TeeReader(body, progressWriter))
 	if err != nil {
 		_ = file.Close()
 		// Sometimes I see random "stream error: stream ID x; INTERNAL_ERROR" from
-		// certain sites.  If we see these, especially if the server supports resume,
-		// we should retry.
-		httpErr = &httpError{canRetry: true, message: fmt.Sprintf("Error downloading %s: %v", request.URL.String(), err)}
-		return written, httpErr
+		// certain sites.  These show up as read errors, and we'll retry them
+		// (right away, if the server supports resume).
+		return written, copyError(request.URL.String(), body, err)
+	}
+
+	return written, client.finishDownload(file, filename, existingSize+written, expectedSize, hashes, remoteInfo, pw)
+}
+
+// finishDownload closes a completely downloaded ".part" file, verifies it if
+// required, and moves it to its final destination.  `size` is the size of the
+// ".part" file, and `expectedSize` is the size the server told us to expect
+// for this response (or -1 if unknown).
+func (client *Client) finishDownload(
+	file *os.File,
+	filename string,
+	size int64,
+	expectedSize int64,
+	hashes *fileHashes,
+	remoteInfo *RemoteFileInfo,
+	pw *progressWriter,
+) *Error {
+	if err := file.Close(); err != nil {
+		return &Error{message: fmt.Sprintf("Error closing %s: %v", filename+partialSuffix, err)}
 	}
 
-	if err = file.Close(); err != nil {
-		httpErr = &httpError{message: fmt.Sprintf("Error closing %s: %v", filename+partialSuffix, err)}
-		return written, httpErr
+	if client.Verify {
+		httpErr := verifyDownload(
+			filename,
+			size,
+			[]int64{expectedSize, remoteInfo.Size},
+			hashes.md5,
+			remoteInfo.MD5,
+		)
+		if httpErr != nil {
+			return httpErr
+		}
 	}
 
 	// Move the file to the final destination.
-	if err = os.Rename(filename+partialSuffix, filename); err != nil {
-		httpErr = &httpError{
+	if err := os.Rename(filename+partialSuffix, filename); err != nil {
+		return &Error{
 			message: fmt.Sprintf("Error renaming %s to %s: %v", filename+partialSuffix, filename, err),
 		}
-		return written, httpErr
 	}
+	removePartialInfo(filename)
+	pw.progress.SHA256 = hashes.sha256Sum()
 
 	// Set the modified time of the file to match the one on the server.
 	if remoteInfo.LastModified != nil {
 		_ = os.Chtimes(filename, time.Now(), *remoteInfo.LastModified)
 	}
 
-	return written, nil
+	return nil
+}
+
+// verifyDownload checks that a freshly downloaded ".part" file has the expected
+// size and hash.  Any expected size of -1 is ignored.  If the file doesn't
+// match, the partial file is deleted so the next attempt will start again
+// from the beginning, and a retryable error is returned.
+func verifyDownload(
+	filename string,
+	size int64,
+	expectedSizes []int64,
+	hasher hash.Hash,
+	expectedMD5 string,
+) *Error {
+	message := ""
+	for _, expectedSize := range expectedSizes {
+		if expectedSize > -1 && size != expectedSize {
+			message = fmt.Sprintf("Downloaded %d bytes, expected %d", size, expectedSize)
+			break
+		}
+	}
+	if message == "" && hasher != nil && !strings.EqualFold(hex.EncodeToString(hasher.Sum(nil)), expectedMD5) {
+		message = fmt.Sprintf("MD5 mismatch: expected %s", expectedMD5)
+	}
+	if message == "" {
+		return nil
+	}
+
+	removePartialInfo(filename)
+	if err := os.Remove(filename + partialSuffix); err != nil {
+		return &Error{message: fmt.Sprintf("%s, and could not remove %s: %v", message, filename+partialSuffix, err)}
+	}
+	return &Error{Class: ErrorCorrupt, message: message}
 }
 
-func (client *Client) resumeDownload(request *http.Request, start int64, end int64) (*http.Response, error) {
+// resumeDownload requests the given range of a file.  If `ifRange` is not "",
+// it is sent as an If-Range header, so if the file has changed the server will
+// send us the whole file instead.
+func (client *Client) resumeDownload(request *http.Request, start int64, end int64, ifRange string) (*http.Response, error) {
 	req := request.Clone(request.Context())
-	req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if end >= start {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+	}
+	if ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
+	}
 	return client.httpClient.Do(req)
 }
+
+// truncatePartialFile throws away everything in a partial file, so we can
+// start downloading again from the beginning.
+func truncatePartialFile(file *os.File) *Error {
+	if err := file.Truncate(0); err != nil {
+		_ = file.Close()
+		return &Error{message: fmt.Sprintf("Could not truncate %s: %v", file.Name(), err), Cause: err}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		_ = file.Close()
+		return &Error{message: fmt.Sprintf("Could not seek %s: %v", file.Name(), err), Cause: err}
+	}
+	return nil
+}
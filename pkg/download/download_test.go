@@ -0,0 +1,379 @@
+package download
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyMD5(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello world"))
+	}))
+	defer server.Close()
+
+	client := NewClient(Verify(true), WithRetryPolicy(&BackoffPolicy{MaxRetries: 1}))
+	filename := filepath.Join(t.TempDir(), "file.txt")
+
+	// Good hash.
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	info := newRemoteFileInfo()
+	info.MD5 = "5eb63bbbe01eeed093cb22bb8f5acdc3"
+	written, err := client.DoWithFileInfo(req, filename, info, func(*Progress) {})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), written)
+	_, err = os.Stat(filename)
+	assert.Nil(t, err)
+
+	// Bad hash.
+	filename = filepath.Join(t.TempDir(), "file2.txt")
+	info.MD5 = "00000000000000000000000000000000"
+	_, err = client.DoWithFileInfo(req, filename, info, func(*Progress) {})
+	assert.NotNil(t, err)
+	_, err = os.Stat(filename)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filename + partialSuffix)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSegmentedDownload(t *testing.T) {
+	content := make([]byte, 100000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	client := NewClient(Segments(4, 1000), Verify(true))
+	filename := filepath.Join(t.TempDir(), "file.bin")
+
+	var lastProgress Progress
+	written, err := client.GetFile(server.URL, filename, func(progress *Progress) {
+		lastProgress = *progress
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), written)
+	assert.True(t, lastProgress.Done)
+	assert.Equal(t, int64(len(content)), lastProgress.Written)
+
+	result, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, content, result)
+
+	// Segment files should all be cleaned up.
+	matches, _ := filepath.Glob(filename + partialSuffix + "*")
+	assert.Empty(t, matches)
+}
+
+func TestSegmentedDownloadWithStaleSegments(t *testing.T) {
+	content := make([]byte, 100000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	// Leave behind a segment from an earlier attempt which used two segments.
+	filename := filepath.Join(t.TempDir(), "file[1].bin")
+	stale := filename + partialSuffix + ".0-49999"
+	assert.NoError(t, os.WriteFile(stale, bytes.Repeat([]byte("x"), 1000), 0644))
+
+	client := NewClient(Segments(4, 1000), Verify(true))
+	warnings := []string{}
+	written, err := client.GetFile(server.URL, filename, func(progress *Progress) {
+		if progress.Warning != "" {
+			warnings = append(warnings, progress.Warning)
+		}
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), written)
+	assert.Equal(t, []string{"Number of segments has changed - restarting download"}, warnings)
+
+	result, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, content, result)
+
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSegmentedDownloadRetriesSegment(t *testing.T) {
+	content := make([]byte, 100000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	sum := md5.Sum(content)
+
+	// Fail the request for one segment, then send garbage for it, before
+	// finally sending the right data.
+	requests := map[string]int{}
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		rangeHeader := r.Header.Get("Range")
+		requests[rangeHeader]++
+		count := requests[rangeHeader]
+		mutex.Unlock()
+
+		if rangeHeader == "bytes=50000-74999" {
+			if count == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			} else if count == 2 {
+				garbage := bytes.Repeat([]byte{0xff}, len(content))
+				http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(garbage))
+				return
+			}
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	client := NewClient(
+		Segments(4, 1000),
+		Verify(true),
+		WithRetryPolicy(&BackoffPolicy{MaxRetries: 3, InitialDelay: time.Millisecond, Multiplier: 1}),
+	)
+	filename := filepath.Join(t.TempDir(), "file.bin")
+	info := newRemoteFileInfo()
+	info.Size = int64(len(content))
+	info.MD5 = hex.EncodeToString(sum[:])
+	info.CanResume = true
+
+	warnings := []string{}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	_, err := client.DoWithFileInfo(req, filename, info, func(progress *Progress) {
+		if progress.Warning != "" {
+			warnings = append(warnings, progress.Warning)
+		}
+	})
+	assert.Nil(t, err)
+	assert.Len(t, warnings, 2)
+
+	result, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, content, result)
+
+	// The bad segment should have been retried on its own after the 503, and
+	// then once more after the MD5 check failed.
+	assert.Equal(t, 3, requests["bytes=50000-74999"])
+
+	matches, _ := filepath.Glob(filename + partialSuffix + "*")
+	assert.Empty(t, matches)
+}
+
+func TestComputeSHA256(t *testing.T) {
+	content := make([]byte, 100000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	sum := sha256.Sum256(content)
+	expected := hex.EncodeToString(sum[:])
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	for index, segments := range []uint{1, 4} {
+		client := NewClient(Segments(segments, 1000), ComputeSHA256(true))
+		filename := filepath.Join(dir, fmt.Sprintf("file%d.bin", index))
+
+		// Start with part of the file already on disk, to make sure resumed
+		// downloads are hashed correctly.
+		if segments == 1 {
+			assert.Nil(t, os.WriteFile(filename+partialSuffix, content[:1000], 0644))
+		}
+
+		var lastProgress Progress
+		_, err := client.GetFile(server.URL, filename, func(progress *Progress) {
+			lastProgress = *progress
+		})
+		assert.Nil(t, err)
+		assert.True(t, lastProgress.Done)
+		assert.Equal(t, expected, lastProgress.SHA256, "segments: %d", segments)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	client := NewClient()
+	filename := filepath.Join(t.TempDir(), "file.txt")
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	_, err := client.DoWithFileInfo(req, filename, newRemoteFileInfo(), func(*Progress) {})
+
+	var downloadErr *Error
+	if assert.True(t, errors.As(err, &downloadErr)) {
+		assert.Equal(t, 404, downloadErr.StatusCode)
+		assert.Equal(t, server.URL, downloadErr.URL)
+		assert.Equal(t, 1, downloadErr.Attempts)
+		assert.True(t, downloadErr.IsGone())
+		assert.False(t, downloadErr.Retryable)
+	}
+
+	// Should not have written the 404 page to disk.
+	_, err = os.Stat(filename)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filename + partialSuffix)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestResumeChangedFile(t *testing.T) {
+	content := []byte("hello world, again")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"new"`)
+		http.ServeContent(w, r, "file.txt", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	client := NewClient()
+	dir := t.TempDir()
+	info := newRemoteFileInfo()
+	info.Size = int64(len(content))
+	info.CanResume = true
+
+	// Partial file from the same version of the file should be resumed.
+	filename := filepath.Join(dir, "same.txt")
+	assert.Nil(t, os.WriteFile(filename+partialSuffix, content[:5], 0644))
+	writePartialInfo(filename, &partialInfo{URL: server.URL, ETag: `"new"`, Size: info.Size})
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	written, err := client.DoWithFileInfo(req, filename, info, func(*Progress) {})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)-5), written)
+	data, _ := os.ReadFile(filename)
+	assert.Equal(t, content, data)
+	_, err = os.Stat(partialInfoFilename(filename))
+	assert.True(t, os.IsNotExist(err))
+
+	// Partial file from an old version of the file should be thrown away.
+	filename = filepath.Join(dir, "changed.txt")
+	assert.Nil(t, os.WriteFile(filename+partialSuffix, []byte("HELLO"), 0644))
+	writePartialInfo(filename, &partialInfo{URL: server.URL, ETag: `"old"`, Size: info.Size})
+	_, err = client.DoWithFileInfo(req, filename, info, func(*Progress) {})
+	assert.Nil(t, err)
+	data, _ = os.ReadFile(filename)
+	assert.Equal(t, content, data)
+}
+
+func TestResumeFromDifferentURL(t *testing.T) {
+	// Two different files of the same size, with no ETag or Last-Modified.
+	files := map[string][]byte{"/a.jpg": []byte("aaaaaaaaaaaa"), "/b.jpg": []byte("bbbbbbbbbbbb")}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.jpg", time.Time{}, bytes.NewReader(files[r.URL.Path]))
+	}))
+	defer server.Close()
+
+	client := NewClient()
+	info := newRemoteFileInfo()
+	info.Size = int64(len(files["/b.jpg"]))
+	info.CanResume = true
+
+	// Partial download of a.jpg...
+	filename := filepath.Join(t.TempDir(), "file.jpg")
+	assert.Nil(t, os.WriteFile(filename+partialSuffix, files["/a.jpg"][:5], 0644))
+	writePartialInfo(filename, &partialInfo{URL: server.URL + "/a.jpg", Size: info.Size})
+
+	// ...should not be resumed with the bytes from b.jpg.
+	warnings := []string{}
+	req, _ := http.NewRequest("GET", server.URL+"/b.jpg", nil)
+	written, err := client.DoWithFileInfo(req, filename, info, func(progress *Progress) {
+		if progress.Warning != "" {
+			warnings = append(warnings, progress.Warning)
+		}
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size, written)
+	assert.Equal(t, []string{"Partial file was downloaded from a different URL - restarting download"}, warnings)
+	data, _ := os.ReadFile(filename)
+	assert.Equal(t, files["/b.jpg"], data)
+}
+
+func TestResumeCompletePartialFile(t *testing.T) {
+	content := []byte("hello world")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.ServeContent(w, r, "file.txt", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	client := NewClient(Verify(true), ComputeSHA256(true))
+	info := newRemoteFileInfo()
+	info.Size = int64(len(content))
+	info.CanResume = true
+
+	// A ".part" file which was completely downloaded, but never renamed.
+	filename := filepath.Join(t.TempDir(), "file.txt")
+	assert.Nil(t, os.WriteFile(filename+partialSuffix, content, 0644))
+	writePartialInfo(filename, &partialInfo{URL: server.URL, Size: info.Size})
+
+	var lastProgress Progress
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	written, err := client.DoWithFileInfo(req, filename, info, func(progress *Progress) {
+		lastProgress = *progress
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), written)
+	assert.Equal(t, 0, requests)
+	assert.Equal(t, int64(len(content)), lastProgress.Written)
+	sum := sha256.Sum256(content)
+	assert.Equal(t, hex.EncodeToString(sum[:]), lastProgress.SHA256)
+
+	data, _ := os.ReadFile(filename)
+	assert.Equal(t, content, data)
+	_, err = os.Stat(filename + partialSuffix)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(partialInfoFilename(filename))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestResumeRangeNotSatisfiable(t *testing.T) {
+	content := []byte("hello world, again")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		_, _ = w.Write(content)
+	}))
+	defer server.Close()
+
+	client := NewClient(WithRetryPolicy(&BackoffPolicy{MaxRetries: 1}))
+	info := newRemoteFileInfo()
+	info.Size = int64(len(content))
+	info.CanResume = true
+
+	filename := filepath.Join(t.TempDir(), "file.txt")
+	assert.Nil(t, os.WriteFile(filename+partialSuffix, []byte("HELLO"), 0644))
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	written, err := client.DoWithFileInfo(req, filename, info, func(*Progress) {})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), written)
+	data, _ := os.ReadFile(filename)
+	assert.Equal(t, content, data)
+}
@@ -0,0 +1,74 @@
+package download
+
+import (
+	"net/http"
+	"time"
+)
+
+// Error is the error returned when a file can't be downloaded.  Use
+// `errors.As()` to get at the details:
+//
+//	var downloadErr *download.Error
+//	if errors.As(err, &downloadErr) && downloadErr.IsGone() {
+//		// File has been removed from the server.
+//	}
+type Error struct {
+	// URL is the URL of the file being downloaded.
+	URL string
+	// StatusCode is the HTTP status code returned by the server, or 0 if the
+	// error didn't come from an HTTP response.
+	StatusCode int
+	// Class is the kind of error.
+	Class ErrorClass
+	// Retryable is true if this is the sort of error which might go away if
+	// we try again later.
+	Retryable bool
+	// Attempts is the number of times we tried to download the file.
+	Attempts int
+	// RetryAfter is the delay requested by the server via a Retry-After
+	// header, if any.
+	RetryAfter time.Duration
+	// Cause is the underlying error, if any.
+	Cause error
+
+	message string
+}
+
+func (err *Error) Error() string {
+	return err.message
+}
+
+func (err *Error) Unwrap() error {
+	return err.Cause
+}
+
+// IsGone returns true if the server told us the file doesn't exist.
+func (err *Error) IsGone() bool {
+	return err.StatusCode == http.StatusNotFound || err.StatusCode == http.StatusGone
+}
+
+// IsForbidden returns true if the server refused to give us the file.
+func (err *Error) IsForbidden() bool {
+	return err.StatusCode == http.StatusUnauthorized || err.StatusCode == http.StatusForbidden
+}
+
+// IsTransient returns true if the error might go away if we try again later.
+func (err *Error) IsTransient() bool {
+	return err.Class != ErrorPermanent
+}
+
+// canRetry returns true if it's worth trying again after this error.
+func (err *Error) canRetry() bool {
+	return err.IsTransient()
+}
+
+// withDetails fills in the URL, attempt count, and Retryable for an error
+// which is about to be returned to the caller.
+func (err *Error) withDetails(url string, attempts int) *Error {
+	err.URL = url
+	if attempts > err.Attempts {
+		err.Attempts = attempts
+	}
+	err.Retryable = err.canRetry()
+	return err
+}
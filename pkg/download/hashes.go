@@ -0,0 +1,83 @@
+package download
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// ComputeSHA256 is an option for NewClient that makes the client compute the
+// SHA-256 hash of each file as it is downloaded.  The hash is passed to the
+// FileProgressCallback in `Progress.SHA256` once the download is complete.
+func ComputeSHA256(compute bool) Option {
+	return func(client *Client) {
+		client.ComputeSHA256 = compute
+	}
+}
+
+// fileHashes computes the hashes of a file as it is written to disk.  Only
+// the hashes the client actually needs are computed.
+type fileHashes struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+// newFileHashes returns the hashes to compute for the given file.
+func (client *Client) newFileHashes(remoteInfo *RemoteFileInfo) *fileHashes {
+	hashes := &fileHashes{}
+	if client.Verify && remoteInfo.MD5 != "" {
+		hashes.md5 = md5.New()
+	}
+	if client.ComputeSHA256 {
+		hashes.sha256 = sha256.New()
+	}
+	return hashes
+}
+
+func (hashes *fileHashes) empty() bool {
+	return hashes.md5 == nil && hashes.sha256 == nil
+}
+
+// Write adds `p` to every hash.
+func (hashes *fileHashes) Write(p []byte) (int, error) {
+	if hashes.md5 != nil {
+		hashes.md5.Write(p)
+	}
+	if hashes.sha256 != nil {
+		hashes.sha256.Write(p)
+	}
+	return len(p), nil
+}
+
+// hashExisting adds the first `size` bytes of the given file to every hash.
+// This is used when resuming a download, so we can compute the hash of the
+// entire file without having to read it again once the download is complete.
+func (hashes *fileHashes) hashExisting(filename string, size int64) *Error {
+	if size == 0 || hashes.empty() {
+		return nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return &Error{message: fmt.Sprintf("Could not open %s: %v", filename, err)}
+	}
+	defer file.Close()
+
+	if _, err = io.CopyN(hashes, file, size); err != nil {
+		return &Error{message: fmt.Sprintf("Could not read %s: %v", filename, err)}
+	}
+
+	return nil
+}
+
+// sha256Sum returns the hex encoded SHA-256 hash, or "" if it wasn't computed.
+func (hashes *fileHashes) sha256Sum() string {
+	if hashes.sha256 == nil {
+		return ""
+	}
+	return hex.EncodeToString(hashes.sha256.Sum(nil))
+}
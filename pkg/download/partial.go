@@ -0,0 +1,34 @@
+package download
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// DoPartial fetches up to `length` bytes from the start of a file, using a
+// Range request.  This is handy for reading a file's header without
+// downloading the whole thing.  If the server ignores the Range header and
+// sends the whole file, only the first `length` bytes are read.  The result
+// may be shorter than `length` if the file is short.
+func (client *Client) DoPartial(request *http.Request, length int64) ([]byte, error) {
+	if length <= 0 {
+		return []byte{}, nil
+	}
+
+	req := request.Clone(request.Context())
+	req.Method = "GET"
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", length-1))
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("unexpected status fetching %s: %s", request.URL, resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, length))
+}
@@ -0,0 +1,116 @@
+package download
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// partialInfoSuffix is added to the name of the ".part" file to get the name
+// of the file where we store partialInfo.
+const partialInfoSuffix = ".meta"
+
+// partialInfo is saved alongside a partially downloaded file, so when we
+// resume the download we can tell if the file has changed on the server.
+type partialInfo struct {
+	URL          string     `json:"url"`
+	ETag         string     `json:"etag,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	Size         int64      `json:"size"`
+}
+
+func partialInfoFilename(filename string) string {
+	return filename + partialSuffix + partialInfoSuffix
+}
+
+// newPartialInfo creates a partialInfo from the response to a request for
+// the whole file.
+func newPartialInfo(url string, resp *http.Response) *partialInfo {
+	return &partialInfo{
+		URL:          url,
+		ETag:         resp.Header.Get("etag"),
+		LastModified: getLastModified(resp),
+		Size:         resp.ContentLength,
+	}
+}
+
+// partialInfoFromRemote creates a partialInfo from a RemoteFileInfo.
+func partialInfoFromRemote(url string, remoteInfo *RemoteFileInfo) *partialInfo {
+	return &partialInfo{
+		URL:          url,
+		ETag:         remoteInfo.ETag,
+		LastModified: remoteInfo.LastModified,
+		Size:         remoteInfo.Size,
+	}
+}
+
+// readPartialInfo reads the partialInfo for the given file.  Returns nil if
+// there is no partialInfo, or if it can't be read.
+func readPartialInfo(filename string) *partialInfo {
+	data, err := os.ReadFile(partialInfoFilename(filename))
+	if err != nil {
+		return nil
+	}
+
+	result := &partialInfo{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil
+	}
+	return result
+}
+
+// writePartialInfo saves the partialInfo for the given file.  Failing to
+// write this isn't fatal - it just means we can't safely resume later.
+func writePartialInfo(filename string, info *partialInfo) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return
+	}
+	_ = os.WriteFile(partialInfoFilename(filename), data, 0644)
+}
+
+// removePartialInfo deletes the partialInfo for the given file.
+func removePartialInfo(filename string) {
+	_ = os.Remove(partialInfoFilename(filename))
+}
+
+// mismatch returns a warning explaining why the partially downloaded file
+// can't be resumed from `url`, or "" if it can.  A partial file from a
+// different URL is never resumed, even if it happens to be the same size.
+// Otherwise, it is only rejected if the file described by `remoteInfo` is
+// definitely not the same file that was partially downloaded.
+func (info *partialInfo) mismatch(url string, remoteInfo *RemoteFileInfo) string {
+	const changed = "File has changed on the server - restarting download"
+
+	if info.URL != url {
+		return "Partial file was downloaded from a different URL - restarting download"
+	}
+	if info.ETag != "" && remoteInfo.ETag != "" {
+		if info.ETag != remoteInfo.ETag {
+			return changed
+		}
+		return ""
+	}
+	if info.LastModified != nil && remoteInfo.LastModified != nil && !info.LastModified.Equal(*remoteInfo.LastModified) {
+		return changed
+	}
+	if info.Size > -1 && remoteInfo.Size > -1 && info.Size != remoteInfo.Size {
+		return changed
+	}
+	return ""
+}
+
+// ifRange returns the value to send in an If-Range header when resuming
+// this file, or "" if we don't have a validator we can use.  Only strong
+// ETags can be used with If-Range.
+func (info *partialInfo) ifRange() string {
+	if info.ETag != "" && !strings.HasPrefix(info.ETag, "W/") {
+		return info.ETag
+	}
+	if info.LastModified != nil {
+		return info.LastModified.UTC().Format(http.TimeFormat)
+	}
+	return ""
+}
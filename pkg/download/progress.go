@@ -26,6 +26,10 @@ type Progress struct {
 	Err error
 	// If warning is present, it signifies a non-fatal error ocurred.
 	Warning string
+	// SHA256 is the hex encoded SHA-256 hash of the file.  This is only set
+	// once the download has completed successfully, and only if the client
+	// was created with the `ComputeSHA256` option.
+	SHA256 string
 }
 
 // FileProgressCallback is function that will be called with updates as a file downloads.
@@ -0,0 +1,155 @@
+package download
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRateLimitedRead is the largest read we'll do at once from a rate
+// limited reader, so that transfers stay smooth at low rates.
+const maxRateLimitedRead = 16 * 1024
+
+// tokenBucket is a token bucket which refills at `rate` tokens per second, and
+// can hold up to one second's worth of tokens.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes `n` tokens from the bucket, and returns how long the caller
+// should wait before using them.  The bucket is allowed to go into debt, so
+// callers that reserve more than they're allowed will be delayed accordingly.
+func (bucket *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	if bucket.rate <= 0 {
+		return 0
+	}
+
+	if !bucket.last.IsZero() {
+		bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+		if bucket.tokens > bucket.rate {
+			bucket.tokens = bucket.rate
+		}
+	}
+	bucket.last = now
+
+	bucket.tokens -= float64(n)
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+// RateLimiter limits the rate at which files are downloaded, both overall
+// and for individual hosts.  Limits can be changed at any time, even while
+// files are being downloaded.  A RateLimiter can be shared between several
+// Clients.
+type RateLimiter struct {
+	mutex  sync.Mutex
+	global tokenBucket
+	hosts  map[string]*tokenBucket
+}
+
+// NewRateLimiter creates a new RateLimiter.  By default there are no limits.
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{hosts: map[string]*tokenBucket{}}
+}
+
+// SetLimit sets the maximum number of bytes per second to download across
+// all hosts.  0 for no limit.
+func (limiter *RateLimiter) SetLimit(bytesPerSecond int64) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.global.rate = float64(bytesPerSecond)
+}
+
+// SetHostLimit sets the maximum number of bytes per second to download from
+// the given host.  0 for no limit.
+func (limiter *RateLimiter) SetHostLimit(host string, bytesPerSecond int64) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	host = strings.ToLower(host)
+	if bytesPerSecond <= 0 {
+		delete(limiter.hosts, host)
+	} else if bucket, ok := limiter.hosts[host]; ok {
+		bucket.rate = float64(bytesPerSecond)
+	} else {
+		limiter.hosts[host] = &tokenBucket{rate: float64(bytesPerSecond)}
+	}
+}
+
+// isLimited returns true if there is any limit on the given host.
+func (limiter *RateLimiter) isLimited(host string) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	return limiter.global.rate > 0 || limiter.hosts[strings.ToLower(host)] != nil
+}
+
+// wait blocks until we're allowed to read `n` more bytes from the given host.
+func (limiter *RateLimiter) wait(ctx context.Context, host string, n int) error {
+	now := time.Now()
+
+	limiter.mutex.Lock()
+	delay := limiter.global.reserve(n, now)
+	if bucket := limiter.hosts[strings.ToLower(host)]; bucket != nil {
+		if hostDelay := bucket.reserve(n, now); hostDelay > delay {
+			delay = hostDelay
+		}
+	}
+	limiter.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimitedReader is an io.Reader which reads from another reader, no
+// faster than the RateLimiter allows.
+type rateLimitedReader struct {
+	ctx     context.Context
+	limiter *RateLimiter
+	host    string
+	reader  io.Reader
+}
+
+// newRateLimitedReader wraps a reader so reads from the given host are
+// limited by `limiter`.  If limiter is nil, returns the reader unchanged.
+func newRateLimitedReader(ctx context.Context, limiter *RateLimiter, host string, reader io.Reader) io.Reader {
+	if limiter == nil {
+		return reader
+	}
+	return &rateLimitedReader{ctx, limiter, host, reader}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if !r.limiter.isLimited(r.host) {
+		return r.reader.Read(p)
+	}
+
+	if len(p) > maxRateLimitedRead {
+		p = p[:maxRateLimitedRead]
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, r.host, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
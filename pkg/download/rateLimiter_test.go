@@ -0,0 +1,27 @@
+package download
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := tokenBucket{rate: 1000}
+
+	// First read of a full second's worth should need to wait a second,
+	// since the bucket starts empty.
+	assert.Equal(t, time.Second, bucket.reserve(1000, now))
+
+	// After two seconds, we've paid off our debt and refilled a second's worth.
+	now = now.Add(2 * time.Second)
+	assert.Equal(t, time.Duration(0), bucket.reserve(500, now))
+	assert.Equal(t, time.Duration(0), bucket.reserve(500, now))
+	assert.Equal(t, 500*time.Millisecond, bucket.reserve(500, now))
+
+	// No limit.
+	unlimited := tokenBucket{}
+	assert.Equal(t, time.Duration(0), unlimited.reserve(1000000, now))
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,6 +19,12 @@ type RemoteFileInfo struct {
 	CanResume bool
 	// Last-modified header, if present.
 	LastModified *time.Time
+	// MD5 is the hex-encoded MD5 hash of the file, or "" if unknown.  This is
+	// never filled in by DoFileInfo, but if the caller knows the hash of a file
+	// it can be set here and the download will be verified against it.
+	MD5 string
+	// ETag is the ETag header, if present.
+	ETag string
 }
 
 func newRemoteFileInfo() *RemoteFileInfo {
@@ -26,12 +34,20 @@ func newRemoteFileInfo() *RemoteFileInfo {
 		"",
 		false,
 		nil,
+		"",
+		"",
 	}
 }
 
 // GetFileInfo is a convenience function for DoFileInfo.
 func (client *Client) GetFileInfo(url string) (*RemoteFileInfo, error) {
-	req, err := http.NewRequest("HEAD", url, nil)
+	return client.GetFileInfoContext(context.Background(), url)
+}
+
+// GetFileInfoContext is like GetFileInfo, but the request will be aborted if
+// the given context is cancelled.
+func (client *Client) GetFileInfoContext(ctx context.Context, url string) (*RemoteFileInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
 	if err != nil {
 		return newRemoteFileInfo(), err
 	}
@@ -41,23 +57,67 @@ func (client *Client) GetFileInfo(url string) (*RemoteFileInfo, error) {
 
 // DoFileInfo returns the length, mime type, last modified time, and other
 // interesting information about the resource for the specified request.
+//
+// This will make a HEAD request for the resource.  Many servers don't allow
+// HEAD requests, so if the HEAD request fails, this will fall back to a GET
+// request for just the first byte of the resource.
 func (client *Client) DoFileInfo(request *http.Request) (*RemoteFileInfo, error) {
 	headReq := request
 
 	if headReq.Method != "HEAD" {
 		// Copy the request, make it a HEAD request.
-		headReq := request.Clone(context.Background())
+		headReq = request.Clone(request.Context())
 		headReq.Method = "HEAD"
 	}
 
 	resp, err := client.httpClient.Do(headReq)
-
-	if err != nil || resp.StatusCode != 200 {
+	if err != nil {
 		return newRemoteFileInfo(), err
 	}
+	resp.Body.Close()
+
+	if resp.StatusCode == 200 {
+		return getRemoteFileInfo(resp), nil
+	}
 
+	return client.doRangeFileInfo(request)
+}
+
+// doRangeFileInfo fetches RemoteFileInfo by making a GET request for the first
+// byte of the resource.
+func (client *Client) doRangeFileInfo(request *http.Request) (*RemoteFileInfo, error) {
+	getReq := request.Clone(request.Context())
+	getReq.Method = "GET"
+	getReq.Header.Set("Range", "bytes=0-0")
+
+	resp, err := client.httpClient.Do(getReq)
+	if err != nil {
+		return newRemoteFileInfo(), err
+	}
+	// Note that we don't read the body here - if the server ignored our range
+	// request, we don't want to download the whole thing.
 	defer resp.Body.Close()
 
+	switch resp.StatusCode {
+	case 206:
+		result := getRemoteFileInfo(resp)
+		result.Size = -1
+		result.CanResume = false
+		if _, _, total, ok := parseContentRange(resp.Header.Get("content-range")); ok && total > -1 {
+			result.Size = total
+			result.CanResume = true
+		}
+		return result, nil
+	case 200:
+		// Server ignored the range, and is sending us the whole file.
+		return getRemoteFileInfo(resp), nil
+	default:
+		return newRemoteFileInfo(), nil
+	}
+}
+
+// getRemoteFileInfo returns RemoteFileInfo for a successful response.
+func getRemoteFileInfo(resp *http.Response) *RemoteFileInfo {
 	resume := false
 	if resp.ContentLength > -1 {
 		resume = canResume(resp)
@@ -69,18 +129,13 @@ func (client *Client) DoFileInfo(request *http.Request) (*RemoteFileInfo, error)
 		parseContentType(resp.Header.Get("content-type")),
 		resume,
 		getLastModified(resp),
-	}, nil
+		"",
+		resp.Header.Get("etag"),
+	}
 }
 
-var contentDispositionRegex = regexp.MustCompile(`^attachment;.*filename="([^"]*)".*$`)
-
 func getFilename(resp *http.Response) string {
-	contentDisposition := resp.Header.Get("content-disposition")
-	match := contentDispositionRegex.FindStringSubmatch(contentDisposition)
-	if match != nil {
-		return match[1]
-	}
-	return ""
+	return parseContentDisposition(resp.Header.Get("content-disposition"))
 }
 
 // httpToken is the regex to get a "token" from RFC7230, S3.2.6.
@@ -104,10 +159,30 @@ func canResume(resp *http.Response) bool {
 func getLastModified(resp *http.Response) *time.Time {
 	header := resp.Header.Get("last-modified")
 	if header != "" {
-		lastModified, err := time.Parse(http.TimeFormat, header)
-		if err != nil {
+		lastModified, err := http.ParseTime(header)
+		if err == nil {
 			return &lastModified
 		}
 	}
 	return nil
 }
+
+var contentRangeRegex = regexp.MustCompile(`^bytes\s+(\d+)-(\d+)/(\d+|\*)$`)
+
+// parseContentRange parses a Content-Range header, returning the first and
+// last byte in the range, and the total size of the file (or -1 if the
+// server doesn't know).
+func parseContentRange(header string) (start int64, end int64, total int64, ok bool) {
+	match := contentRangeRegex.FindStringSubmatch(strings.TrimSpace(header))
+	if match == nil {
+		return 0, 0, 0, false
+	}
+
+	start, _ = strconv.ParseInt(match[1], 10, 64)
+	end, _ = strconv.ParseInt(match[2], 10, 64)
+	total = -1
+	if match[3] != "*" {
+		total, _ = strconv.ParseInt(match[3], 10, 64)
+	}
+	return start, end, total, true
+}
@@ -1,7 +1,11 @@
 package download
 
 import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -12,3 +16,40 @@ func TestParseContentType(t *testing.T) {
 	assert.Equal(t, "", parseContentType("blat"))
 	assert.Equal(t, "", parseContentType(""))
 }
+
+func TestDoFileInfoHeadNotAllowed(t *testing.T) {
+	content := []byte("hello world")
+	methods := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Disposition", `attachment; filename="hello.jpg"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	info, err := NewClient().GetFileInfo(server.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"HEAD", "GET"}, methods)
+	assert.Equal(t, int64(len(content)), info.Size)
+	assert.Equal(t, "image/jpeg", info.MimeType)
+	assert.Equal(t, "hello.jpg", info.Filename)
+	assert.True(t, info.CanResume)
+}
+
+func TestParseContentRange(t *testing.T) {
+	start, end, total, ok := parseContentRange("bytes 0-0/1234")
+	assert.True(t, ok)
+	assert.Equal(t, []int64{0, 0, 1234}, []int64{start, end, total})
+
+	_, _, total, ok = parseContentRange("bytes 10-20/*")
+	assert.True(t, ok)
+	assert.Equal(t, int64(-1), total)
+
+	_, _, _, ok = parseContentRange("bytes */1234")
+	assert.False(t, ok)
+}
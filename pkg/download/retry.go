@@ -0,0 +1,287 @@
+package download
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+const defaultInitialRetryDelay = 1 * time.Second
+const defaultMaxRetryDelay = 1 * time.Minute
+
+// ErrorClass describes what kind of error caused a download to fail.
+type ErrorClass int
+
+const (
+	// ErrorPermanent is an error that won't go away if we try again, such as
+	// a 404 from the server or a full disk.
+	ErrorPermanent ErrorClass = iota
+	// ErrorNetwork is an error connecting to the server, such as a timeout or
+	// a refused connection.
+	ErrorNetwork
+	// ErrorInterrupted is an error which interrupted a transfer part way
+	// through, such as a reset connection or an HTTP/2 stream error.
+	ErrorInterrupted
+	// ErrorServer is a 5xx response from the server.
+	ErrorServer
+	// ErrorThrottled is a 429 response from the server.
+	ErrorThrottled
+	// ErrorCorrupt is a file which was downloaded, but failed verification.
+	ErrorCorrupt
+)
+
+func (class ErrorClass) String() string {
+	switch class {
+	case ErrorPermanent:
+		return "permanent"
+	case ErrorNetwork:
+		return "network"
+	case ErrorInterrupted:
+		return "interrupted"
+	case ErrorServer:
+		return "server"
+	case ErrorThrottled:
+		return "throttled"
+	case ErrorCorrupt:
+		return "corrupt"
+	default:
+		return fmt.Sprintf("ErrorClass(%d)", int(class))
+	}
+}
+
+// RetryAttempt describes a failed attempt to download a file, and is passed
+// to a RetryPolicy to decide whether to try again.
+type RetryAttempt struct {
+	// Err is the error from this attempt.
+	Err error
+	// Class is the kind of error.
+	Class ErrorClass
+	// Attempts is the number of attempts made so far, including this one.
+	Attempts int
+	// Failures is the number of attempts which have failed without making any
+	// progress, including this one.  Attempts which were interrupted part way
+	// through a download that can be resumed are not counted.
+	Failures int
+	// Resumable is true if this attempt downloaded some data, and the next
+	// attempt will pick up from where this one left off.
+	Resumable bool
+	// Elapsed is the time since the first attempt started.
+	Elapsed time.Duration
+	// RetryAfter is the delay the server asked for via a Retry-After header,
+	// or 0 if the server didn't send one.
+	RetryAfter time.Duration
+}
+
+// RetryPolicy decides whether, and when, to retry a failed download.
+type RetryPolicy interface {
+	// NextDelay returns how long to wait before trying again, or false if
+	// we should give up.
+	NextDelay(attempt *RetryAttempt) (time.Duration, bool)
+}
+
+// BackoffPolicy is a RetryPolicy which waits exponentially longer between
+// each retry, with some random jitter so many clients don't all retry at
+// the same time.  Downloads which were interrupted part way through, but can
+// be resumed, are retried immediately.
+type BackoffPolicy struct {
+	// MaxRetries is the maximum number of failed attempts to retry.
+	MaxRetries uint
+	// InitialDelay is the delay before the first retry.
+	InitialDelay time.Duration
+	// MaxDelay is the longest delay between retries, unless the server asks
+	// for a longer delay with a Retry-After header.
+	MaxDelay time.Duration
+	// Multiplier is how much to increase the delay by after each retry.
+	Multiplier float64
+	// Jitter is the fraction of the delay to randomly add or remove, from
+	// 0 to 1.
+	Jitter float64
+	// MaxElapsed is the total time budget for a file.  We won't retry if the
+	// next attempt would start after this much time has passed since the
+	// first attempt.  0 for no limit.
+	MaxElapsed time.Duration
+}
+
+// NewBackoffPolicy returns a new BackoffPolicy with default settings.
+func NewBackoffPolicy() *BackoffPolicy {
+	return &BackoffPolicy{
+		MaxRetries:   defaultMaxRetries,
+		InitialDelay: defaultInitialRetryDelay,
+		MaxDelay:     defaultMaxRetryDelay,
+		Multiplier:   2,
+		Jitter:       0.2,
+	}
+}
+
+// NextDelay implements RetryPolicy.
+func (policy *BackoffPolicy) NextDelay(attempt *RetryAttempt) (time.Duration, bool) {
+	if attempt.Class == ErrorPermanent || attempt.Failures > int(policy.MaxRetries) {
+		return 0, false
+	}
+
+	var delay time.Duration
+	if attempt.Resumable && attempt.RetryAfter == 0 {
+		// We made some progress - pick up where we left off right away.
+		delay = 0
+	} else {
+		backoff := float64(policy.InitialDelay) * math.Pow(policy.Multiplier, float64(attempt.Failures-1))
+		if policy.MaxDelay > 0 && backoff > float64(policy.MaxDelay) {
+			backoff = float64(policy.MaxDelay)
+		}
+		backoff += backoff * policy.Jitter * (rand.Float64()*2 - 1)
+		delay = time.Duration(backoff)
+
+		if attempt.RetryAfter > delay {
+			delay = attempt.RetryAfter
+		}
+	}
+
+	if policy.MaxElapsed > 0 && attempt.Elapsed+delay > policy.MaxElapsed {
+		return 0, false
+	}
+
+	return delay, true
+}
+
+// retrier keeps track of the attempts to download a single file.
+type retrier struct {
+	policy   RetryPolicy
+	start    time.Time
+	attempts int
+	failures int
+}
+
+func newRetrier(policy RetryPolicy) *retrier {
+	return &retrier{policy: policy, start: time.Now()}
+}
+
+// attempt records the start of a new attempt.
+func (r *retrier) attempt() {
+	r.attempts++
+}
+
+// next records a failed attempt, and returns how long to wait before trying
+// again, or false if we should give up.  `progressed` should be true if the
+// attempt downloaded some data that the next attempt will resume from.
+func (r *retrier) next(httpErr *Error, progressed bool) (time.Duration, bool) {
+	resumable := progressed && httpErr.Class == ErrorInterrupted
+	if !resumable {
+		r.failures++
+	}
+
+	return r.policy.NextDelay(&RetryAttempt{
+		Err:        httpErr,
+		Class:      httpErr.Class,
+		Attempts:   r.attempts,
+		Failures:   r.failures,
+		Resumable:  resumable,
+		Elapsed:    time.Since(r.start),
+		RetryAfter: httpErr.RetryAfter,
+	})
+}
+
+// retryMessage returns a warning describing a retry decision.
+func retryMessage(httpErr *Error, delay time.Duration, retry bool) string {
+	if !retry {
+		return fmt.Sprintf("Error: %v - giving up", httpErr)
+	} else if delay <= 0 {
+		return fmt.Sprintf("Error: %v - retrying now", httpErr)
+	}
+	return fmt.Sprintf("Error: %v - will retry in %v", httpErr, delay.Round(time.Millisecond))
+}
+
+// sleepContext waits for the given delay, or until the context is done.
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// classifyRequestError works out what kind of error was returned from
+// `http.Client.Do()`.
+func classifyRequestError(err error) ErrorClass {
+	var unknownAuthority x509.UnknownAuthorityError
+	var certInvalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &certInvalid) || errors.As(err, &hostname) {
+		return ErrorPermanent
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && !dnsErr.IsTemporary && !dnsErr.IsTimeout {
+		return ErrorPermanent
+	}
+
+	// Anything else is a timeout, a reset connection, or some other network
+	// problem which may well go away if we try again.
+	return ErrorNetwork
+}
+
+// statusCodeError returns an error for a response with a status code that
+// isn't a success.  429 and 5xx responses are worth retrying; anything else,
+// such as a 404 or 403, is permanent.
+func statusCodeError(resp *http.Response) *Error {
+	retryAfter, _ := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+
+	result := &Error{
+		StatusCode: resp.StatusCode,
+		Class:      ErrorPermanent,
+		message:    fmt.Sprintf("Server replied with %d", resp.StatusCode),
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		result.Class = ErrorThrottled
+		result.RetryAfter = retryAfter
+	case resp.StatusCode >= 500 && resp.StatusCode < 600:
+		result.Class = ErrorServer
+		result.RetryAfter = retryAfter
+	}
+	return result
+}
+
+// readErrorRecorder is an io.Reader that remembers the last error returned
+// by the underlying reader.  This lets us tell errors reading from the
+// network apart from errors writing to disk when using io.Copy.
+type readErrorRecorder struct {
+	reader io.Reader
+	err    error
+}
+
+func (r *readErrorRecorder) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// copyError returns an Error for an error returned by io.Copy, when
+// copying from `body`.
+func copyError(url string, body *readErrorRecorder, err error) *Error {
+	class := ErrorPermanent
+	if body.err != nil && errors.Is(err, body.err) {
+		class = ErrorInterrupted
+	}
+
+	return &Error{
+		Class:   class,
+		message: fmt.Sprintf("Error downloading %s: %v", url, err),
+		Cause:   err,
+	}
+}
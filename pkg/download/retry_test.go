@@ -0,0 +1,101 @@
+package download
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffPolicy(t *testing.T) {
+	policy := &BackoffPolicy{
+		MaxRetries:   3,
+		InitialDelay: time.Second,
+		MaxDelay:     3 * time.Second,
+		Multiplier:   2,
+		MaxElapsed:   time.Minute,
+	}
+
+	delay, retry := policy.NextDelay(&RetryAttempt{Class: ErrorServer, Failures: 1})
+	assert.True(t, retry)
+	assert.Equal(t, time.Second, delay)
+
+	delay, _ = policy.NextDelay(&RetryAttempt{Class: ErrorServer, Failures: 2})
+	assert.Equal(t, 2*time.Second, delay)
+
+	// Capped at MaxDelay.
+	delay, _ = policy.NextDelay(&RetryAttempt{Class: ErrorServer, Failures: 3})
+	assert.Equal(t, 3*time.Second, delay)
+
+	// Retry-After wins over MaxDelay.
+	delay, _ = policy.NextDelay(&RetryAttempt{Class: ErrorThrottled, Failures: 1, RetryAfter: 10 * time.Second})
+	assert.Equal(t, 10*time.Second, delay)
+
+	// Resumable downloads retry right away.
+	delay, retry = policy.NextDelay(&RetryAttempt{Class: ErrorInterrupted, Failures: 1, Resumable: true})
+	assert.True(t, retry)
+	assert.Equal(t, time.Duration(0), delay)
+
+	// Give up.
+	_, retry = policy.NextDelay(&RetryAttempt{Class: ErrorPermanent, Failures: 1})
+	assert.False(t, retry)
+	_, retry = policy.NextDelay(&RetryAttempt{Class: ErrorServer, Failures: 4})
+	assert.False(t, retry)
+	_, retry = policy.NextDelay(&RetryAttempt{Class: ErrorServer, Failures: 1, Elapsed: 59500 * time.Millisecond})
+	assert.False(t, retry)
+}
+
+func TestMaxRetriesOption(t *testing.T) {
+	policy := &BackoffPolicy{MaxRetries: 5, InitialDelay: time.Second}
+
+	for _, options := range [][]Option{
+		{MaxRetries(3), WithRetryPolicy(policy)},
+		{WithRetryPolicy(policy), MaxRetries(3)},
+	} {
+		client := NewClient(options...)
+		if assert.IsType(t, &BackoffPolicy{}, client.RetryPolicy) {
+			assert.Equal(t, uint(3), client.RetryPolicy.(*BackoffPolicy).MaxRetries)
+			assert.Equal(t, time.Second, client.RetryPolicy.(*BackoffPolicy).InitialDelay)
+		}
+	}
+
+	// Should not have modified the policy that was passed in.
+	assert.Equal(t, uint(5), policy.MaxRetries)
+
+	client := NewClient(MaxRetries(3))
+	assert.Equal(t, uint(3), client.RetryPolicy.(*BackoffPolicy).MaxRetries)
+}
+
+func TestRetryReportsWarnings(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("hello world"))
+	}))
+	defer server.Close()
+
+	client := NewClient(WithRetryPolicy(&BackoffPolicy{MaxRetries: 1}))
+	filename := filepath.Join(t.TempDir(), "file.txt")
+
+	warnings := []string{}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	_, err := client.DoWithFileInfo(req, filename, newRemoteFileInfo(), func(progress *Progress) {
+		if progress.Warning != "" {
+			warnings = append(warnings, progress.Warning)
+		}
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	if assert.Equal(t, 1, len(warnings)) {
+		assert.True(t, strings.Contains(warnings[0], "503"))
+	}
+}
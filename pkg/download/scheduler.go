@@ -0,0 +1,292 @@
+package download
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRetryAfterDelay is the longest the Scheduler will hold back requests to
+// a host that replies with a Retry-After header.
+const maxRetryAfterDelay = 5 * time.Minute
+
+// HostLimits are the limits a Scheduler applies to requests to a single host.
+type HostLimits struct {
+	// RequestsPerSecond is the maximum number of requests to start per second.
+	// 0 for no limit.
+	RequestsPerSecond float64
+	// MaxConnections is the maximum number of requests that can be in progress
+	// at once.  A request is in progress until its response body is closed.
+	// 0 for no limit.
+	MaxConnections int
+}
+
+// hostState tracks requests to a single host.
+type hostState struct {
+	// active is the number of requests currently in progress.
+	active int
+	// next is the earliest time the next request can start.
+	next time.Time
+	// blockedUntil is set when the server sends us a Retry-After header.
+	blockedUntil time.Time
+	// wake is closed (and replaced) whenever a request finishes.
+	wake chan struct{}
+}
+
+// Scheduler limits how often, and how many concurrent, requests are made to
+// each host, and honors Retry-After headers on 429 and 503 responses by
+// holding back further requests to the host.  The Scheduler never retries a
+// request itself - the response is returned to the caller, and it's up to the
+// caller (e.g. a Client's RetryPolicy) to decide whether to try again.  Use
+// `Client()` or `Transport()` to send requests via the Scheduler.  A single
+// Scheduler should be shared by everything that makes requests, so limits
+// apply across all of them.  Limits can be changed at any time.
+type Scheduler struct {
+	mutex      sync.Mutex
+	limits     HostLimits
+	hostLimits map[string]HostLimits
+	hosts      map[string]*hostState
+}
+
+// NewScheduler creates a new Scheduler which applies the given limits to
+// every host.
+func NewScheduler(limits HostLimits) *Scheduler {
+	return &Scheduler{
+		limits:     limits,
+		hostLimits: map[string]HostLimits{},
+		hosts:      map[string]*hostState{},
+	}
+}
+
+// SetLimits sets the limits for every host that doesn't have limits set via
+// SetHostLimits.
+func (scheduler *Scheduler) SetLimits(limits HostLimits) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	scheduler.limits = limits
+	scheduler.wakeAll()
+}
+
+// SetHostLimits sets the limits for a single host.
+func (scheduler *Scheduler) SetHostLimits(host string, limits HostLimits) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	scheduler.hostLimits[strings.ToLower(host)] = limits
+	scheduler.wakeAll()
+}
+
+// Transport returns an http.RoundTripper which sends requests via `next`,
+// subject to the Scheduler's limits.  If next is nil, http.DefaultTransport
+// will be used.
+func (scheduler *Scheduler) Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &scheduledTransport{scheduler: scheduler, next: next}
+}
+
+// Client returns a copy of the given http.Client which sends all requests
+// via the Scheduler.
+func (scheduler *Scheduler) Client(httpClient *http.Client) *http.Client {
+	result := *httpClient
+	result.Transport = scheduler.Transport(httpClient.Transport)
+	return &result
+}
+
+// getLimits returns the limits for the given host.  Must be called with the
+// mutex held.
+func (scheduler *Scheduler) getLimits(host string) HostLimits {
+	if limits, ok := scheduler.hostLimits[host]; ok {
+		return limits
+	}
+	return scheduler.limits
+}
+
+// getHost returns the state for the given host.  Must be called with the
+// mutex held.
+func (scheduler *Scheduler) getHost(host string) *hostState {
+	state := scheduler.hosts[host]
+	if state == nil {
+		state = &hostState{wake: make(chan struct{})}
+		scheduler.hosts[host] = state
+	}
+	return state
+}
+
+// wakeAll wakes every request waiting for a connection, so they can check
+// the new limits.  Must be called with the mutex held.
+func (scheduler *Scheduler) wakeAll() {
+	for _, state := range scheduler.hosts {
+		close(state.wake)
+		state.wake = make(chan struct{})
+	}
+}
+
+// acquire waits until a request can be made to the given host.  On success,
+// the caller must call the returned function once the request is finished.
+func (scheduler *Scheduler) acquire(ctx context.Context, host string) (func(), error) {
+	for {
+		scheduler.mutex.Lock()
+		state := scheduler.getHost(host)
+		limits := scheduler.getLimits(host)
+
+		if limits.MaxConnections > 0 && state.active >= limits.MaxConnections {
+			wake := state.wake
+			scheduler.mutex.Unlock()
+			select {
+			case <-wake:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		now := time.Now()
+		start := now
+		if state.blockedUntil.After(start) {
+			start = state.blockedUntil
+		}
+		if limits.RequestsPerSecond > 0 {
+			if state.next.After(start) {
+				start = state.next
+			}
+			state.next = start.Add(time.Duration(float64(time.Second) / limits.RequestsPerSecond))
+		}
+		state.active++
+		scheduler.mutex.Unlock()
+
+		release := scheduler.releaseFunc(state)
+		if delay := start.Sub(now); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				release()
+				return nil, ctx.Err()
+			}
+		}
+
+		return release, nil
+	}
+}
+
+// releaseFunc returns a function which frees up a connection to the given
+// host.  The returned function is safe to call more than once.
+func (scheduler *Scheduler) releaseFunc(state *hostState) func() {
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			scheduler.mutex.Lock()
+			defer scheduler.mutex.Unlock()
+
+			state.active--
+			close(state.wake)
+			state.wake = make(chan struct{})
+		})
+	}
+}
+
+// checkRetryAfter checks to see if the response is a 429 or 503 with a
+// Retry-After header.  If it is, no further requests will be made to the
+// host until the Retry-After time has passed, and this returns the delay
+// requested by the server.
+func (scheduler *Scheduler) checkRetryAfter(host string, resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok {
+		return 0, false
+	}
+
+	blockFor := delay
+	if blockFor > maxRetryAfterDelay {
+		blockFor = maxRetryAfterDelay
+	}
+
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	state := scheduler.getHost(host)
+	if until := now.Add(blockFor); until.After(state.blockedUntil) {
+		state.blockedUntil = until
+	}
+
+	return delay, true
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which may be
+// either a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		delay := date.Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+
+	return 0, false
+}
+
+// scheduledTransport is an http.RoundTripper which sends requests via a
+// Scheduler.
+type scheduledTransport struct {
+	scheduler *Scheduler
+	next      http.RoundTripper
+}
+
+func (transport *scheduledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Hostname())
+
+	release, err := transport.scheduler.acquire(req.Context(), host)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := transport.next.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	// If the server asked us to back off, hold back any further requests
+	// to this host.
+	transport.scheduler.checkRetryAfter(host, resp, time.Now())
+
+	resp.Body = &scheduledBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// scheduledBody is the body of a response from a scheduledTransport.  The
+// request's connection is released when the body is closed.
+type scheduledBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (body *scheduledBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.release()
+	return err
+}
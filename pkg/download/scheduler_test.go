@@ -0,0 +1,125 @@
+package download
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerMaxConnections(t *testing.T) {
+	var active, maxActive int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&active, 1)
+		for {
+			seen := atomic.LoadInt32(&maxActive)
+			if current <= seen || atomic.CompareAndSwapInt32(&maxActive, seen, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+	}))
+	defer server.Close()
+
+	scheduler := NewScheduler(HostLimits{MaxConnections: 2})
+	client := scheduler.Client(server.Client())
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(server.URL)
+			if assert.NoError(t, err) {
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxActive))
+}
+
+func TestSchedulerRetryAfter(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	scheduler := NewScheduler(HostLimits{})
+	client := scheduler.Client(server.Client())
+
+	// The 429 should be returned to the caller, not retried.
+	start := time.Now()
+	resp, err := client.Get(server.URL)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// The next request should be held back until the Retry-After has passed.
+	resp, err = client.Get(server.URL)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.True(t, time.Since(start) >= time.Second)
+}
+
+func TestClientRetriesThrottledRequestOnce(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := NewClient(WithScheduler(NewScheduler(HostLimits{})))
+	filename := filepath.Join(t.TempDir(), "file.txt")
+
+	warnings := []string{}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	_, err := client.DoWithFileInfo(req, filename, newRemoteFileInfo(), func(progress *Progress) {
+		if progress.Warning != "" {
+			warnings = append(warnings, progress.Warning)
+		}
+	})
+	assert.NoError(t, err)
+
+	// One request that was throttled, and one retry from the client.
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.Len(t, warnings, 1)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	delay, ok := parseRetryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, delay)
+
+	delay, ok = parseRetryAfter("Fri, 01 Jan 2021 00:00:30 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, delay)
+
+	_, ok = parseRetryAfter("soon", now)
+	assert.False(t, ok)
+}
@@ -0,0 +1,393 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSegmentMinSize is the default minimum size of a file before we'll
+// split it into segments.
+const defaultSegmentMinSize = 16 * 1024 * 1024
+
+// errRangeNotSupported is the cause of the error returned by
+// doSegmentedDownload if the server does not honor range requests.  When this
+// happens, we fall back to downloading the file over a single connection.
+var errRangeNotSupported = errors.New("server does not support range requests")
+
+// isRangeNotSupported returns true if err was caused by errRangeNotSupported.
+func isRangeNotSupported(err *Error) bool {
+	return err != nil && errors.Is(err, errRangeNotSupported)
+}
+
+// segment is a single byte range of a file being downloaded in segments.
+type segment struct {
+	// start is the offset of the first byte in this segment.
+	start int64
+	// end is the offset of the last byte in this segment (inclusive).
+	end int64
+	// filename is the file this segment is written to.
+	filename string
+}
+
+func (seg *segment) size() int64 {
+	return seg.end - seg.start + 1
+}
+
+// lockedWriter wraps a progressWriter so it can be written to from many
+// goroutines at once.
+type lockedWriter struct {
+	mutex sync.Mutex
+	pw    *progressWriter
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.pw.Write(p)
+}
+
+// Segments is an option for NewClient that makes the client download large
+// files over several connections at once.  Files which are at least `minSize`
+// bytes long, where the server supports range requests, will be split into
+// `count` segments which are downloaded concurrently, and then reassembled.
+// If minSize is 0, a default of 16MB will be used.
+func Segments(count uint, minSize int64) Option {
+	return func(client *Client) {
+		if minSize <= 0 {
+			minSize = defaultSegmentMinSize
+		}
+		client.Segments = count
+		client.SegmentMinSize = minSize
+	}
+}
+
+// shouldSegment returns true if the given file should be downloaded in segments.
+func (client *Client) shouldSegment(filename string, remoteInfo *RemoteFileInfo) bool {
+	if client.Segments < 2 || !remoteInfo.CanResume || remoteInfo.Size < client.SegmentMinSize {
+		return false
+	}
+
+	// If we have a partial file from a single-connection download, resume
+	// that instead.
+	if _, err := os.Stat(filename + partialSuffix); err == nil {
+		return false
+	}
+
+	return true
+}
+
+// getSegments splits a file of the given size into `count` segments.  The
+// byte range for each segment is part of the segment's filename.  If `count`
+// changes between attempts, none of the old segments will match, so they are
+// thrown away by removeStaleSegments.
+func getSegments(filename string, size int64, count uint) []segment {
+	segmentSize := size / int64(count)
+	result := make([]segment, 0, count)
+
+	for i := int64(0); i < int64(count); i++ {
+		start := i * segmentSize
+		end := start + segmentSize - 1
+		if i == int64(count)-1 {
+			end = size - 1
+		}
+		result = append(result, segment{
+			start:    start,
+			end:      end,
+			filename: fmt.Sprintf("%s%s.%d-%d", filename, partialSuffix, start, end),
+		})
+	}
+
+	return result
+}
+
+// doSegmentedDownload downloads a file in several segments at once, and then
+// joins the segments together into the final file.  If any segment fails, the
+// others are stopped, and the error is returned so the caller can retry.
+// Segments are kept on disk, so the next attempt picks up each segment from
+// where it left off.
+func (client *Client) doSegmentedDownload(
+	ctx context.Context,
+	request *http.Request,
+	filename string,
+	remoteInfo *RemoteFileInfo,
+	pw *progressWriter,
+) (written int64, httpErr *Error) {
+	segments := getSegments(filename, remoteInfo.Size, client.Segments)
+	if removeStaleSegments(filename, segments) {
+		pw.Warn("Number of segments has changed - restarting download")
+	}
+
+	// Figure out how much we've already downloaded.
+	var existingSize int64
+	for _, seg := range segments {
+		if info, err := os.Stat(seg.filename); err == nil {
+			existingSize += info.Size()
+		}
+	}
+
+	// If the file has changed on the server since we started downloading it,
+	// or the segments are from some other URL, throw away whatever we have so
+	// far.
+	saved := readPartialInfo(filename)
+	if existingSize > 0 && saved != nil {
+		if warning := saved.mismatch(request.URL.String(), remoteInfo); warning != "" {
+			pw.Warn(warning)
+			client.removeSegments(segments)
+			existingSize = 0
+		}
+	}
+	if saved == nil || existingSize == 0 {
+		saved = partialInfoFromRemote(request.URL.String(), remoteInfo)
+		writePartialInfo(filename, saved)
+	}
+	ifRange := saved.ifRange()
+
+	pw.progress.Total = remoteInfo.Size
+	pw.setSize(existingSize)
+
+	// If any segment fails, stop all the others.
+	segmentCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lw := &lockedWriter{pw: pw}
+	errs := make([]*Error, len(segments))
+	writtenBySegment := make([]int64, len(segments))
+
+	wg := sync.WaitGroup{}
+	for index := range segments {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			writtenBySegment[index], errs[index] = client.downloadSegment(segmentCtx, request, &segments[index], ifRange, lw)
+			if errs[index] != nil {
+				cancel()
+			}
+		}(index)
+	}
+	wg.Wait()
+
+	for index := range segments {
+		written += writtenBySegment[index]
+	}
+
+	// Report the first "real" error - the others are probably just the result
+	// of being cancelled.
+	for _, err := range errs {
+		if isRangeNotSupported(err) {
+			client.removeSegments(segments)
+			removePartialInfo(filename)
+			return written, err
+		}
+	}
+	for _, err := range errs {
+		if err != nil && !errors.Is(err.Cause, context.Canceled) {
+			if err.StatusCode != 0 && !err.canRetry() {
+				// File is gone, or we're not allowed to have it.
+				client.removeSegments(segments)
+			}
+			return written, err
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return written, err
+		}
+	}
+
+	hashes, httpErr := client.joinSegments(filename, segments, remoteInfo)
+	if httpErr != nil {
+		return written, httpErr
+	}
+	removePartialInfo(filename)
+	pw.progress.SHA256 = hashes.sha256Sum()
+
+	// Set the modified time of the file to match the one on the server.
+	if remoteInfo.LastModified != nil {
+		_ = os.Chtimes(filename, time.Now(), *remoteInfo.LastModified)
+	}
+
+	return written, nil
+}
+
+// downloadSegment downloads a single segment, resuming from wherever the
+// last attempt left off.
+func (client *Client) downloadSegment(
+	ctx context.Context,
+	request *http.Request,
+	seg *segment,
+	ifRange string,
+	lw *lockedWriter,
+) (written int64, httpErr *Error) {
+	file, existingSize, httpErr := openFileForWriting(seg.filename, true)
+	if httpErr != nil {
+		return 0, httpErr
+	}
+	defer file.Close()
+
+	if existingSize >= seg.size() {
+		// Already done.
+		return 0, nil
+	}
+
+	req := request.Clone(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", seg.start+existingSize, seg.end))
+	if ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
+	}
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return 0, &Error{Class: classifyRequestError(err), message: err.Error(), Cause: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 200 {
+		// Server ignored our range request, or the file has changed.
+		return 0, &Error{Class: ErrorServer, message: errRangeNotSupported.Error(), Cause: errRangeNotSupported}
+	} else if resp.StatusCode != 206 {
+		return 0, statusCodeError(resp)
+	}
+	if start, _, _, ok := parseContentRange(resp.Header.Get("content-range")); ok && start != seg.start+existingSize {
+		return 0, &Error{
+			Class:   ErrorServer,
+			message: fmt.Sprintf("Server sent range starting at %d, expected %d", start, seg.start+existingSize),
+		}
+	}
+
+	remaining := seg.size() - existingSize
+	body := &readErrorRecorder{reader: newRateLimitedReader(ctx, client.RateLimiter, request.URL.Hostname(), resp.Body)}
+	written, err = io.Copy(file, io.TeeReader(io.LimitReader(body, remaining), lw))
+	if err != nil {
+		return written, copyError(request.URL.String(), body, err)
+	}
+	if written != remaining {
+		return written, &Error{
+			Class:   ErrorInterrupted,
+			message: fmt.Sprintf("Segment %d-%d ended early", seg.start, seg.end),
+		}
+	}
+
+	return written, nil
+}
+
+// joinSegments concatenates all segments into the final file, verifying the
+// result if the client has verification enabled.  Returns the hashes of the
+// final file.  Segments are only removed once the file has been verified.
+func (client *Client) joinSegments(filename string, segments []segment, remoteInfo *RemoteFileInfo) (*fileHashes, *Error) {
+	partFilename := filename + partialSuffix
+	file, err := os.OpenFile(partFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, &Error{message: fmt.Sprintf("Could not open %s: %v", partFilename, err)}
+	}
+
+	hashes := client.newFileHashes(remoteInfo)
+	var out io.Writer = file
+	if !hashes.empty() {
+		out = io.MultiWriter(file, hashes)
+	}
+
+	var size int64
+	for _, seg := range segments {
+		written, err := appendFile(out, seg.filename)
+		size += written
+		if err != nil {
+			_ = file.Close()
+			return nil, &Error{message: fmt.Sprintf("Error joining segments for %s: %v", filename, err)}
+		}
+	}
+
+	if err = file.Close(); err != nil {
+		return nil, &Error{message: fmt.Sprintf("Error closing %s: %v", partFilename, err)}
+	}
+
+	if client.Verify {
+		if httpErr := verifyDownload(filename, size, []int64{remoteInfo.Size}, hashes.md5, remoteInfo.MD5); httpErr != nil {
+			client.removeBadSegments(segments)
+			return nil, httpErr
+		}
+	}
+
+	client.removeSegments(segments)
+
+	if err = os.Rename(partFilename, filename); err != nil {
+		return nil, &Error{message: fmt.Sprintf("Error renaming %s to %s: %v", partFilename, filename, err)}
+	}
+
+	return hashes, nil
+}
+
+// appendFile copies the contents of the given file to `out`.
+func appendFile(out io.Writer, filename string) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return io.Copy(out, file)
+}
+
+// removeStaleSegments deletes any segment files for `filename` left behind by
+// an earlier attempt that split the file differently, and returns true if
+// any were found.
+func removeStaleSegments(filename string, segments []segment) bool {
+	current := make(map[string]bool, len(segments))
+	for _, seg := range segments {
+		current[filepath.Base(seg.filename)] = true
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(filename))
+	if err != nil {
+		return false
+	}
+
+	// Segment files are named "<filename>.part.<start>-<end>".  Match these by
+	// hand instead of with filepath.Glob, since filename may contain "[" or "*".
+	prefix := filepath.Base(filename) + partialSuffix + "."
+	removed := false
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || current[name] {
+			continue
+		}
+		var start, end int64
+		if n, _ := fmt.Sscanf(name[len(prefix):], "%d-%d", &start, &end); n != 2 {
+			// Not a segment (e.g. the ".part.meta" file).
+			continue
+		}
+		_ = os.Remove(filepath.Join(filepath.Dir(filename), name))
+		removed = true
+	}
+
+	return removed
+}
+
+// removeBadSegments deletes any segment files which are the wrong size, so
+// they will be downloaded again.  If every segment is the right size, then
+// we can't tell which one is corrupt, so they are all deleted.
+func (client *Client) removeBadSegments(segments []segment) {
+	removed := false
+	for _, seg := range segments {
+		if info, err := os.Stat(seg.filename); err == nil && info.Size() != seg.size() {
+			_ = os.Remove(seg.filename)
+			removed = true
+		}
+	}
+	if !removed {
+		client.removeSegments(segments)
+	}
+}
+
+// removeSegments deletes all segment files.
+func (client *Client) removeSegments(segments []segment) {
+	for _, seg := range segments {
+		_ = os.Remove(seg.filename)
+	}
+}
@@ -1,8 +1,10 @@
 package pixdl
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/jwalton/pixdl/pkg/providers"
 )
@@ -41,7 +43,7 @@ func getAlbum(
 			return
 		}
 
-		fileInfo, err := client.DoFileInfo(req)
+		fileInfo, err := env.DownloadClient.DoFileInfo(req)
 		if err != nil {
 			callback(defaultAlbum, nil, err)
 			return
@@ -62,54 +64,212 @@ func getAlbum(
 	}
 
 	if !handled {
-		callback(defaultAlbum, nil, fmt.Errorf("could not find a suitable provider to download album"))
+		if err := env.Context().Err(); err != nil {
+			// Providers give up without any images if they're cancelled.
+			callback(defaultAlbum, nil, err)
+		} else {
+			callback(defaultAlbum, nil, fmt.Errorf("could not find a suitable provider to download album"))
+		}
 	}
 }
 
 // downloadAlbum will fetch every image in an album and then download it, using
-// the specified downloader.
-func downloadAlbum(downloader ImageDownloader, url string, options DownloadOptions, reporter ProgressReporter) {
+// the specified downloader.  If ctx is cancelled, no further images will be
+// fetched from the album, and the album will end with the context's error.
+func downloadAlbum(
+	ctx context.Context,
+	downloader ImageDownloader,
+	url string,
+	options DownloadOptions,
+	reporter ProgressReporter,
+) {
+	var startedAlbum *AlbumMetadata
+	albumFolder := ""
+	albumImages := &sync.WaitGroup{}
+
+	// startAlbum figures out where the album is going to be stored, and
+	// records the album in the manifest.
+	startAlbum := func(album *AlbumMetadata) (string, error) {
+		toFolder, err := getAlbumFolder(options, album)
+		if err != nil {
+			return toFolder, err
+		}
+		startedAlbum = album
+		albumFolder = toFolder
+
+		manifest, err := downloader.getManifest(toFolder)
+		if err != nil {
+			return toFolder, err
+		}
+		if manifest != nil {
+			if err = manifest.startAlbum(album, options); err != nil {
+				return toFolder, fmt.Errorf("error updating manifest: %w", err)
+			}
+		}
+		if err = downloader.startAlbumSidecar(toFolder, album); err != nil {
+			return toFolder, fmt.Errorf("error writing album sidecar: %w", err)
+		}
+		return toFolder, nil
+	}
+
+	filter, err := newImageFilter(options)
+	if err != nil {
+		reporter.AlbumFetch(url)
+		reporter.AlbumEnd(&AlbumMetadata{URL: url}, err)
+		return
+	}
+
+	rootFolder := options.RootFolder
+	if rootFolder == "" {
+		rootFolder = options.ToFolder
+	}
+
+	walkAlbum(ctx, downloader.getEnv(), url, options, filter, reporter, startAlbum, func(image *ImageMetadata, toFolder string, done func(downloaded bool)) {
+		albumImages.Add(1)
+		downloader.queueImage(ctx, image, rootFolder, toFolder, options.FilenameTemplate, filter, reporter, func(downloaded bool) {
+			done(downloaded)
+			albumImages.Done()
+		})
+	})
+
+	if startedAlbum != nil {
+		albumImages.Wait()
+		downloader.endAlbum(albumFolder, startedAlbum)
+	}
+}
+
+// walkAlbum will fetch every image in an album, and call `handleImage` for
+// each image that passes the limits in `options` and `filter`.  Images which
+// don't pass `filter` are reported as skipped, with the reason.  `startAlbum`
+// is called once the album's metadata is known, and returns the folder to
+// store images from the album in.  If ctx is cancelled, no further images
+// will be fetched from the album, and the album will end with the context's
+// error.
+//
+// `handleImage` must call `done` once it's finished with the image, with
+// `downloaded` set to false if the image was skipped.  Only images which
+// were downloaded count towards `options.MaxImages`.
+func walkAlbum(
+	ctx context.Context,
+	env *providers.Env,
+	url string,
+	options DownloadOptions,
+	filter *imageFilter,
+	reporter ProgressReporter,
+	startAlbum func(album *AlbumMetadata) (string, error),
+	handleImage func(image *ImageMetadata, toFolder string, done func(downloaded bool)),
+) {
 	started := false
+	ended := false
 	startPage := -1
-	imagesDownloaded := 0
+	limit := newImageLimit(options.MaxImages)
+	toFolder := options.ToFolder
+
+	env = env.WithContext(ctx)
+	env.Since = options.Since
+	env.Until = options.Until
+
+	endAlbum := func(album *AlbumMetadata, err error) bool {
+		if !ended {
+			ended = true
+			reporter.AlbumEnd(album, err)
+		}
+		return false
+	}
 
 	reporter.AlbumFetch(url)
-	getAlbum(downloader.getEnv(), options.Params, url, func(album *AlbumMetadata, image *ImageMetadata, err error) bool {
+	getAlbum(env, options.Params, url, func(album *AlbumMetadata, image *ImageMetadata, err error) bool {
+		if err == nil && ctx.Err() != nil {
+			// Cancelled - treat this as the end of the album.
+			image = nil
+			err = ctx.Err()
+		}
+
 		if !started {
 			reporter.AlbumStart(album)
 			started = true
 
 			if image == nil || err != nil {
 				// Never got a first image - end right away
-				reporter.AlbumEnd(album, err)
-				return false
+				return endAlbum(album, err)
+			}
+
+			if toFolder, err = startAlbum(album); err != nil {
+				return endAlbum(album, err)
 			}
 		} else if image == nil {
 			// All done!
-			reporter.AlbumEnd(album, err)
-			return false
+			return endAlbum(album, err)
 		}
 
 		if startPage == -1 {
 			startPage = image.Page
 		}
 
-		if options.MaxImages > 0 && imagesDownloaded >= options.MaxImages {
-			return false
+		if limit.reached() {
+			return endAlbum(album, nil)
 		}
 
 		if options.MaxPages > 0 && (image.Page-startPage) >= options.MaxPages {
 			// Stop fetching images
-			return false
+			return endAlbum(album, nil)
 		}
 
-		if options.FilterSubAlbum != "" && image.SubAlbum != options.FilterSubAlbum {
-			reporter.ImageSkip(image, nil)
+		if err := filter.check(image, nil); err != nil {
+			reporter.ImageSkip(image, err)
 		} else {
-			downloader.DownloadImage(image, options.ToFolder, options.FilenameTemplate, reporter)
-			imagesDownloaded++
+			limit.add()
+			handleImage(image, toFolder, limit.done)
 		}
 
 		return true
 	})
 }
+
+// imageLimit counts the images downloaded from an album, so we can stop once
+// we reach DownloadOptions.MaxImages.  We don't know if an image will be
+// skipped (because it's already in the manifest, or it's too small) until
+// we've tried to download it, so once the images we're waiting on could take
+// us past the limit, reached will wait for them to finish.
+type imageLimit struct {
+	cond       *sync.Cond
+	max        int
+	pending    int
+	downloaded int
+}
+
+func newImageLimit(maxImages int) *imageLimit {
+	return &imageLimit{cond: sync.NewCond(&sync.Mutex{}), max: maxImages}
+}
+
+// add records that an image is about to be downloaded.
+func (limit *imageLimit) add() {
+	limit.cond.L.Lock()
+	defer limit.cond.L.Unlock()
+	limit.pending++
+}
+
+// done records that an image has been downloaded or skipped.
+func (limit *imageLimit) done(downloaded bool) {
+	limit.cond.L.Lock()
+	defer limit.cond.L.Unlock()
+	limit.pending--
+	if downloaded {
+		limit.downloaded++
+	}
+	limit.cond.Broadcast()
+}
+
+// reached returns true if we've downloaded the maximum number of images.
+func (limit *imageLimit) reached() bool {
+	if limit.max <= 0 {
+		return false
+	}
+
+	limit.cond.L.Lock()
+	defer limit.cond.L.Unlock()
+	for limit.pending > 0 && limit.downloaded+limit.pending >= limit.max {
+		limit.cond.Wait()
+	}
+	return limit.downloaded >= limit.max
+}
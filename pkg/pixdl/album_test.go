@@ -0,0 +1,387 @@
+package pixdl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jwalton/pixdl/pkg/download"
+	"github.com/stretchr/testify/assert"
+)
+
+// testReporter is a ProgressReporter which records what happened.
+type testReporter struct {
+	mutex      sync.Mutex
+	albumEnds  []error
+	skipped    []string
+	downloaded []string
+	failed     []string
+}
+
+func (r *testReporter) AlbumFetch(url string)           {}
+func (r *testReporter) AlbumStart(album *AlbumMetadata) {}
+func (r *testReporter) ImageStart(image *ImageMetadata) {}
+func (r *testReporter) ImageProgress(image *ImageMetadata, progress *download.Progress) {
+}
+
+func (r *testReporter) AlbumEnd(album *AlbumMetadata, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.albumEnds = append(r.albumEnds, err)
+}
+
+func (r *testReporter) ImageSkip(image *ImageMetadata, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.skipped = append(r.skipped, image.URL)
+}
+
+func (r *testReporter) ImageEnd(image *ImageMetadata, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err != nil {
+		r.failed = append(r.failed, fmt.Sprintf("%s: %v", image.URL, err))
+	} else {
+		r.downloaded = append(r.downloaded, image.URL)
+	}
+}
+
+// newTestSite starts a web server which serves the given files.  Any path
+// ending in ".html" is served as a page which links to every file listed in
+// `pages` for that path.
+func newTestSite(t *testing.T, files map[string][]byte, pages map[string][]string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if links, ok := pages[r.URL.Path]; ok {
+			body := strings.Builder{}
+			body.WriteString("<html><body>")
+			for _, link := range links {
+				fmt.Fprintf(&body, `<a href="%s%s">%s</a>`, server.URL, link, path.Base(link))
+			}
+			body.WriteString("</body></html>")
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(body.String()))
+			return
+		}
+
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, path.Base(r.URL.Path), time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDownloadAlbumDedupesAcrossRootFolder(t *testing.T) {
+	content := bytes.Repeat([]byte("duplicate"), 1000)
+	server := newTestSite(t,
+		map[string][]byte{"/one.jpg": content, "/two.jpg": content},
+		map[string][]string{"/a.html": {"/one.jpg"}, "/b.html": {"/two.jpg"}},
+	)
+
+	root := t.TempDir()
+	downloader := NewConcurrentDownloader(
+		SetDedupe(DedupeHardlink),
+		SetClient(download.NewClient(download.ComputeSHA256(true))),
+	)
+	defer downloader.Close()
+
+	// Download each album into its own folder, as "pixdl sync" does.
+	reporter := &testReporter{}
+	for _, name := range []string{"a", "b"} {
+		downloader.DownloadAlbum(server.URL+"/"+name+".html", DownloadOptions{
+			ToFolder:   filepath.Join(root, name),
+			RootFolder: root,
+		}, reporter)
+		downloader.Wait()
+	}
+	assert.Empty(t, reporter.failed)
+	assert.Len(t, reporter.downloaded, 2)
+
+	original, err := os.Stat(filepath.Join(root, "a", "one.jpg"))
+	assert.NoError(t, err)
+	duplicate, err := os.Stat(filepath.Join(root, "b", "two.jpg"))
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(original, duplicate), "duplicate should be a hard link to the original")
+
+	// Only the root folder should have a dedupe index.
+	_, err = os.Stat(DedupeIndexPath(root))
+	assert.NoError(t, err)
+	_, err = os.Stat(DedupeIndexPath(filepath.Join(root, "b")))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadAlbumCompareSizeWithEmbeddedMetadata(t *testing.T) {
+	content := bytes.Buffer{}
+	assert.NoError(t, png.Encode(&content, image.NewRGBA(image.Rect(0, 0, 4, 4))))
+	server := newTestSite(t,
+		map[string][]byte{"/photo.png": content.Bytes()},
+		map[string][]string{"/album.html": {"/photo.png"}},
+	)
+
+	folder := t.TempDir()
+	newDownloader := func() ImageDownloader {
+		return NewConcurrentDownloader(
+			SetUseManifest(false),
+			SetConflictPolicy(ConflictCompareSize),
+			SetEmbedMetadata(true),
+		)
+	}
+
+	reporter := &testReporter{}
+	downloader := newDownloader()
+	downloader.DownloadAlbum(server.URL+"/album.html", DownloadOptions{ToFolder: folder}, reporter)
+	downloader.Wait()
+	downloader.Close()
+	assert.Empty(t, reporter.failed)
+	assert.Len(t, reporter.downloaded, 1)
+
+	// Embedding metadata should have changed the size of the file.
+	info, err := os.Stat(filepath.Join(folder, "photo.png"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, int64(content.Len()), info.Size())
+
+	// Without a manifest, the second run should still recognize the file
+	// from its original size, and skip it.
+	reporter = &testReporter{}
+	downloader = newDownloader()
+	downloader.DownloadAlbum(server.URL+"/album.html", DownloadOptions{ToFolder: folder}, reporter)
+	downloader.Wait()
+	downloader.Close()
+	assert.Empty(t, reporter.failed)
+	assert.Empty(t, reporter.downloaded)
+	assert.Equal(t, []string{server.URL + "/photo.png"}, reporter.skipped)
+
+	_, err = os.Stat(filepath.Join(folder, "photo-1.png"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadAlbumEndsOnce(t *testing.T) {
+	content := bytes.Repeat([]byte("image"), 1000)
+	server := newTestSite(t,
+		map[string][]byte{"/one.jpg": content, "/two.jpg": content, "/three.jpg": content},
+		map[string][]string{"/album.html": {"/one.jpg", "/two.jpg", "/three.jpg"}},
+	)
+
+	for _, test := range []struct {
+		name       string
+		options    DownloadOptions
+		downloaded int
+	}{
+		{name: "all images", downloaded: 3},
+		{name: "max images", options: DownloadOptions{MaxImages: 1}, downloaded: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			downloader := NewConcurrentDownloader(SetUseManifest(false))
+			defer downloader.Close()
+
+			reporter := &testReporter{}
+			options := test.options
+			options.ToFolder = t.TempDir()
+			downloader.DownloadAlbum(server.URL+"/album.html", options, reporter)
+			downloader.Wait()
+
+			assert.Equal(t, []error{nil}, reporter.albumEnds)
+			assert.Empty(t, reporter.failed)
+			assert.Len(t, reporter.downloaded, test.downloaded)
+		})
+	}
+}
+
+func TestDownloadAlbumOnlyAdoptsMatchingExistingFiles(t *testing.T) {
+	content := bytes.Repeat([]byte("image"), 1000)
+	server := newTestSite(t,
+		map[string][]byte{"/a/same.jpg": content, "/a/other.jpg": content},
+		map[string][]string{"/album.html": {"/a/same.jpg", "/a/other.jpg"}},
+	)
+
+	// "same.jpg" is already there from an earlier download.  "other.jpg" is
+	// a different image which happens to have the same filename.
+	folder := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(folder, "same.jpg"), content, 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(folder, "other.jpg"), []byte("something else"), 0644))
+
+	downloader := NewConcurrentDownloader()
+	reporter := &testReporter{}
+	albumURL := server.URL + "/album.html"
+	downloader.DownloadAlbum(albumURL, DownloadOptions{ToFolder: folder}, reporter)
+	downloader.Wait()
+	downloader.Close()
+	assert.Len(t, reporter.skipped, 2)
+
+	manifest, err := ReadManifest(folder)
+	assert.NoError(t, err)
+	assert.True(t, manifest.HasImage(albumURL, server.URL+"/a/same.jpg"))
+	assert.False(t, manifest.HasImage(albumURL, server.URL+"/a/other.jpg"))
+}
+
+func TestDownloadAlbumMaxImagesOnlyCountsDownloads(t *testing.T) {
+	content := bytes.Repeat([]byte("image"), 1000)
+	server := newTestSite(t,
+		map[string][]byte{"/one.jpg": content, "/two.jpg": content, "/three.jpg": content},
+		map[string][]string{"/album.html": {"/one.jpg", "/two.jpg", "/three.jpg"}},
+	)
+
+	folder := t.TempDir()
+	download := func() *testReporter {
+		downloader := NewConcurrentDownloader()
+		defer downloader.Close()
+		reporter := &testReporter{}
+		downloader.DownloadAlbum(server.URL+"/album.html", DownloadOptions{ToFolder: folder, MaxImages: 1}, reporter)
+		downloader.Wait()
+		return reporter
+	}
+
+	reporter := download()
+	assert.Equal(t, []string{server.URL + "/one.jpg"}, reporter.downloaded)
+
+	// Images already in the manifest shouldn't count towards the limit.
+	reporter = download()
+	assert.Equal(t, []error{nil}, reporter.albumEnds)
+	assert.Equal(t, []string{server.URL + "/one.jpg"}, reporter.skipped)
+	assert.Equal(t, []string{server.URL + "/two.jpg"}, reporter.downloaded)
+}
+
+func TestDownloadAlbumMaxImagesSkipsSmallImages(t *testing.T) {
+	encode := func(size int) []byte {
+		content := bytes.Buffer{}
+		assert.NoError(t, png.Encode(&content, image.NewRGBA(image.Rect(0, 0, size, size))))
+		return content.Bytes()
+	}
+	server := newTestSite(t,
+		map[string][]byte{"/small.png": encode(2), "/large.png": encode(8)},
+		map[string][]string{"/album.html": {"/small.png", "/large.png"}},
+	)
+
+	downloader := NewConcurrentDownloader(SetUseManifest(false))
+	defer downloader.Close()
+	reporter := &testReporter{}
+	downloader.DownloadAlbum(server.URL+"/album.html", DownloadOptions{
+		ToFolder:  t.TempDir(),
+		MaxImages: 1,
+		MinWidth:  4,
+	}, reporter)
+	downloader.Wait()
+
+	assert.Equal(t, []error{nil}, reporter.albumEnds)
+	assert.Equal(t, []string{server.URL + "/small.png"}, reporter.skipped)
+	assert.Equal(t, []string{server.URL + "/large.png"}, reporter.downloaded)
+}
+
+func TestDownloadAlbumCancelledBeforeFirstImage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/page" {
+			// Ctrl-C while we're checking the links on the album page.
+			cancel()
+			return
+		}
+		fmt.Fprintf(w, `<a href="%[1]s/page">page</a><a href="%[1]s/one.jpg">one</a>`, server.URL)
+	}))
+	defer server.Close()
+
+	downloader := NewConcurrentDownloader(SetUseManifest(false))
+	defer downloader.Close()
+	reporter := &testReporter{}
+	downloader.DownloadAlbumContext(ctx, server.URL+"/album.html", DownloadOptions{ToFolder: t.TempDir()}, reporter)
+	downloader.Wait()
+
+	if assert.Len(t, reporter.albumEnds, 1) {
+		assert.True(t, errors.Is(reporter.albumEnds[0], context.Canceled), reporter.albumEnds[0])
+	}
+	assert.Empty(t, reporter.downloaded)
+}
+
+func TestDownloadAlbumCancelledMidAlbum(t *testing.T) {
+	content := bytes.Repeat([]byte("image"), 10000)
+	var stall int32 = 1
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/album.html":
+			w.Header().Set("Content-Type", "text/html")
+			for i := 0; i < 50; i++ {
+				fmt.Fprintf(w, `<a href="%s/%d.jpg">%d</a>`, server.URL, i, i)
+			}
+		case r.URL.Path == "/0.jpg" && r.Method == http.MethodGet && atomic.LoadInt32(&stall) == 1:
+			// Send half the image, then wait to be cancelled.
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(content)))
+			_, _ = w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			http.ServeContent(w, r, path.Base(r.URL.Path), time.Time{}, bytes.NewReader(content))
+		}
+	}))
+	defer server.Close()
+
+	folder := t.TempDir()
+	partFile := filepath.Join(folder, "0.jpg.part")
+	ctx, cancel := context.WithCancel(context.Background())
+	downloader := NewConcurrentDownloader(SetUseManifest(false), SetMaxConcurrency(1))
+	reporter := &testReporter{}
+	downloader.DownloadAlbumContext(ctx, server.URL+"/album.html", DownloadOptions{ToFolder: folder}, reporter)
+
+	// Wait for the first image to be half downloaded, then Ctrl-C.
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if info, err := os.Stat(partFile); err == nil && info.Size() > 0 {
+			break
+		}
+	}
+	cancel()
+	downloader.Wait()
+	downloader.Close()
+
+	// The album should stop before reaching the end, and end exactly once.
+	assert.Equal(t, []error{context.Canceled}, reporter.albumEnds)
+	assert.Empty(t, reporter.downloaded)
+	assert.Less(t, len(reporter.skipped)+len(reporter.failed), 50)
+
+	// The partial download should be left behind so it can be resumed.
+	_, err := os.Stat(filepath.Join(folder, "0.jpg"))
+	assert.True(t, os.IsNotExist(err))
+	info, err := os.Stat(partFile)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(len(content)/2), info.Size())
+	}
+
+	// Resuming should finish the download and clean up the partial file.
+	atomic.StoreInt32(&stall, 0)
+	downloader = NewConcurrentDownloader(SetUseManifest(false))
+	reporter = &testReporter{}
+	downloader.DownloadAlbum(server.URL+"/album.html", DownloadOptions{ToFolder: folder, MaxImages: 1}, reporter)
+	downloader.Wait()
+	downloader.Close()
+
+	assert.Equal(t, []error{nil}, reporter.albumEnds)
+	assert.Empty(t, reporter.failed)
+	assert.Equal(t, []string{server.URL + "/0.jpg"}, reporter.downloaded)
+	data, err := os.ReadFile(filepath.Join(folder, "0.jpg"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	parts, _ := filepath.Glob(filepath.Join(folder, "*.part*"))
+	assert.Empty(t, parts)
+}
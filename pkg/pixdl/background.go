@@ -1,10 +1,15 @@
 package pixdl
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/jwalton/pixdl/pkg/download"
 	"github.com/jwalton/pixdl/pkg/providers"
 )
 
@@ -23,11 +28,58 @@ type DownloadOptions struct {
 	Parallel int
 	// ToFolder is the destination folder to download images to.
 	ToFolder string
+	// RootFolder is the output folder that ToFolder is part of, where the
+	// dedupe index is kept.  This is used when downloading an album into a
+	// folder inside a larger collection (e.g. by "pixdl sync"), so duplicates
+	// are found across the whole collection.  If empty, ToFolder is used.
+	RootFolder string
 	// FilenameTemplate is a golang template for generating the filename to write to.
 	FilenameTemplate string
-	// FilterSubAlbum is the name of the subalbum to filter.  If this is non-empty,
-	// then only images from the specified SubAlbum will be downloaded.
+	// AlbumFolderTemplate is a golang template for generating the name of a
+	// folder, relative to ToFolder, to store all images from the album in.
+	// If empty, images will be stored directly in ToFolder.
+	AlbumFolderTemplate string
+	// FilterSubAlbum is a comma separated list of sub-albums to download,
+	// which may include numeric ranges (e.g. "22,30-45").  If this is
+	// non-empty, then only images from the specified sub-albums will be
+	// downloaded.
 	FilterSubAlbum string
+	// Include is a list of regular expressions.  If non-empty, only images
+	// whose URL or filename matches at least one of them will be downloaded.
+	Include []string
+	// Exclude is a list of regular expressions.  Images whose URL or
+	// filename matches any of them will be skipped.
+	Exclude []string
+	// AllowTypes is a list of file extensions (e.g. "jpg") or MIME types
+	// (e.g. "image/jpeg" or "image/*").  If non-empty, only images of one of
+	// these types will be downloaded.
+	AllowTypes []string
+	// DenyTypes is a list of file extensions or MIME types, like AllowTypes.
+	// Images of any of these types will be skipped.
+	DenyTypes []string
+	// MinSize is the minimum size, in bytes, of images to download.  0 for
+	// no minimum.
+	MinSize int64
+	// MaxSize is the maximum size, in bytes, of images to download.  0 for
+	// no maximum.
+	MaxSize int64
+	// MinWidth and MinHeight are the minimum dimensions, in pixels, of
+	// images to download.  0 for no minimum.  If the provider doesn't know
+	// the dimensions of an image, the start of the image is fetched and its
+	// header decoded to find them.
+	MinWidth  int64
+	MinHeight int64
+	// MaxWidth and MaxHeight are the maximum dimensions, in pixels, of
+	// images to download.  0 for no maximum.
+	MaxWidth  int64
+	MaxHeight int64
+	// Since, if set, skips images with a timestamp before this time.
+	// Images without a timestamp are never skipped.
+	Since *time.Time
+	// Until, if set, skips images with a timestamp after this time.  Providers
+	// which return images in chronological order (such as forum threads) will
+	// stop fetching pages once they pass this time.
+	Until *time.Time
 	// Params is parameters to pass down to the providers.
 	Params map[string]string
 }
@@ -41,6 +93,26 @@ type ImageDownloader interface {
 		reporter ProgressReporter,
 	)
 
+	// DownloadAlbumContext is like DownloadAlbum, but will stop fetching and
+	// downloading images from the album once ctx is cancelled.
+	DownloadAlbumContext(
+		ctx context.Context,
+		url string,
+		options DownloadOptions,
+		reporter ProgressReporter,
+	)
+
+	// ListAlbumContext fetches every image in an album, and calls `callback`
+	// with each image that DownloadAlbum would download, and where it would
+	// be saved.  Nothing is downloaded or written to disk.  Returns an error
+	// if the album can't be fetched.
+	ListAlbumContext(
+		ctx context.Context,
+		url string,
+		options DownloadOptions,
+		callback func(image *ListedImage),
+	) error
+
 	// DownloadImage will download an individual image from an album.
 	DownloadImage(
 		image *ImageMetadata,
@@ -49,6 +121,17 @@ type ImageDownloader interface {
 		reporter ProgressReporter,
 	)
 
+	// DownloadImageContext is like DownloadImage, but the download will be
+	// aborted if ctx is cancelled.  Partially downloaded files are left on
+	// disk so they can be resumed later.
+	DownloadImageContext(
+		ctx context.Context,
+		image *ImageMetadata,
+		toFolder string,
+		filenameTemplate string,
+		reporter ProgressReporter,
+	)
+
 	// Wait will block until all albums/images currently being downloaded are
 	// done downloading.
 	Wait()
@@ -59,14 +142,48 @@ type ImageDownloader interface {
 	// IsClosed will return true if this downloader has been closed.
 	IsClosed() bool
 
+	// startAlbumSidecar writes the sidecar file for an album which is about
+	// to be downloaded into `folder`, if sidecars are enabled.
+	startAlbumSidecar(folder string, album *AlbumMetadata) error
+
+	// endAlbum is called once every image from an album which was downloaded
+	// into `folder` has finished, and writes out anything that was saved up
+	// while the album was downloading.
+	endAlbum(folder string, album *AlbumMetadata)
+
+	// queueImage is like DownloadImageContext, but `rootFolder` is the output
+	// folder the album is being downloaded into, which may be a parent of
+	// `toFolder`.  `filter` is checked again once the size and type of the
+	// image are known, and may be nil.  `done`, if not nil, is called once
+	// the image has been downloaded or skipped, with `downloaded` set to
+	// false if the image was skipped.
+	queueImage(
+		ctx context.Context,
+		image *ImageMetadata,
+		rootFolder string,
+		toFolder string,
+		filenameTemplate string,
+		filter *imageFilter,
+		reporter ProgressReporter,
+		done func(downloaded bool),
+	)
+
 	getEnv() *providers.Env
+
+	// getManifest returns the Manifest for the given output folder, or nil if
+	// manifests are disabled.
+	getManifest(folder string) (*Manifest, error)
 }
 
 type downloadRequest struct {
+	ctx              context.Context
 	image            *ImageMetadata
+	rootFolder       string
 	toFolder         string
 	filenameTemplate string
+	filter           *imageFilter
 	reporter         ProgressReporter
+	done             func(downloaded bool)
 }
 
 type concurrentDownloader struct {
@@ -76,18 +193,89 @@ type concurrentDownloader struct {
 	imageWg        *sync.WaitGroup
 	closed         int32
 	maxConcurrency uint
-	minSize        int64
+	onConflict     ConflictPolicy
+	destinations   *destinations
+	dedupe         DedupeMode
+	sidecars       *sidecarWriter
+	embedMetadata  bool
+	noManifest     bool
+	manifestsMutex sync.Mutex
+	// manifests is a map of manifests indexed by absolute folder name.
+	manifests map[string]*Manifest
+	// dedupeIndexes is a map of dedupe indexes indexed by absolute folder
+	// name.  Protected by manifestsMutex.
+	dedupeIndexes map[string]*DedupeIndex
 }
 
 // Option is an option that can be passed to NewConcurrnetDownloader().
 type Option func(*concurrentDownloader)
 
-// SetMinSize is an option that sets the minimum size, in bytes, of files to download.
-// Any file smaller than this will be skipped. 0 for any size.  If the size of a
-// file cannot be determined ahead of time, this will be ignored.
-func SetMinSize(size int64) Option {
+// SetConflictPolicy is an option for NewConcurrentDownloader which sets what
+// to do when the file an image would be downloaded to already exists.  The
+// default is ConflictSkip.
+func SetConflictPolicy(policy ConflictPolicy) Option {
 	return func(dl *concurrentDownloader) {
-		dl.minSize = size
+		dl.onConflict = policy
+	}
+}
+
+// SetDedupe is an option for NewConcurrentDownloader which turns on
+// deduplication.  A DedupeIndex of every file downloaded is kept in each
+// output folder, and when an image is identical to a file that was downloaded
+// before, the duplicate is handled according to `mode`.  For best performance,
+// the download.Client should be created with the `download.ComputeSHA256`
+// option, so files are hashed as they are downloaded.
+func SetDedupe(mode DedupeMode) Option {
+	return func(dl *concurrentDownloader) {
+		dl.dedupe = mode
+	}
+}
+
+// SetSidecars is an option for NewConcurrentDownloader which controls which
+// metadata sidecar files are written alongside downloaded images.  The
+// default is SidecarsNone.
+func SetSidecars(mode SidecarMode) Option {
+	return func(dl *concurrentDownloader) {
+		dl.sidecars = newSidecarWriter(mode)
+	}
+}
+
+// SetEmbedMetadata is an option for NewConcurrentDownloader which writes
+// the source URL, album name, author, title, and timestamp into each image
+// after it is downloaded.  This is supported for JPEG and PNG files - other
+// formats are left unchanged, and a warning is reported.
+func SetEmbedMetadata(embedMetadata bool) Option {
+	return func(dl *concurrentDownloader) {
+		dl.embedMetadata = embedMetadata
+	}
+}
+
+// SetClient is an option for NewConcurrentDownloader which sets the
+// download.Client used to download files.  If not specified, a client
+// created with `download.NewClient()` will be used.
+func SetClient(client *download.Client) Option {
+	return func(dl *concurrentDownloader) {
+		dl.env.DownloadClient = client
+	}
+}
+
+// SetScheduler is an option for NewConcurrentDownloader which sets the
+// Scheduler used by providers to fetch album pages.  The same Scheduler
+// should be passed to the download.Client via `download.WithScheduler()`,
+// so that limits apply to both pages and images.
+func SetScheduler(scheduler *download.Scheduler) Option {
+	return func(dl *concurrentDownloader) {
+		dl.env.HTTPClient = scheduler.Client(http.DefaultClient)
+	}
+}
+
+// SetUseManifest is an option for NewConcurrentDownloader which controls whether
+// or not a Manifest is kept in each output folder.  When enabled (the default)
+// images recorded in the manifest will not be downloaded again, even if they
+// have since been moved or renamed.
+func SetUseManifest(useManifest bool) Option {
+	return func(dl *concurrentDownloader) {
+		dl.noManifest = !useManifest
 	}
 }
 
@@ -107,10 +295,16 @@ func SetMaxConcurrency(maxConcurrency uint) Option {
 // the maximum number of concurrent downloads to allow at the same time.
 func NewConcurrentDownloader(options ...Option) ImageDownloader {
 	downloader := &concurrentDownloader{
-		env:     &providers.Env{DownloadClient: client},
-		ch:      nil,
-		albumWg: &sync.WaitGroup{},
-		imageWg: &sync.WaitGroup{},
+		env:           &providers.Env{DownloadClient: download.NewClient()},
+		ch:            nil,
+		albumWg:       &sync.WaitGroup{},
+		imageWg:       &sync.WaitGroup{},
+		onConflict:    ConflictSkip,
+		destinations:  newDestinations(),
+		dedupe:        DedupeOff,
+		sidecars:      newSidecarWriter(SidecarsNone),
+		manifests:     map[string]*Manifest{},
+		dedupeIndexes: map[string]*DedupeIndex{},
 	}
 
 	for _, option := range options {
@@ -137,14 +331,25 @@ func (downloader *concurrentDownloader) startImageWorker(ch <-chan *downloadRequ
 	for !done {
 		req := <-ch
 		if req != nil {
-			downloadImage(
-				downloader.env,
-				req.image,
-				req.toFolder,
-				req.filenameTemplate,
-				downloader.minSize,
-				req.reporter,
-			)
+			downloaded := false
+			manifest, err := downloader.getManifest(req.toFolder)
+			if err != nil {
+				req.reporter.ImageSkip(req.image, err)
+			} else {
+				downloaded = downloader.downloadImage(
+					req.ctx,
+					req.image,
+					req.rootFolder,
+					req.toFolder,
+					req.filenameTemplate,
+					req.filter,
+					manifest,
+					req.reporter,
+				)
+			}
+			if req.done != nil {
+				req.done(downloaded)
+			}
 			downloader.imageWg.Done()
 		} else {
 			done = true
@@ -157,30 +362,74 @@ func (downloader *concurrentDownloader) DownloadAlbum(
 	options DownloadOptions,
 	reporter ProgressReporter,
 ) {
-	downloader.albumWg.Add(1)
+	downloader.DownloadAlbumContext(context.Background(), url, options, reporter)
+}
 
-	err := validateTemplate(options.FilenameTemplate)
-	if err != nil {
-		reporter.ImageEnd(nil, err)
+func (downloader *concurrentDownloader) DownloadAlbumContext(
+	ctx context.Context,
+	url string,
+	options DownloadOptions,
+	reporter ProgressReporter,
+) {
+	if err := validateDownloadOptions(options); err != nil {
+		reporter.AlbumFetch(url)
+		reporter.AlbumEnd(&AlbumMetadata{URL: url}, err)
+		return
 	}
 
+	downloader.albumWg.Add(1)
 	go func() {
-		downloadAlbum(downloader, url, options, reporter)
+		downloadAlbum(ctx, downloader, url, options, reporter)
 		downloader.albumWg.Done()
 	}()
 }
 
+func (downloader *concurrentDownloader) ListAlbumContext(
+	ctx context.Context,
+	url string,
+	options DownloadOptions,
+	callback func(image *ListedImage),
+) error {
+	return listAlbum(ctx, downloader, url, options, callback)
+}
+
 func (downloader *concurrentDownloader) DownloadImage(
 	image *ImageMetadata,
 	toFolder string,
 	filenameTemplate string,
 	reporter ProgressReporter,
+) {
+	downloader.DownloadImageContext(context.Background(), image, toFolder, filenameTemplate, reporter)
+}
+
+func (downloader *concurrentDownloader) DownloadImageContext(
+	ctx context.Context,
+	image *ImageMetadata,
+	toFolder string,
+	filenameTemplate string,
+	reporter ProgressReporter,
+) {
+	downloader.queueImage(ctx, image, toFolder, toFolder, filenameTemplate, nil, reporter, nil)
+}
+
+func (downloader *concurrentDownloader) queueImage(
+	ctx context.Context,
+	image *ImageMetadata,
+	rootFolder string,
+	toFolder string,
+	filenameTemplate string,
+	filter *imageFilter,
+	reporter ProgressReporter,
+	done func(downloaded bool),
 ) {
 	if downloader.IsClosed() {
 		reporter.ImageSkip(image, fmt.Errorf("downloader closed"))
+		if done != nil {
+			done(false)
+		}
 	} else {
 		downloader.imageWg.Add(1)
-		downloader.ch <- &downloadRequest{image, toFolder, filenameTemplate, reporter}
+		downloader.ch <- &downloadRequest{ctx, image, rootFolder, toFolder, filenameTemplate, filter, reporter, done}
 	}
 }
 
@@ -189,6 +438,8 @@ func (downloader *concurrentDownloader) Wait() {
 	downloader.albumWg.Wait()
 	// Wait for all images to finish downloading...
 	downloader.imageWg.Wait()
+	// Write out sidecars for any images downloaded outside of an album.
+	_ = downloader.sidecars.flush()
 }
 
 func (downloader *concurrentDownloader) Close() {
@@ -197,12 +448,79 @@ func (downloader *concurrentDownloader) Close() {
 	close(downloader.ch)
 	// Block until everything is done.
 	downloader.imageWg.Wait()
+	_ = downloader.sidecars.flush()
 }
 
 func (downloader *concurrentDownloader) IsClosed() bool {
 	return atomic.LoadInt32(&downloader.closed) == 1
 }
 
+func (downloader *concurrentDownloader) startAlbumSidecar(folder string, album *AlbumMetadata) error {
+	return downloader.sidecars.startAlbum(folder, album)
+}
+
+func (downloader *concurrentDownloader) endAlbum(folder string, album *AlbumMetadata) {
+	// If this fails, every image is still in the manifest log, so there's
+	// nothing lost - we'll try again at the end of the next album.
+	if manifest, err := downloader.getManifest(folder); err == nil && manifest != nil {
+		_ = manifest.Save()
+	}
+	// If this fails, we'll try again when the downloader is closed.
+	_ = downloader.sidecars.endAlbum(folder, album)
+}
+
 func (downloader *concurrentDownloader) getEnv() *providers.Env {
 	return downloader.env
 }
+
+func (downloader *concurrentDownloader) getManifest(folder string) (*Manifest, error) {
+	if downloader.noManifest {
+		return nil, nil
+	}
+
+	absFolder, err := filepath.Abs(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	downloader.manifestsMutex.Lock()
+	defer downloader.manifestsMutex.Unlock()
+
+	manifest := downloader.manifests[absFolder]
+	if manifest == nil {
+		manifest, err = ReadManifest(absFolder)
+		if err != nil {
+			return nil, err
+		}
+		downloader.manifests[absFolder] = manifest
+	}
+
+	return manifest, nil
+}
+
+// getDedupeIndex returns the DedupeIndex for the given output folder, or nil
+// if deduplication is disabled.
+func (downloader *concurrentDownloader) getDedupeIndex(folder string) (*DedupeIndex, error) {
+	if downloader.dedupe == DedupeOff || downloader.dedupe == "" {
+		return nil, nil
+	}
+
+	absFolder, err := filepath.Abs(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	downloader.manifestsMutex.Lock()
+	defer downloader.manifestsMutex.Unlock()
+
+	index := downloader.dedupeIndexes[absFolder]
+	if index == nil {
+		index, err = ReadDedupeIndex(absFolder)
+		if err != nil {
+			return nil, err
+		}
+		downloader.dedupeIndexes[absFolder] = index
+	}
+
+	return index, nil
+}
@@ -0,0 +1,237 @@
+package pixdl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jwalton/pixdl/pkg/pixdl/embed"
+)
+
+// ConflictPolicy controls what happens when the file we want to download an
+// image to already exists.
+type ConflictPolicy string
+
+const (
+	// ConflictSkip skips the image if the file already exists.  This is the
+	// default.
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictOverwrite downloads the image, replacing the existing file.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictRenameWithSuffix downloads the image to a new file, named by
+	// adding a short hash of the image's URL to the filename (e.g.
+	// "image-1a2b3c4d.jpg").  The same image always gets the same name, so
+	// if that file already exists too, the image is skipped.
+	ConflictRenameWithSuffix ConflictPolicy = "rename-with-suffix"
+	// ConflictRenameWithIndex downloads the image to a new file, named by
+	// adding the first free index to the filename (e.g. "image-1.jpg").
+	ConflictRenameWithIndex ConflictPolicy = "rename-with-index"
+	// ConflictCompareSize skips the image if the existing file is the same
+	// size as the image (or if the size of the image isn't known), and
+	// otherwise behaves like ConflictRenameWithIndex.
+	ConflictCompareSize ConflictPolicy = "compare-size-then-decide"
+)
+
+// conflictPolicies is every valid ConflictPolicy.
+var conflictPolicies = []ConflictPolicy{
+	ConflictSkip,
+	ConflictOverwrite,
+	ConflictRenameWithSuffix,
+	ConflictRenameWithIndex,
+	ConflictCompareSize,
+}
+
+// maxConflictIndex is the highest index we'll try before giving up on
+// finding a free filename.
+const maxConflictIndex = 9999
+
+// ParseConflictPolicy converts a string into a ConflictPolicy.  An empty
+// string is treated as ConflictSkip.
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	if value == "" {
+		return ConflictSkip, nil
+	}
+
+	names := make([]string, 0, len(conflictPolicies))
+	for _, policy := range conflictPolicies {
+		if string(policy) == value {
+			return policy, nil
+		}
+		names = append(names, string(policy))
+	}
+
+	return ConflictSkip, fmt.Errorf("unknown conflict policy %q (expected one of %s)", value, strings.Join(names, ", "))
+}
+
+// destinations keeps track of the files that are currently being downloaded,
+// so two images are never downloaded to the same file at the same time.
+//
+// Methods on destinations are safe to call from multiple goroutines.
+type destinations struct {
+	mutex sync.Mutex
+	inUse map[string]bool
+}
+
+func newDestinations() *destinations {
+	return &destinations{inUse: map[string]bool{}}
+}
+
+// reserve marks a file as being downloaded.  Returns false if the file is
+// already reserved.
+func (dests *destinations) reserve(filename string) bool {
+	key := destinationKey(filename)
+
+	dests.mutex.Lock()
+	defer dests.mutex.Unlock()
+
+	if dests.inUse[key] {
+		return false
+	}
+	dests.inUse[key] = true
+	return true
+}
+
+// release marks a file as no longer being downloaded.
+func (dests *destinations) release(filename string) {
+	key := destinationKey(filename)
+
+	dests.mutex.Lock()
+	defer dests.mutex.Unlock()
+
+	delete(dests.inUse, key)
+}
+
+// destinationKey returns the key used to identify a file in destinations.
+// Windows and macOS both usually have case-insensitive filesystems, so on
+// those platforms "a.jpg" and "A.jpg" are treated as the same file.
+func destinationKey(filename string) string {
+	if abs, err := filepath.Abs(filename); err == nil {
+		filename = abs
+	}
+	if isWindows || isDarwin {
+		filename = strings.ToLower(filename)
+	}
+	return filename
+}
+
+// conflictResult is the result of resolveConflict.
+type conflictResult struct {
+	// filename is the file to download the image to.  If this is non-empty,
+	// it has been reserved, and must be released once the download is done.
+	filename string
+	// existing is set if the image should be skipped because it has already
+	// been downloaded to this file.
+	existing string
+}
+
+// resolveConflict works out which file to download an image to, given the
+// file we'd like to download it to, and what to do if that file already
+// exists (or is being downloaded by another worker).  `size` is the size of
+// the image, or -1 if unknown.
+func resolveConflict(
+	policy ConflictPolicy,
+	dests *destinations,
+	filename string,
+	imageURL string,
+	size int64,
+) (conflictResult, error) {
+	switch policy {
+	case ConflictOverwrite:
+		if !dests.reserve(filename) {
+			return conflictResult{}, errAlreadyDownloading(filename)
+		}
+		return conflictResult{filename: filename}, nil
+
+	case ConflictRenameWithSuffix:
+		result, err := reserveIfMissing(dests, filename)
+		if err != nil || result.filename != "" {
+			return result, err
+		}
+
+		candidate := addFilenameSuffix(filename, "-"+truncateString(8, hashString(imageURL)))
+		exists, err := fileExists(candidate)
+		if err != nil {
+			return conflictResult{}, err
+		}
+		if exists {
+			return conflictResult{existing: candidate}, nil
+		}
+		if !dests.reserve(candidate) {
+			return conflictResult{}, errAlreadyDownloading(candidate)
+		}
+		return conflictResult{filename: candidate}, nil
+
+	case ConflictRenameWithIndex, ConflictCompareSize:
+		for index := 0; index <= maxConflictIndex; index++ {
+			candidate := filename
+			if index > 0 {
+				candidate = addFilenameSuffix(filename, fmt.Sprintf("-%d", index))
+			}
+
+			info, err := os.Stat(candidate)
+			if err != nil && !os.IsNotExist(err) {
+				return conflictResult{}, err
+			}
+			if err == nil {
+				if policy == ConflictCompareSize && (size < 0 || hasSize(candidate, info, size)) {
+					return conflictResult{existing: candidate}, nil
+				}
+				continue
+			}
+
+			if dests.reserve(candidate) {
+				return conflictResult{filename: candidate}, nil
+			}
+		}
+		return conflictResult{}, fmt.Errorf("could not find a free filename for %s", filename)
+
+	default:
+		result, err := reserveIfMissing(dests, filename)
+		if err != nil || result.filename != "" {
+			return result, err
+		}
+		if result.existing == "" {
+			return conflictResult{}, errAlreadyDownloading(filename)
+		}
+		return result, nil
+	}
+}
+
+// hasSize returns true if the given file is `size` bytes long, or was before
+// pixdl embedded metadata in it.
+func hasSize(filename string, info os.FileInfo, size int64) bool {
+	if info.Size() == size {
+		return true
+	}
+	originalSize, err := embed.ReadOriginalSize(filename)
+	return err == nil && originalSize == size
+}
+
+// reserveIfMissing reserves `filename` if it doesn't exist yet.  If it does
+// exist, returns a result with `existing` set.  If it is reserved by someone
+// else, returns an empty result.
+func reserveIfMissing(dests *destinations, filename string) (conflictResult, error) {
+	exists, err := fileExists(filename)
+	if err != nil {
+		return conflictResult{}, err
+	}
+	if exists {
+		return conflictResult{existing: filename}, nil
+	}
+	if dests.reserve(filename) {
+		return conflictResult{filename: filename}, nil
+	}
+	return conflictResult{}, nil
+}
+
+// addFilenameSuffix adds a suffix to a filename, before the extension.
+func addFilenameSuffix(filename string, suffix string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + suffix + ext
+}
+
+func errAlreadyDownloading(filename string) error {
+	return fmt.Errorf("another image is already being downloaded to %s", filename)
+}
@@ -0,0 +1,105 @@
+package pixdl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestFile(t *testing.T, filename string, size int) {
+	assert.NoError(t, os.WriteFile(filename, make([]byte, size), 0644))
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	policy, err := ParseConflictPolicy("")
+	assert.NoError(t, err)
+	assert.Equal(t, ConflictSkip, policy)
+
+	policy, err = ParseConflictPolicy("rename-with-index")
+	assert.NoError(t, err)
+	assert.Equal(t, ConflictRenameWithIndex, policy)
+
+	_, err = ParseConflictPolicy("rename")
+	assert.Error(t, err)
+}
+
+func TestResolveConflict(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "image.jpg")
+	url := "https://example.com/image.jpg"
+
+	// No conflict.
+	for _, policy := range conflictPolicies {
+		result, err := resolveConflict(policy, newDestinations(), filename, url, 10)
+		assert.NoError(t, err, policy)
+		assert.Equal(t, conflictResult{filename: filename}, result, policy)
+	}
+
+	writeTestFile(t, filename, 10)
+
+	result, err := resolveConflict(ConflictSkip, newDestinations(), filename, url, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, conflictResult{existing: filename}, result)
+
+	result, err = resolveConflict(ConflictOverwrite, newDestinations(), filename, url, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, conflictResult{filename: filename}, result)
+
+	suffixed := filepath.Join(dir, "image-"+hashString(url)[:8]+".jpg")
+	result, err = resolveConflict(ConflictRenameWithSuffix, newDestinations(), filename, url, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, conflictResult{filename: suffixed}, result)
+
+	writeTestFile(t, suffixed, 10)
+	result, err = resolveConflict(ConflictRenameWithSuffix, newDestinations(), filename, url, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, conflictResult{existing: suffixed}, result)
+
+	writeTestFile(t, filepath.Join(dir, "image-1.jpg"), 20)
+	result, err = resolveConflict(ConflictRenameWithIndex, newDestinations(), filename, url, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, conflictResult{filename: filepath.Join(dir, "image-2.jpg")}, result)
+
+	// Same size as an existing file - skip.
+	result, err = resolveConflict(ConflictCompareSize, newDestinations(), filename, url, 20)
+	assert.NoError(t, err)
+	assert.Equal(t, conflictResult{existing: filepath.Join(dir, "image-1.jpg")}, result)
+
+	// Different size - rename.
+	result, err = resolveConflict(ConflictCompareSize, newDestinations(), filename, url, 30)
+	assert.NoError(t, err)
+	assert.Equal(t, conflictResult{filename: filepath.Join(dir, "image-2.jpg")}, result)
+
+	// Unknown size - skip.
+	result, err = resolveConflict(ConflictCompareSize, newDestinations(), filename, url, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, conflictResult{existing: filename}, result)
+}
+
+func TestResolveConflictInRun(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "image.jpg")
+
+	dests := newDestinations()
+	result, err := resolveConflict(ConflictSkip, dests, filename, "https://example.com/a/image.jpg", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, filename, result.filename)
+
+	// Another image with the same name, while the first is still downloading.
+	_, err = resolveConflict(ConflictSkip, dests, filename, "https://example.com/b/image.jpg", 10)
+	assert.Error(t, err)
+	_, err = resolveConflict(ConflictOverwrite, dests, filename, "https://example.com/b/image.jpg", 10)
+	assert.Error(t, err)
+
+	result, err = resolveConflict(ConflictRenameWithIndex, dests, filename, "https://example.com/b/image.jpg", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "image-1.jpg"), result.filename)
+
+	// Once the first download is done, the file can be used again.
+	dests.release(filename)
+	result, err = resolveConflict(ConflictOverwrite, dests, filename, "https://example.com/b/image.jpg", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, filename, result.filename)
+}
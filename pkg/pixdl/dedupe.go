@@ -0,0 +1,376 @@
+package pixdl
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DedupeMode controls what happens when a downloaded image turns out to be
+// identical to a file that has already been downloaded.
+type DedupeMode string
+
+const (
+	// DedupeOff disables deduplication.  This is the default.
+	DedupeOff DedupeMode = "off"
+	// DedupeHardlink replaces duplicates with a hard link to the original file.
+	DedupeHardlink DedupeMode = "hardlink"
+	// DedupeSymlink replaces duplicates with a symbolic link to the original file.
+	DedupeSymlink DedupeMode = "symlink"
+	// DedupeSkip deletes duplicates, and records them in the dedupe index.
+	DedupeSkip DedupeMode = "skip"
+)
+
+// dedupeModes is every valid DedupeMode.
+var dedupeModes = []DedupeMode{DedupeOff, DedupeHardlink, DedupeSymlink, DedupeSkip}
+
+const dedupeIndexFilename = "dedupe.jsonl"
+
+// ParseDedupeMode converts a string into a DedupeMode.  An empty string is
+// treated as DedupeOff.
+func ParseDedupeMode(value string) (DedupeMode, error) {
+	if value == "" {
+		return DedupeOff, nil
+	}
+
+	names := make([]string, 0, len(dedupeModes))
+	for _, mode := range dedupeModes {
+		if string(mode) == value {
+			return mode, nil
+		}
+		names = append(names, string(mode))
+	}
+
+	return DedupeOff, fmt.Errorf("unknown dedupe mode %q (expected one of %s)", value, strings.Join(names, ", "))
+}
+
+// DedupeIndex is a record of the SHA-256 hash of every file downloaded into
+// an output folder (including any album folders inside it), so we can tell
+// when we download the same file twice.
+//
+// The index is stored in the ManifestDir of the output folder, with one JSON
+// object per line.  New entries are appended to the end of the file.
+//
+// Methods on DedupeIndex are safe to call from multiple goroutines.
+type DedupeIndex struct {
+	mutex  sync.Mutex
+	folder string
+	// files is a map of original files, indexed by hash.
+	files map[string]*DedupeEntry
+	// urls is a map of every file in the index, including duplicates,
+	// indexed by the URL it was downloaded from.
+	urls map[string]*DedupeEntry
+}
+
+// DedupeEntry is a single entry in a DedupeIndex.
+type DedupeEntry struct {
+	// SHA256 is the hex encoded SHA-256 hash of the file.
+	SHA256 string `json:"sha256"`
+	// Size is the size of the file, in bytes.
+	Size int64 `json:"size"`
+	// Path is the path of the file, relative to the output folder, using "/"
+	// as a separator.
+	Path string `json:"path"`
+	// URL is the URL the file was downloaded from.
+	URL string `json:"url,omitempty"`
+	// DuplicateOf is set if this file was a duplicate of an earlier file.  This
+	// is the path of the earlier file.
+	DuplicateOf string `json:"duplicateOf,omitempty"`
+	// Added is the time this entry was added to the index.
+	Added time.Time `json:"added"`
+}
+
+// DedupeIndexPath returns the path to the dedupe index for the given output folder.
+func DedupeIndexPath(folder string) string {
+	return filepath.Join(folder, ManifestDir, dedupeIndexFilename)
+}
+
+// ReadDedupeIndex reads the dedupe index for the given output folder.  If
+// there is no index in the folder, this returns a new, empty index.
+func ReadDedupeIndex(folder string) (*DedupeIndex, error) {
+	index := &DedupeIndex{
+		folder: folder,
+		files:  map[string]*DedupeEntry{},
+		urls:   map[string]*DedupeEntry{},
+	}
+
+	file, err := os.Open(DedupeIndexPath(folder))
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := &DedupeEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			// Probably a half-written line from a crash - skip it.
+			continue
+		}
+		if entry.SHA256 != "" && entry.DuplicateOf == "" {
+			index.files[entry.SHA256] = entry
+		}
+		if entry.URL != "" {
+			index.urls[entry.URL] = entry
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", DedupeIndexPath(folder), err)
+	}
+
+	return index, nil
+}
+
+// Folder returns the output folder this index describes.
+func (index *DedupeIndex) Folder() string {
+	return index.folder
+}
+
+// Lookup returns the full path of a previously downloaded file with the
+// given hash, or "" if there is no such file.  Files which have since been
+// deleted or changed are ignored.
+func (index *DedupeIndex) Lookup(contentHash string) string {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	return index.lookup(contentHash)
+}
+
+// lookup is like Lookup, but the caller must hold the mutex.
+func (index *DedupeIndex) lookup(contentHash string) string {
+	entry := index.files[contentHash]
+	if entry == nil {
+		return ""
+	}
+
+	filename := filepath.Join(index.folder, filepath.FromSlash(entry.Path))
+	info, err := os.Stat(filename)
+	if err != nil || info.Size() != entry.Size {
+		return ""
+	}
+	return filename
+}
+
+// add records a newly downloaded file.  If the index already has a different
+// file with the same hash, then nothing is recorded, and the full path of the
+// existing file is returned.
+func (index *DedupeIndex) add(contentHash string, filename string, url string) (string, error) {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if original := index.lookup(contentHash); original != "" && original != filename {
+		return original, nil
+	}
+
+	entry, err := index.newEntry(contentHash, filename, url)
+	if err != nil {
+		return "", err
+	}
+	index.files[contentHash] = entry
+	index.addURL(entry)
+	return "", index.append(entry)
+}
+
+// addDuplicate records that `filename` was a duplicate of `original`.
+func (index *DedupeIndex) addDuplicate(contentHash string, filename string, original string, size int64, url string) error {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	entry := &DedupeEntry{
+		SHA256:      contentHash,
+		Size:        size,
+		Path:        index.relPath(filename),
+		URL:         url,
+		DuplicateOf: index.relPath(original),
+		Added:       time.Now(),
+	}
+	index.addURL(entry)
+	return index.append(entry)
+}
+
+// addURL records the URL an entry was downloaded from.  Caller must hold the
+// mutex.
+func (index *DedupeIndex) addURL(entry *DedupeEntry) {
+	if entry.URL != "" {
+		index.urls[entry.URL] = entry
+	}
+}
+
+// hasDownload returns true if the index records that `filename` was
+// downloaded from `url`, and the file hasn't changed size since.
+func (index *DedupeIndex) hasDownload(url string, filename string) bool {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return false
+	}
+
+	index.mutex.Lock()
+	entry := index.urls[url]
+	index.mutex.Unlock()
+
+	if entry == nil || entry.Path != index.relPath(filename) {
+		return false
+	}
+	info, err := os.Stat(filename)
+	return err == nil && info.Size() == entry.Size
+}
+
+// newEntry creates a new entry for a file.  Caller must hold the mutex.
+func (index *DedupeIndex) newEntry(contentHash string, filename string, url string) (*DedupeEntry, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DedupeEntry{
+		SHA256: contentHash,
+		Size:   info.Size(),
+		Path:   index.relPath(filename),
+		URL:    url,
+		Added:  time.Now(),
+	}, nil
+}
+
+// relPath returns the path of the file relative to the output folder, using
+// "/" as a separator.
+func (index *DedupeIndex) relPath(filename string) string {
+	path, err := filepath.Rel(index.folder, filename)
+	if err != nil {
+		path = filename
+	}
+	return filepath.ToSlash(path)
+}
+
+// append writes an entry to the end of the index file.  Caller must hold
+// the mutex.
+func (index *DedupeIndex) append(entry *DedupeEntry) error {
+	filename := DedupeIndexPath(index.folder)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// dedupeFile checks to see if a freshly downloaded file is a duplicate of a
+// file already in the index.  If it is, then the duplicate is replaced with a
+// link to the original, or deleted, depending on `mode`.  `contentHash` is the
+// SHA-256 hash of the file - if this is "", the hash will be computed.
+//
+// Returns the name of the file which now holds the image.  This will be
+// `filename`, unless the duplicate was deleted.
+func dedupeFile(index *DedupeIndex, mode DedupeMode, filename string, contentHash string, url string) (string, error) {
+	if mode == DedupeOff || index == nil {
+		return filename, nil
+	}
+
+	var err error
+	if contentHash == "" {
+		if contentHash, err = hashFile(filename); err != nil {
+			return filename, err
+		}
+	}
+
+	original, err := index.add(contentHash, filename, url)
+	if err != nil || original == "" {
+		return filename, err
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return filename, err
+	}
+
+	result := filename
+	switch mode {
+	case DedupeHardlink:
+		err = replaceWithLink(filename, original, false)
+	case DedupeSymlink:
+		err = replaceWithLink(filename, original, true)
+	case DedupeSkip:
+		err = os.Remove(filename)
+		result = original
+	}
+	if err != nil {
+		return filename, err
+	}
+
+	return result, index.addDuplicate(contentHash, filename, original, info.Size(), url)
+}
+
+// replaceWithLink replaces `filename` with a hard or symbolic link to
+// `original`.  If the link can't be created, `filename` is left alone.
+func replaceWithLink(filename string, original string, symlink bool) error {
+	tmpFilename := filename + ".link"
+	_ = os.Remove(tmpFilename)
+
+	var err error
+	if symlink {
+		// Use a relative link if we can, so the output folder can be moved.
+		target, relErr := filepath.Rel(filepath.Dir(filename), original)
+		if relErr != nil {
+			target = original
+		}
+		err = os.Symlink(target, tmpFilename)
+	} else {
+		err = os.Link(original, tmpFilename)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpFilename, filename); err != nil {
+		_ = os.Remove(tmpFilename)
+		return err
+	}
+	return nil
+}
+
+// hashFile returns the hex encoded SHA-256 hash of a file.
+func hashFile(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,91 @@
+package pixdl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDedupeMode(t *testing.T) {
+	mode, err := ParseDedupeMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, DedupeOff, mode)
+
+	mode, err = ParseDedupeMode("symlink")
+	assert.NoError(t, err)
+	assert.Equal(t, DedupeSymlink, mode)
+
+	_, err = ParseDedupeMode("link")
+	assert.Error(t, err)
+}
+
+func TestDedupeFile(t *testing.T) {
+	for _, mode := range []DedupeMode{DedupeHardlink, DedupeSymlink, DedupeSkip} {
+		dir := t.TempDir()
+		original := filepath.Join(dir, "a", "original.jpg")
+		duplicate := filepath.Join(dir, "b", "duplicate.jpg")
+		assert.NoError(t, os.MkdirAll(filepath.Dir(original), 0755))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(duplicate), 0755))
+		assert.NoError(t, os.WriteFile(original, []byte("hello"), 0644))
+		assert.NoError(t, os.WriteFile(duplicate, []byte("hello"), 0644))
+
+		index, err := ReadDedupeIndex(dir)
+		assert.NoError(t, err)
+
+		result, err := dedupeFile(index, mode, original, "", "https://example.com/a.jpg")
+		assert.NoError(t, err, mode)
+		assert.Equal(t, original, result, mode)
+
+		result, err = dedupeFile(index, mode, duplicate, "", "https://example.com/b.jpg")
+		assert.NoError(t, err, mode)
+
+		originalInfo, _ := os.Stat(original)
+		switch mode {
+		case DedupeHardlink:
+			assert.Equal(t, duplicate, result)
+			info, err := os.Lstat(duplicate)
+			assert.NoError(t, err)
+			assert.True(t, os.SameFile(originalInfo, info))
+		case DedupeSymlink:
+			assert.Equal(t, duplicate, result)
+			target, err := os.Readlink(duplicate)
+			assert.NoError(t, err)
+			assert.Equal(t, filepath.Join("..", "a", "original.jpg"), target)
+		case DedupeSkip:
+			assert.Equal(t, original, result)
+			_, err := os.Stat(duplicate)
+			assert.True(t, os.IsNotExist(err))
+		}
+
+		// Index should be written to disk.
+		index, err = ReadDedupeIndex(dir)
+		assert.NoError(t, err)
+		hash, _ := hashFile(original)
+		assert.Equal(t, original, index.Lookup(hash))
+		assert.True(t, index.hasDownload("https://example.com/a.jpg", original), mode)
+		assert.False(t, index.hasDownload("https://example.com/b.jpg", original), mode)
+	}
+}
+
+func TestDedupeIndexIgnoresChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.jpg")
+	second := filepath.Join(dir, "second.jpg")
+	assert.NoError(t, os.WriteFile(first, []byte("hello"), 0644))
+
+	index, err := ReadDedupeIndex(dir)
+	assert.NoError(t, err)
+	_, err = dedupeFile(index, DedupeSkip, first, "", "")
+	assert.NoError(t, err)
+
+	// If the original has been deleted, the next copy becomes the original.
+	assert.NoError(t, os.Remove(first))
+	assert.NoError(t, os.WriteFile(second, []byte("hello"), 0644))
+	result, err := dedupeFile(index, DedupeSkip, second, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, second, result)
+	_, err = os.Stat(second)
+	assert.NoError(t, err)
+}
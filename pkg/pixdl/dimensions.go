@@ -0,0 +1,127 @@
+package pixdl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+
+	// Register decoders for image.DecodeConfig.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/jwalton/pixdl/pkg/download"
+)
+
+// sniffSizes are the number of bytes to fetch from the start of an image to
+// find its dimensions.  Most images have their dimensions in the first few
+// bytes, but JPEG files can have a large EXIF block (with an embedded
+// thumbnail) before the frame header, so if we can't find the dimensions in
+// the first chunk we try once more with a larger chunk.
+var sniffSizes = []int64{16 * 1024, 256 * 1024}
+
+// errNeedMoreData is returned from decodeDimensions if the data ends before
+// we find the image's dimensions.
+var errNeedMoreData = errors.New("need more data")
+
+// errUnknownImageFormat is returned from decodeDimensions if the data isn't
+// in a format we know how to read.
+var errUnknownImageFormat = errors.New("unknown image format")
+
+// sniffDimensions finds the width and height of a remote image by fetching
+// only the start of the file, and decoding the header.  Supports JPEG, PNG,
+// GIF, and WebP.
+func sniffDimensions(client *download.Client, req *http.Request) (width int64, height int64, err error) {
+	for _, size := range sniffSizes {
+		var data []byte
+		data, err = client.DoPartial(req, size)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		width, height, err = decodeDimensions(data)
+		if err != errNeedMoreData || int64(len(data)) < size {
+			break
+		}
+	}
+
+	if err == errNeedMoreData {
+		err = fmt.Errorf("could not find image dimensions in first %d bytes", sniffSizes[len(sniffSizes)-1])
+	}
+	return width, height, err
+}
+
+// decodeDimensions returns the width and height of an image, given the first
+// part of the image file.  Returns errNeedMoreData if `data` is too short.
+func decodeDimensions(data []byte) (width int64, height int64, err error) {
+	if len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP" {
+		return decodeWebPDimensions(data)
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return 0, 0, errNeedMoreData
+	} else if errors.Is(err, image.ErrFormat) {
+		return 0, 0, errUnknownImageFormat
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	return int64(config.Width), int64(config.Height), nil
+}
+
+// decodeWebPDimensions returns the width and height of a WebP image.  See
+// https://developers.google.com/speed/webp/docs/riff_container.
+func decodeWebPDimensions(data []byte) (width int64, height int64, err error) {
+	if len(data) < 30 {
+		return 0, 0, errNeedMoreData
+	}
+
+	switch string(data[12:16]) {
+	case "VP8 ":
+		// Lossy - a 3 byte frame tag, a 3 byte start code, and then the
+		// width and height in 14 bits each.
+		if !bytes.Equal(data[23:26], []byte{0x9d, 0x01, 0x2a}) {
+			return 0, 0, fmt.Errorf("invalid WebP VP8 header")
+		}
+		width = int64(binary.LittleEndian.Uint16(data[26:]) & 0x3fff)
+		height = int64(binary.LittleEndian.Uint16(data[28:]) & 0x3fff)
+	case "VP8L":
+		// Lossless - a signature byte, and then the width and height minus
+		// one in 14 bits each.
+		if data[20] != 0x2f {
+			return 0, 0, fmt.Errorf("invalid WebP VP8L header")
+		}
+		bits := binary.LittleEndian.Uint32(data[21:])
+		width = int64(bits&0x3fff) + 1
+		height = int64((bits>>14)&0x3fff) + 1
+	case "VP8X":
+		// Extended - the canvas width and height minus one in 24 bits each.
+		width = int64(uint32(data[24])|uint32(data[25])<<8|uint32(data[26])<<16) + 1
+		height = int64(uint32(data[27])|uint32(data[28])<<8|uint32(data[29])<<16) + 1
+	default:
+		return 0, 0, errUnknownImageFormat
+	}
+
+	return width, height, nil
+}
+
+// checkImageDimensions makes sure `image` passes the dimension limits in
+// `filter`.  If the provider didn't tell us the dimensions of the image, the
+// start of the image is fetched to find them.  If the dimensions can't be
+// found (e.g. because the image is a video) the image is let through.
+func checkImageDimensions(client *download.Client, req *http.Request, filter *imageFilter, image *ImageMetadata) error {
+	if !filter.needsDimensions(image) {
+		return nil
+	}
+
+	width, height, err := sniffDimensions(client, req)
+	if err != nil {
+		return nil
+	}
+	return filter.checkDimensions(width, height)
+}
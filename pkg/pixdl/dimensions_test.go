@@ -0,0 +1,125 @@
+package pixdl
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwalton/pixdl/pkg/download"
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeTestImage(t *testing.T, format string, width int, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	data := bytes.Buffer{}
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&data, img, nil)
+	case "png":
+		err = png.Encode(&data, img)
+	case "gif":
+		err = gif.Encode(&data, img, nil)
+	}
+	assert.NoError(t, err)
+	return data.Bytes()
+}
+
+func TestDecodeDimensions(t *testing.T) {
+	for _, format := range []string{"jpeg", "png", "gif"} {
+		width, height, err := decodeDimensions(encodeTestImage(t, format, 320, 200))
+		assert.NoError(t, err, format)
+		assert.Equal(t, int64(320), width, format)
+		assert.Equal(t, int64(200), height, format)
+	}
+
+	// Not enough data.
+	_, _, err := decodeDimensions(encodeTestImage(t, "jpeg", 320, 200)[:10])
+	assert.Equal(t, errNeedMoreData, err)
+
+	_, _, err = decodeDimensions([]byte("<html><body>Not an image</body></html>"))
+	assert.Equal(t, errUnknownImageFormat, err)
+}
+
+func TestDecodeWebPDimensions(t *testing.T) {
+	header := func(chunk string, data ...byte) []byte {
+		result := append([]byte("RIFF\x00\x00\x00\x00WEBP"+chunk+"\x00\x00\x00\x00"), data...)
+		for len(result) < 30 {
+			result = append(result, 0)
+		}
+		return result
+	}
+
+	// Lossy: frame tag, start code, 14 bit width and height.
+	width, height, err := decodeDimensions(header("VP8 ", 0, 0, 0, 0x9d, 0x01, 0x2a, 0x40, 0x01, 0xc8, 0x00))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(320), width)
+	assert.Equal(t, int64(200), height)
+
+	// Lossless: signature, then width-1 and height-1 packed in 14 bits each.
+	bits := uint32(319) | uint32(199)<<14
+	width, height, err = decodeDimensions(header("VP8L", 0x2f, byte(bits), byte(bits>>8), byte(bits>>16), byte(bits>>24)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(320), width)
+	assert.Equal(t, int64(200), height)
+
+	// Extended: flags, reserved, then 24 bit width-1 and height-1.
+	width, height, err = decodeDimensions(header("VP8X", 0, 0, 0, 0, 0x3f, 0x01, 0x00, 0xc7, 0x00, 0x00))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(320), width)
+	assert.Equal(t, int64(200), height)
+
+	_, _, err = decodeDimensions([]byte("RIFF\x00\x00\x00\x00WEBPVP8X"))
+	assert.Equal(t, errNeedMoreData, err)
+}
+
+func TestSniffDimensions(t *testing.T) {
+	data := encodeTestImage(t, "png", 64, 48)
+	// Pad the image out, so we can tell if the whole thing was downloaded.
+	data = append(data, make([]byte, 100*1024)...)
+
+	ranges := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "image.png", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/image.png", nil)
+	assert.NoError(t, err)
+
+	width, height, err := sniffDimensions(download.NewClient(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(64), width)
+	assert.Equal(t, int64(48), height)
+	assert.Equal(t, []string{"bytes=0-16383"}, ranges)
+}
+
+func TestImageFilterDimensions(t *testing.T) {
+	filter, err := newImageFilter(DownloadOptions{MinWidth: 100, MaxHeight: 1000})
+	assert.NoError(t, err)
+
+	image := &ImageMetadata{URL: "https://example.com/a.jpg", Size: -1}
+	assert.True(t, filter.needsDimensions(image))
+	assert.NoError(t, filter.check(image, nil))
+
+	image.Width = 50
+	image.Height = 50
+	assert.False(t, filter.needsDimensions(image))
+	err = filter.check(image, nil)
+	assertFiltered(t, err)
+	assert.True(t, strings.Contains(err.Error(), "width 50"))
+
+	assert.NoError(t, filter.checkDimensions(200, 500))
+	assertFiltered(t, filter.checkDimensions(200, 5000))
+
+	_, err = newImageFilter(DownloadOptions{MinHeight: 1000, MaxHeight: 100})
+	assert.Error(t, err)
+}
@@ -1,19 +1,22 @@
 package pixdl
 
 import (
-	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
-	"text/template"
+	"strings"
 	"time"
 
 	"github.com/jwalton/pixdl/pkg/download"
+	"github.com/jwalton/pixdl/pkg/pixdl/embed"
 	"github.com/jwalton/pixdl/pkg/pixdl/meta"
-	"github.com/jwalton/pixdl/pkg/providers"
 )
 
 // AlbumMetadata contains data about an album.
@@ -22,8 +25,6 @@ type AlbumMetadata = meta.AlbumMetadata
 // ImageMetadata contains data about an image inside an album.
 type ImageMetadata = meta.ImageMetadata
 
-var client = download.NewClient()
-
 // Return the file name to store the downloaded image in.
 func getDownloadFilename(image *ImageMetadata, remoteInfo *download.RemoteFileInfo) (string, error) {
 	filename := image.Filename
@@ -44,7 +45,7 @@ func getDownloadFilename(image *ImageMetadata, remoteInfo *download.RemoteFileIn
 		return filename, fmt.Errorf("could not determine name for file")
 	}
 
-	return filename, nil
+	return sanitizeFilename(filename), nil
 }
 
 // fileExists returns true if the local file already exists, false otherwise.
@@ -64,15 +65,21 @@ func fileExists(filename string) (bool, error) {
 
 // downloadImage downloads an image and saves it on disk.
 // `image` is the image to download, `toFolder` is the file to store it in.
-func downloadImage(
-	env *providers.Env,
+// If ctx is cancelled, the download will be aborted, and any partially
+// downloaded file will be left on disk so it can be resumed.  Returns false
+// if the image was skipped, or true if we tried to download it.
+func (downloader *concurrentDownloader) downloadImage(
+	ctx context.Context,
 	image *ImageMetadata,
+	rootFolder string,
 	toFolder string,
 	filenameTemplate string,
-	minSizeBytes int64,
+	filter *imageFilter,
+	manifest *Manifest,
 	reporter ProgressReporter,
-) {
+) (downloaded bool) {
 	var err error
+	env := downloader.env
 
 	if image == nil {
 		panic("pixdl.DownloadImage requires an image")
@@ -80,7 +87,18 @@ func downloadImage(
 
 	albumMetadata := image.Album
 
-	req, err := env.NewGetRequest(image.URL)
+	if ctx.Err() != nil {
+		reporter.ImageSkip(image, ctx.Err())
+		return
+	}
+
+	// If we've downloaded this image before, skip it.
+	if manifest != nil && image.Album != nil && manifest.HasImage(image.Album.URL, image.URL) {
+		reporter.ImageSkip(image, nil)
+		return
+	}
+
+	req, err := env.WithContext(ctx).NewGetRequest(image.URL)
 	if err != nil {
 		reporter.ImageSkip(image, err)
 		return
@@ -93,7 +111,20 @@ func downloadImage(
 
 	remoteInfo := image.RemoteInfo
 	if remoteInfo == nil {
-		remoteInfo, _ = client.DoFileInfo(req)
+		remoteInfo, _ = env.DownloadClient.DoFileInfo(req)
+	}
+
+	// If the provider knows the size or hash of the file, pass them along so
+	// the download can be verified.
+	if (remoteInfo.Size == -1 && image.Size != -1) || (remoteInfo.MD5 == "" && image.MD5 != "") {
+		info := *remoteInfo
+		if info.Size == -1 {
+			info.Size = image.Size
+		}
+		if info.MD5 == "" {
+			info.MD5 = image.MD5
+		}
+		remoteInfo = &info
 	}
 
 	// Figure out where to store this image
@@ -113,7 +144,13 @@ func downloadImage(
 		return
 	}
 
-	destFilename := filepath.Join(toFolder, templateFilename)
+	destFilename, err := resolvePath(toFolder, templateFilename)
+	if err != nil {
+		if reporter != nil {
+			reporter.ImageSkip(image, err)
+		}
+		return
+	}
 
 	// Make sure the destination directory exists.
 	destDir := filepath.Dir(destFilename)
@@ -125,32 +162,51 @@ func downloadImage(
 		return
 	}
 
-	// Verify image doesn't already exist before downloading
-	exists, err := fileExists(destFilename)
-	if err != nil || exists {
+	// Work out what to do if the file already exists, or if another image
+	// is being downloaded to the same file.
+	conflict, err := resolveConflict(downloader.onConflict, downloader.destinations, destFilename, image.URL, remoteInfo.Size)
+	if err == nil && conflict.existing != "" && manifest != nil && image.Album != nil &&
+		downloader.isExistingImage(rootFolder, conflict.existing, image, remoteInfo) {
+		// File was downloaded before we started keeping a manifest - add it
+		// so we don't have to look for it again.
+		err = manifest.addImage(image, conflict.existing)
+	}
+	if err != nil || conflict.existing != "" {
 		// If the already exists, or we can't check for some reason, skip it.
 		if reporter != nil {
 			reporter.ImageSkip(image, err)
 		}
 		return
 	}
+	destFilename = conflict.filename
+	defer downloader.destinations.release(destFilename)
 
-	// If the image is beneath our minimum size threshold, skip it.
-	if minSizeBytes > 0 {
-		if (remoteInfo.Size > -1 && remoteInfo.Size < minSizeBytes) ||
-			(image.Size != -1 && image.Size < minSizeBytes) {
-			reporter.ImageSkip(image, nil)
-			return
-		}
+	// If the image doesn't pass the album's filters now that we know more
+	// about it, skip it.
+	err = filter.check(image, remoteInfo)
+	if err == nil {
+		err = checkImageDimensions(env.DownloadClient, req, filter, image)
+	}
+	if err != nil {
+		reporter.ImageSkip(image, err)
+		return
 	}
 
+	downloaded = true
 	if reporter != nil {
 		reporter.ImageStart(image)
 		defer func() { reporter.ImageEnd(image, err) }()
 	}
 
 	// Get the file...
-	_, err = client.DoWithFileInfo(req, destFilename, remoteInfo, newDownloadProgressWrapper(reporter, albumMetadata, image))
+	contentHash := ""
+	progress := newDownloadProgressWrapper(reporter, albumMetadata, image)
+	_, err = env.DownloadClient.DoWithFileInfoContext(ctx, req, destFilename, remoteInfo, func(p *download.Progress) {
+		if p.Done {
+			contentHash = p.SHA256
+		}
+		progress(p)
+	})
 	if err != nil {
 		return
 	}
@@ -160,13 +216,153 @@ func downloadImage(
 	if image.Timestamp != nil {
 		_ = os.Chtimes(destFilename, time.Now(), *image.Timestamp)
 	}
+
+	// The image has been downloaded, so anything that goes wrong from here
+	// on is only a warning.
+	warn := func(message string, a ...interface{}) {
+		progress(&download.Progress{
+			URL:     image.URL,
+			File:    destFilename,
+			Total:   -1,
+			Warning: fmt.Sprintf(message, a...),
+		})
+	}
+
+	if downloader.embedMetadata {
+		// Hash the file before we change it, so duplicates are found based
+		// on what was actually downloaded.
+		if contentHash == "" && downloader.dedupe != DedupeOff && downloader.dedupe != "" {
+			contentHash, _ = hashFile(destFilename)
+		}
+
+		embedErr := embedImageMetadata(destFilename, image)
+		if errors.Is(embedErr, embed.ErrUnsupportedFormat) {
+			warn("Not embedding metadata in %s: unsupported format", destFilename)
+		} else if embedErr != nil {
+			warn("Could not embed metadata in %s: %v", destFilename, embedErr)
+		}
+	}
+
+	// If we've downloaded this file before, get rid of the duplicate.
+	downloadedFilename := destFilename
+	dedupeIndex, dedupeErr := downloader.getDedupeIndex(rootFolder)
+	if dedupeErr == nil {
+		destFilename, dedupeErr = dedupeFile(dedupeIndex, downloader.dedupe, destFilename, contentHash, image.URL)
+	}
+	if dedupeErr != nil {
+		warn("Could not deduplicate %s: %v", destFilename, dedupeErr)
+	}
+
+	if sidecarErr := downloader.sidecars.addImage(toFolder, image, destFilename, destFilename == downloadedFilename); sidecarErr != nil {
+		warn("Could not write sidecar for %s: %v", destFilename, sidecarErr)
+	}
+
+	if manifest != nil && image.Album != nil {
+		if err = manifest.addImage(image, destFilename); err != nil {
+			err = fmt.Errorf("error updating manifest: %w", err)
+			return
+		}
+	}
+	return
+}
+
+// isExistingImage returns true if `filename` is verifiably a copy of `image`,
+// because its size or MD5 hash matches `remoteInfo`, or because the dedupe
+// index says it was downloaded from the image's URL.  If we can't tell, this
+// returns false, since a different image with the same filename could have
+// been downloaded to the same file.
+func (downloader *concurrentDownloader) isExistingImage(
+	rootFolder string,
+	filename string,
+	image *ImageMetadata,
+	remoteInfo *download.RemoteFileInfo,
+) bool {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+
+	if remoteInfo.Size >= 0 {
+		if !hasSize(filename, info, remoteInfo.Size) {
+			return false
+		}
+		// If metadata was embedded, the file's MD5 won't match any more.
+		if remoteInfo.MD5 == "" || info.Size() != remoteInfo.Size {
+			return true
+		}
+	}
+
+	if remoteInfo.MD5 != "" {
+		fileMD5, err := md5File(filename)
+		return err == nil && strings.EqualFold(fileMD5, remoteInfo.MD5)
+	}
+
+	index, err := downloader.getDedupeIndex(rootFolder)
+	return err == nil && index != nil && index.hasDownload(image.URL, filename)
 }
 
+// md5File returns the hex encoded MD5 hash of a file.
+func md5File(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// getAlbumFolder returns the folder to store images from the given album in.
+func getAlbumFolder(options DownloadOptions, album *AlbumMetadata) (string, error) {
+	if options.AlbumFolderTemplate == "" {
+		return options.ToFolder, nil
+	}
+
+	folder, err := executeTemplate("album", options.AlbumFolderTemplate, getAlbumTemplateData(album))
+	if err != nil {
+		return options.ToFolder, err
+	}
+
+	if sanitizePath(folder, isWindows) == "" {
+		return options.ToFolder, nil
+	}
+	return resolvePath(options.ToFolder, folder)
+}
+
+// validateDownloadOptions makes sure the templates and filters in `options`
+// are valid.
+func validateDownloadOptions(options DownloadOptions) error {
+	err := validateTemplate(options.FilenameTemplate)
+	if err == nil {
+		err = validateAlbumFolderTemplate(options.AlbumFolderTemplate)
+	}
+	if err == nil {
+		_, err = newImageFilter(options)
+	}
+	return err
+}
+
+// validateTemplate makes sure a filename template is valid, by trying it out
+// on a sample image.
 func validateTemplate(filenameTemplate string) error {
 	if filenameTemplate == "" {
 		return nil
 	}
-	_, err := template.New("filename").Parse(filenameTemplate)
+	_, err := executeTemplate("filename", filenameTemplate, getTemplateData(sampleImage.Filename, sampleImage.Album, sampleImage))
+	return err
+}
+
+// validateAlbumFolderTemplate makes sure an album folder template is valid,
+// by trying it out on a sample album.
+func validateAlbumFolderTemplate(albumFolderTemplate string) error {
+	if albumFolderTemplate == "" {
+		return nil
+	}
+	_, err := executeTemplate("album", albumFolderTemplate, getAlbumTemplateData(sampleImage.Album))
 	return err
 }
 
@@ -180,20 +376,10 @@ func getTemplateFilename(
 		return downloadFilename, nil
 	}
 
-	template, err := template.New("filename").Parse(filenameTemplate)
-	if err != nil {
-		return downloadFilename, err
-	}
-
-	var b bytes.Buffer
-	err = template.Execute(&b, map[string]interface{}{
-		"Filename": downloadFilename,
-		"Album":    albumMetadata,
-		"Image":    imageMetadata,
-	})
+	filename, err := executeTemplate("filename", filenameTemplate, getTemplateData(downloadFilename, albumMetadata, imageMetadata))
 	if err != nil {
 		return downloadFilename, err
 	}
 
-	return b.String(), nil
+	return filename, nil
 }
@@ -0,0 +1,32 @@
+package pixdl
+
+import (
+	"os"
+
+	"github.com/jwalton/pixdl/pkg/pixdl/embed"
+)
+
+// embedImageMetadata writes metadata about where an image came from into the
+// downloaded file.  The size of the file as downloaded is recorded too, so
+// "compare-size-then-decide" can still recognize the file later.
+func embedImageMetadata(filename string, image *ImageMetadata) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	metadata := &embed.Metadata{
+		Title:        image.Title,
+		SourceURL:    image.URL,
+		PageURL:      image.SourceURL,
+		Timestamp:    image.Timestamp,
+		OriginalSize: info.Size(),
+	}
+	if image.Album != nil {
+		metadata.Author = image.Album.Author
+		metadata.Album = image.Album.Name
+		metadata.AlbumURL = image.Album.URL
+	}
+
+	return embed.File(filename, metadata)
+}
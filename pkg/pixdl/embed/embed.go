@@ -0,0 +1,122 @@
+// Package embed writes metadata about where an image came from into the
+// image file itself, so the information isn't lost if the file is shared.
+//
+// JPEG files get an XMP packet, and PNG files get tEXt/iTXt chunks.  Other
+// formats are not supported.
+package embed
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrUnsupportedFormat is returned when trying to embed metadata in a file
+// which isn't in a format we know how to write metadata to.
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+
+// Metadata is the metadata to embed in an image.  Empty fields are omitted.
+type Metadata struct {
+	// Title is the title of the image.
+	Title string
+	// Author is the author of the album or post the image came from.
+	Author string
+	// Album is the name of the album the image came from.
+	Album string
+	// AlbumURL is the URL of the album the image came from.
+	AlbumURL string
+	// SourceURL is the URL the image was downloaded from.
+	SourceURL string
+	// PageURL is the URL of the forum post or page the image was found on.
+	PageURL string
+	// Timestamp is the time the image was created.
+	Timestamp *time.Time
+	// OriginalSize is the size of the file, in bytes, before metadata was
+	// embedded in it, so the file can be matched with the original later (see
+	// ReadOriginalSize).  0 to omit.
+	OriginalSize int64
+}
+
+// maxMetadataBytes is how much of a file ReadOriginalSize will read looking
+// for metadata.  pixdl writes metadata near the start of the file, so this
+// only needs to be large enough to skip any EXIF data in front of it.
+const maxMetadataBytes = 1024 * 1024
+
+var jpegSignature = []byte{0xff, 0xd8, 0xff}
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// Bytes returns a copy of the given image data with the metadata embedded.
+// Returns ErrUnsupportedFormat if the image isn't a JPEG or PNG.
+func Bytes(data []byte, metadata *Metadata) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, jpegSignature):
+		return embedJPEG(data, metadata)
+	case bytes.HasPrefix(data, pngSignature):
+		return embedPNG(data, metadata)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+// File embeds the metadata in the given image file.  The file's modified
+// time is preserved.  Returns ErrUnsupportedFormat if the image isn't a JPEG
+// or PNG, in which case the file is left unchanged.
+func File(filename string, metadata *Metadata) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	result, err := Bytes(data, metadata)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(result, data) {
+		return nil
+	}
+
+	// Write to a temporary file and then rename it, so we never leave a
+	// half-written image behind.
+	tmpFilename := filename + ".tmp"
+	if err = os.WriteFile(tmpFilename, result, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpFilename, filename); err != nil {
+		_ = os.Remove(tmpFilename)
+		return err
+	}
+
+	return os.Chtimes(filename, time.Now(), info.ModTime())
+}
+
+// ReadOriginalSize returns the OriginalSize embedded in the given image file,
+// or -1 if the file doesn't have one (or isn't a format we can read metadata
+// from).
+func ReadOriginalSize(filename string) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return -1, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxMetadataBytes))
+	if err != nil {
+		return -1, err
+	}
+
+	switch {
+	case bytes.HasPrefix(data, jpegSignature):
+		return readJPEGOriginalSize(data), nil
+	case bytes.HasPrefix(data, pngSignature):
+		return readPNGOriginalSize(data), nil
+	default:
+		return -1, nil
+	}
+}
@@ -0,0 +1,242 @@
+package embed
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testTimestamp = time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+
+var testMetadata = &Metadata{
+	Title:     "Fish & chips",
+	Author:    "Jason",
+	Album:     "Lunch",
+	AlbumURL:  "https://example.com/albums/lunch",
+	SourceURL: "https://example.com/images/fish.jpg",
+	PageURL:   "https://example.com/posts/1",
+	Timestamp: &testTimestamp,
+}
+
+func testImage() image.Image {
+	return image.NewRGBA(image.Rect(0, 0, 4, 4))
+}
+
+func testJPEG(t *testing.T) []byte {
+	data := bytes.Buffer{}
+	err := jpeg.Encode(&data, testImage(), nil)
+	assert.NoError(t, err)
+	return data.Bytes()
+}
+
+func testPNG(t *testing.T) []byte {
+	data := bytes.Buffer{}
+	err := png.Encode(&data, testImage())
+	assert.NoError(t, err)
+	return data.Bytes()
+}
+
+// readXMP returns the XMP packet from a JPEG file.
+func readXMP(t *testing.T, data []byte) string {
+	segments, _, err := readJPEGSegments(data)
+	assert.NoError(t, err)
+
+	result := ""
+	for _, seg := range segments {
+		if seg.isXMP() {
+			assert.Equal(t, "", result, "should only have one XMP packet")
+			result = string(seg.payload()[len(xmpHeader):])
+		}
+	}
+	return result
+}
+
+// readPNGText returns the text chunks from a PNG file, and verifies every
+// chunk's CRC.
+func readPNGText(t *testing.T, data []byte) map[string]string {
+	result := map[string]string{}
+	pos := len(pngSignature)
+	for pos < len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		chunkData := data[pos+8 : pos+8+length]
+		crc := binary.BigEndian.Uint32(data[pos+8+length:])
+		assert.Equal(t, crc32.ChecksumIEEE(data[pos+4:pos+8+length]), crc, "CRC for %s chunk", chunkType)
+
+		parts := bytes.SplitN(chunkData, []byte{0}, 2)
+		switch chunkType {
+		case "tEXt":
+			value := []rune{}
+			for _, b := range parts[1] {
+				value = append(value, rune(b))
+			}
+			result[string(parts[0])] = string(value)
+		case "iTXt":
+			// Skip compression flag and method, language tag, and
+			// translated keyword.
+			rest := parts[1][2:]
+			rest = rest[bytes.IndexByte(rest, 0)+1:]
+			rest = rest[bytes.IndexByte(rest, 0)+1:]
+			result[string(parts[0])] = string(rest)
+		}
+		pos += 12 + length
+	}
+	return result
+}
+
+func TestEmbedJPEG(t *testing.T) {
+	data, err := Bytes(testJPEG(t), testMetadata)
+	assert.NoError(t, err)
+
+	// Should still be a valid JPEG.
+	_, err = jpeg.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	packet := readXMP(t, data)
+	assert.Contains(t, packet, `<dc:title><rdf:Alt><rdf:li xml:lang="x-default">Fish &amp; chips</rdf:li></rdf:Alt></dc:title>`)
+	assert.Contains(t, packet, `<dc:creator><rdf:Seq><rdf:li>Jason</rdf:li></rdf:Seq></dc:creator>`)
+	assert.Contains(t, packet, `<dc:source>https://example.com/images/fish.jpg</dc:source>`)
+	assert.Contains(t, packet, `<xmp:CreateDate>2021-03-04T05:06:07Z</xmp:CreateDate>`)
+	assert.Contains(t, packet, `<pixdl:Album>Lunch</pixdl:Album>`)
+	assert.Contains(t, packet, `<pixdl:PageURL>https://example.com/posts/1</pixdl:PageURL>`)
+
+	// XMP should go before the quantization tables.
+	segments, _, err := readJPEGSegments(data)
+	assert.NoError(t, err)
+	assert.True(t, segments[0].isXMP())
+
+	// Embedding again should leave the file unchanged.
+	again, err := Bytes(data, testMetadata)
+	assert.NoError(t, err)
+	assert.Equal(t, data, again)
+}
+
+func TestEmbedJPEGExistingXMP(t *testing.T) {
+	existing := "<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n" +
+		"<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n" +
+		" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n" +
+		"  <rdf:Description rdf:about=\"\" xmlns:dc=\"http://purl.org/dc/elements/1.1/\">\n" +
+		"   <dc:title><rdf:Alt><rdf:li xml:lang=\"x-default\">Original</rdf:li></rdf:Alt></dc:title>\n" +
+		"  </rdf:Description>\n" +
+		" </rdf:RDF>\n" +
+		"</x:xmpmeta>\n" +
+		"<?xpacket end=\"w\"?>"
+	seg, err := newXMPSegment(existing)
+	assert.NoError(t, err)
+
+	original := testJPEG(t)
+	withXMP := append([]byte{}, original[:2]...)
+	withXMP = append(withXMP, seg.data...)
+	withXMP = append(withXMP, original[2:]...)
+
+	data, err := Bytes(withXMP, testMetadata)
+	assert.NoError(t, err)
+
+	_, err = jpeg.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	packet := readXMP(t, data)
+	assert.Contains(t, packet, "Original")
+	assert.NotContains(t, packet, "Fish")
+	assert.Contains(t, packet, `<dc:creator><rdf:Seq><rdf:li>Jason</rdf:li></rdf:Seq></dc:creator>`)
+	assert.Equal(t, 1, strings.Count(packet, "</rdf:RDF>"))
+}
+
+func TestEmbedPNG(t *testing.T) {
+	metadata := *testMetadata
+	metadata.Title = "Café ☕"
+
+	data, err := Bytes(testPNG(t), &metadata)
+	assert.NoError(t, err)
+
+	// Should still be a valid PNG.
+	_, err = png.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"Title":         "Café ☕",
+		"Author":        "Jason",
+		"Creation Time": "Thu, 04 Mar 2021 05:06:07 UTC",
+		"Album":         "Lunch",
+		"Album URL":     "https://example.com/albums/lunch",
+		"Source URL":    "https://example.com/images/fish.jpg",
+		"Page URL":      "https://example.com/posts/1",
+	}, readPNGText(t, data))
+
+	// Embedding again should leave the file unchanged.
+	again, err := Bytes(data, &metadata)
+	assert.NoError(t, err)
+	assert.Equal(t, data, again)
+}
+
+func TestEmbedUnsupported(t *testing.T) {
+	_, err := Bytes([]byte("GIF89a..."), testMetadata)
+	assert.Equal(t, ErrUnsupportedFormat, err)
+}
+
+func TestEmbedFile(t *testing.T) {
+	dir := t.TempDir()
+
+	filename := filepath.Join(dir, "test.png")
+	err := os.WriteFile(filename, testPNG(t), 0644)
+	assert.NoError(t, err)
+	err = os.Chtimes(filename, testTimestamp, testTimestamp)
+	assert.NoError(t, err)
+
+	err = File(filename, testMetadata)
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "Jason", readPNGText(t, data)["Author"])
+
+	info, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.True(t, testTimestamp.Equal(info.ModTime()))
+
+	gifFilename := filepath.Join(dir, "test.gif")
+	err = os.WriteFile(gifFilename, []byte("GIF89a..."), 0644)
+	assert.NoError(t, err)
+	err = File(gifFilename, testMetadata)
+	assert.Equal(t, ErrUnsupportedFormat, err)
+}
+
+func TestReadOriginalSize(t *testing.T) {
+	dir := t.TempDir()
+
+	for name, data := range map[string][]byte{"test.jpg": testJPEG(t), "test.png": testPNG(t)} {
+		filename := filepath.Join(dir, name)
+		err := os.WriteFile(filename, data, 0644)
+		assert.NoError(t, err)
+
+		size, err := ReadOriginalSize(filename)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(-1), size, name)
+
+		metadata := *testMetadata
+		metadata.OriginalSize = int64(len(data))
+		err = File(filename, &metadata)
+		assert.NoError(t, err)
+
+		size, err = ReadOriginalSize(filename)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(data)), size, name)
+	}
+
+	gifFilename := filepath.Join(dir, "test.gif")
+	err := os.WriteFile(gifFilename, []byte("GIF89a..."), 0644)
+	assert.NoError(t, err)
+	size, err := ReadOriginalSize(gifFilename)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), size)
+}
@@ -0,0 +1,254 @@
+package embed
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	markerSOI  = 0xd8
+	markerSOS  = 0xda
+	markerAPP0 = 0xe0
+	markerAPP1 = 0xe1
+)
+
+// xmpHeader identifies an APP1 segment which holds an XMP packet.
+var xmpHeader = []byte("http://ns.adobe.com/xap/1.0/\x00")
+
+// maxSegmentLength is the largest a JPEG segment can be, including the two
+// length bytes.
+const maxSegmentLength = 0xffff
+
+const pixdlNamespace = "https://github.com/jwalton/pixdl/ns/1.0/"
+
+// jpegSegment is a single marker segment from a JPEG file.
+type jpegSegment struct {
+	marker byte
+	// data is the entire segment, including the marker and length.
+	data []byte
+}
+
+func (seg jpegSegment) payload() []byte {
+	return seg.data[4:]
+}
+
+func (seg jpegSegment) isXMP() bool {
+	return seg.marker == markerAPP1 && bytes.HasPrefix(seg.payload(), xmpHeader)
+}
+
+// embedJPEG writes an XMP packet into a JPEG file.  If the file already has
+// an XMP packet, our properties are added to it, skipping any properties the
+// packet already has.
+func embedJPEG(data []byte, metadata *Metadata) ([]byte, error) {
+	segments, rest, err := readJPEGSegments(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find any existing XMP packet, and the place to add a new one - after
+	// the JFIF and EXIF segments at the start of the file.
+	xmpIndex := -1
+	insertAt := 0
+	for index, seg := range segments {
+		if seg.isXMP() && xmpIndex == -1 {
+			xmpIndex = index
+		}
+		if insertAt == index && (seg.marker == markerAPP0 || seg.marker == markerAPP1) {
+			insertAt = index + 1
+		}
+	}
+
+	existing := ""
+	if xmpIndex != -1 {
+		existing = string(segments[xmpIndex].payload()[len(xmpHeader):])
+	}
+	packet, err := buildXMP(existing, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if packet == existing {
+		return data, nil
+	}
+
+	seg, err := newXMPSegment(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	result := bytes.Buffer{}
+	result.Grow(len(data) + len(seg.data))
+	result.Write([]byte{0xff, markerSOI})
+	for index, existingSeg := range segments {
+		if xmpIndex == -1 && index == insertAt {
+			result.Write(seg.data)
+		}
+		if index == xmpIndex {
+			result.Write(seg.data)
+		} else {
+			result.Write(existingSeg.data)
+		}
+	}
+	if xmpIndex == -1 && insertAt == len(segments) {
+		result.Write(seg.data)
+	}
+	result.Write(rest)
+
+	return result.Bytes(), nil
+}
+
+// readJPEGSegments splits a JPEG file into the marker segments that come
+// before the image data, and everything from the start of the image data on.
+func readJPEGSegments(data []byte) ([]jpegSegment, []byte, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != markerSOI {
+		return nil, nil, fmt.Errorf("not a JPEG file")
+	}
+
+	segments := []jpegSegment{}
+	pos := 2
+	for {
+		if pos+4 > len(data) || data[pos] != 0xff {
+			return nil, nil, fmt.Errorf("invalid JPEG segment at offset %d", pos)
+		}
+
+		marker := data[pos+1]
+		if marker == 0xff {
+			// Fill byte.
+			pos++
+			continue
+		}
+		if marker == markerSOS {
+			return segments, data[pos:], nil
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, nil, fmt.Errorf("invalid JPEG segment length at offset %d", pos)
+		}
+		segments = append(segments, jpegSegment{marker: marker, data: data[pos : pos+2+length]})
+		pos += 2 + length
+	}
+}
+
+// newXMPSegment creates an APP1 segment holding the given XMP packet.
+func newXMPSegment(packet string) (jpegSegment, error) {
+	length := 2 + len(xmpHeader) + len(packet)
+	if length > maxSegmentLength {
+		return jpegSegment{}, fmt.Errorf("XMP packet is too large (%d bytes)", len(packet))
+	}
+
+	data := make([]byte, 0, length+2)
+	data = append(data, 0xff, markerAPP1, byte(length>>8), byte(length))
+	data = append(data, xmpHeader...)
+	data = append(data, packet...)
+	return jpegSegment{marker: markerAPP1, data: data}, nil
+}
+
+// xmpOriginalSizeRegex matches the pixdl:OriginalSize property in an XMP
+// packet, written either as an element or as an attribute.
+var xmpOriginalSizeRegex = regexp.MustCompile(`pixdl:OriginalSize(?:>|=")(\d+)`)
+
+// readJPEGOriginalSize returns the pixdl:OriginalSize from the XMP packet in
+// a JPEG file, or -1 if there isn't one.  `data` may be just the start of
+// the file, as long as it includes every segment before the image data.
+func readJPEGOriginalSize(data []byte) int64 {
+	segments, _, err := readJPEGSegments(data)
+	if err != nil {
+		return -1
+	}
+
+	for _, seg := range segments {
+		if !seg.isXMP() {
+			continue
+		}
+		if match := xmpOriginalSizeRegex.FindSubmatch(seg.payload()); match != nil {
+			if size, err := strconv.ParseInt(string(match[1]), 10, 64); err == nil {
+				return size
+			}
+		}
+	}
+	return -1
+}
+
+// xmpProperty is a single property in an XMP packet.
+type xmpProperty struct {
+	name  string
+	value string
+}
+
+// xmpProperties returns the XMP properties for the given metadata.
+func xmpProperties(metadata *Metadata) []xmpProperty {
+	result := []xmpProperty{}
+	add := func(name string, format string, value string) {
+		if value != "" {
+			result = append(result, xmpProperty{name, fmt.Sprintf(format, xmlEscape(value))})
+		}
+	}
+
+	add("dc:title", `<rdf:Alt><rdf:li xml:lang="x-default">%s</rdf:li></rdf:Alt>`, metadata.Title)
+	add("dc:creator", `<rdf:Seq><rdf:li>%s</rdf:li></rdf:Seq>`, metadata.Author)
+	add("dc:source", "%s", metadata.SourceURL)
+	if metadata.Timestamp != nil {
+		add("xmp:CreateDate", "%s", metadata.Timestamp.Format(time.RFC3339))
+	}
+	add("pixdl:Album", "%s", metadata.Album)
+	add("pixdl:AlbumURL", "%s", metadata.AlbumURL)
+	add("pixdl:PageURL", "%s", metadata.PageURL)
+	if metadata.OriginalSize > 0 {
+		add("pixdl:OriginalSize", "%s", strconv.FormatInt(metadata.OriginalSize, 10))
+	}
+
+	return result
+}
+
+// buildXMP returns an XMP packet with the given metadata.  If `existing` is
+// not "", the metadata is added to the existing packet, skipping any
+// properties the packet already has.
+func buildXMP(existing string, metadata *Metadata) (string, error) {
+	description := strings.Builder{}
+	description.WriteString(`<rdf:Description rdf:about=""` +
+		` xmlns:dc="http://purl.org/dc/elements/1.1/"` +
+		` xmlns:xmp="http://ns.adobe.com/xap/1.0/"` +
+		` xmlns:pixdl="` + pixdlNamespace + `">` + "\n")
+
+	count := 0
+	for _, prop := range xmpProperties(metadata) {
+		if existing != "" && (strings.Contains(existing, "<"+prop.name) || strings.Contains(existing, prop.name+"=")) {
+			continue
+		}
+		fmt.Fprintf(&description, "   <%s>%s</%s>\n", prop.name, prop.value, prop.name)
+		count++
+	}
+	description.WriteString("  </rdf:Description>\n")
+
+	if count == 0 {
+		return existing, nil
+	}
+
+	if existing != "" {
+		end := strings.LastIndex(existing, "</rdf:RDF>")
+		if end == -1 {
+			return "", fmt.Errorf("could not parse existing XMP packet")
+		}
+		return existing[:end] + " " + description.String() + " " + existing[end:], nil
+	}
+
+	return "<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n" +
+		"<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n" +
+		" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n" +
+		"  " + description.String() +
+		" </rdf:RDF>\n" +
+		"</x:xmpmeta>\n" +
+		"<?xpacket end=\"w\"?>", nil
+}
+
+func xmlEscape(value string) string {
+	result := strings.Builder{}
+	_ = xml.EscapeText(&result, []byte(value))
+	return result.String()
+}
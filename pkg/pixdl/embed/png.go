@@ -0,0 +1,178 @@
+package embed
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// pngOriginalSizeKeyword is the keyword for the text chunk which holds
+// Metadata.OriginalSize.
+const pngOriginalSizeKeyword = "Original Size"
+
+// pngTextEntry is a single keyword/value pair to write to a PNG text chunk.
+type pngTextEntry struct {
+	keyword string
+	value   string
+}
+
+// pngTextEntries returns the PNG text entries for the given metadata.  Where
+// the PNG spec defines a keyword, we use it.
+func pngTextEntries(metadata *Metadata) []pngTextEntry {
+	result := []pngTextEntry{}
+	add := func(keyword string, value string) {
+		if value != "" {
+			result = append(result, pngTextEntry{keyword, value})
+		}
+	}
+
+	add("Title", metadata.Title)
+	add("Author", metadata.Author)
+	if metadata.Timestamp != nil {
+		add("Creation Time", metadata.Timestamp.UTC().Format(time.RFC1123))
+	}
+	add("Album", metadata.Album)
+	add("Album URL", metadata.AlbumURL)
+	add("Source URL", metadata.SourceURL)
+	add("Page URL", metadata.PageURL)
+	if metadata.OriginalSize > 0 {
+		add(pngOriginalSizeKeyword, strconv.FormatInt(metadata.OriginalSize, 10))
+	}
+
+	return result
+}
+
+// embedPNG writes tEXt or iTXt chunks into a PNG file, immediately after the
+// IHDR chunk.  Keywords which are already present in the file are left alone.
+func embedPNG(data []byte, metadata *Metadata) ([]byte, error) {
+	pos := len(pngSignature)
+	insertAt := -1
+	existing := map[string]bool{}
+
+	for pos < len(data) {
+		if pos+12 > len(data) {
+			return nil, fmt.Errorf("invalid PNG chunk at offset %d", pos)
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, fmt.Errorf("invalid PNG chunk length at offset %d", pos)
+		}
+
+		switch chunkType {
+		case "IHDR":
+			insertAt = end
+		case "tEXt", "zTXt", "iTXt":
+			chunkData := data[pos+8 : pos+8+length]
+			if keyword := bytes.IndexByte(chunkData, 0); keyword != -1 {
+				existing[string(chunkData[:keyword])] = true
+			}
+		}
+
+		pos = end
+		if chunkType == "IEND" {
+			break
+		}
+	}
+
+	if insertAt == -1 {
+		return nil, fmt.Errorf("PNG file has no IHDR chunk")
+	}
+
+	chunks := bytes.Buffer{}
+	for _, entry := range pngTextEntries(metadata) {
+		if !existing[entry.keyword] {
+			writePNGTextChunk(&chunks, entry)
+		}
+	}
+	if chunks.Len() == 0 {
+		return data, nil
+	}
+
+	result := bytes.Buffer{}
+	result.Grow(len(data) + chunks.Len())
+	result.Write(data[:insertAt])
+	result.Write(chunks.Bytes())
+	result.Write(data[insertAt:])
+	return result.Bytes(), nil
+}
+
+// readPNGOriginalSize returns the size from the "Original Size" tEXt chunk in
+// a PNG file, or -1 if there isn't one.  `data` may be just the start of the
+// file - we only look at chunks before the image data.
+func readPNGOriginalSize(data []byte) int64 {
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		end := pos + 12 + length
+		if length < 0 || end > len(data) || chunkType == "IDAT" {
+			break
+		}
+
+		if chunkType == "tEXt" {
+			parts := bytes.SplitN(data[pos+8:pos+8+length], []byte{0}, 2)
+			if len(parts) == 2 && string(parts[0]) == pngOriginalSizeKeyword {
+				if size, err := strconv.ParseInt(string(parts[1]), 10, 64); err == nil {
+					return size
+				}
+			}
+		}
+
+		pos = end
+	}
+	return -1
+}
+
+// writePNGTextChunk writes a text chunk for the given entry.  Values which
+// can be represented in Latin-1 are written as a tEXt chunk, and anything
+// else as an uncompressed UTF-8 iTXt chunk.
+func writePNGTextChunk(out *bytes.Buffer, entry pngTextEntry) {
+	chunkData := []byte(entry.keyword)
+	chunkData = append(chunkData, 0)
+
+	chunkType := "tEXt"
+	if latin1, ok := toLatin1(entry.value); ok {
+		chunkData = append(chunkData, latin1...)
+	} else {
+		chunkType = "iTXt"
+		// Compression flag, compression method, empty language tag, and
+		// empty translated keyword.
+		chunkData = append(chunkData, 0, 0, 0, 0)
+		chunkData = append(chunkData, entry.value...)
+	}
+
+	writePNGChunk(out, chunkType, chunkData)
+}
+
+func writePNGChunk(out *bytes.Buffer, chunkType string, chunkData []byte) {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(chunkData)))
+	copy(header[4:], chunkType)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(chunkData)
+
+	out.Write(header)
+	out.Write(chunkData)
+	_ = binary.Write(out, binary.BigEndian, crc.Sum32())
+}
+
+// toLatin1 converts a UTF-8 string to Latin-1.  Returns false if the string
+// contains characters which can't be represented in Latin-1.
+func toLatin1(value string) ([]byte, bool) {
+	result := make([]byte, 0, len(value))
+	for _, r := range value {
+		if r == utf8.RuneError || r > 0xff || r == 0 {
+			return nil, false
+		}
+		result = append(result, byte(r))
+	}
+	return result, true
+}
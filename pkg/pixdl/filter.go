@@ -0,0 +1,356 @@
+package pixdl
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jwalton/pixdl/pkg/download"
+)
+
+// FilteredError is passed to ProgressReporter.ImageSkip when an image is
+// skipped because it doesn't pass one of the filters in DownloadOptions.
+type FilteredError struct {
+	// Reason is a human readable description of why the image was skipped.
+	Reason string
+}
+
+func (err *FilteredError) Error() string {
+	return err.Reason
+}
+
+func filtered(format string, a ...interface{}) error {
+	return &FilteredError{Reason: fmt.Sprintf(format, a...)}
+}
+
+// imageFilter is the compiled form of the filters in DownloadOptions.
+// A nil imageFilter lets every image through.
+type imageFilter struct {
+	include    []*regexp.Regexp
+	exclude    []*regexp.Regexp
+	allowTypes []string
+	denyTypes  []string
+	minSize    int64
+	maxSize    int64
+	minWidth   int64
+	minHeight  int64
+	maxWidth   int64
+	maxHeight  int64
+	since      *time.Time
+	until      *time.Time
+	subAlbums  *subAlbumFilter
+}
+
+// newImageFilter compiles the filters in `options`.  Returns an error if any
+// of the filters are invalid.
+func newImageFilter(options DownloadOptions) (*imageFilter, error) {
+	var err error
+	result := &imageFilter{
+		allowTypes: normalizeTypes(options.AllowTypes),
+		denyTypes:  normalizeTypes(options.DenyTypes),
+		minSize:    options.MinSize,
+		maxSize:    options.MaxSize,
+		minWidth:   options.MinWidth,
+		minHeight:  options.MinHeight,
+		maxWidth:   options.MaxWidth,
+		maxHeight:  options.MaxHeight,
+		since:      options.Since,
+		until:      options.Until,
+	}
+
+	if result.include, err = compileRegexps("include", options.Include); err != nil {
+		return nil, err
+	}
+	if result.exclude, err = compileRegexps("exclude", options.Exclude); err != nil {
+		return nil, err
+	}
+	if result.subAlbums, err = parseSubAlbumFilter(options.FilterSubAlbum); err != nil {
+		return nil, err
+	}
+	if result.minSize < 0 || result.maxSize < 0 {
+		return nil, fmt.Errorf("minimum and maximum size must not be negative")
+	}
+	if result.maxSize > 0 && result.minSize > result.maxSize {
+		return nil, fmt.Errorf("minimum size %d is larger than maximum size %d", result.minSize, result.maxSize)
+	}
+	if result.minWidth < 0 || result.minHeight < 0 || result.maxWidth < 0 || result.maxHeight < 0 {
+		return nil, fmt.Errorf("minimum and maximum width and height must not be negative")
+	}
+	if result.maxWidth > 0 && result.minWidth > result.maxWidth {
+		return nil, fmt.Errorf("minimum width %d is larger than maximum width %d", result.minWidth, result.maxWidth)
+	}
+	if result.maxHeight > 0 && result.minHeight > result.maxHeight {
+		return nil, fmt.Errorf("minimum height %d is larger than maximum height %d", result.minHeight, result.maxHeight)
+	}
+	if result.since != nil && result.until != nil && result.since.After(*result.until) {
+		return nil, fmt.Errorf("since (%s) is after until (%s)", result.since.Format(time.RFC3339), result.until.Format(time.RFC3339))
+	}
+
+	return result, nil
+}
+
+func compileRegexps(name string, patterns []string) ([]*regexp.Regexp, error) {
+	result := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", name, pattern, err)
+		}
+		result = append(result, re)
+	}
+	return result, nil
+}
+
+// normalizeTypes lowercases a list of MIME types and extensions, and makes
+// sure every extension starts with a ".".
+func normalizeTypes(types []string) []string {
+	result := make([]string, 0, len(types))
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if !strings.Contains(t, "/") && !strings.HasPrefix(t, ".") {
+			t = "." + t
+		}
+		result = append(result, t)
+	}
+	return result
+}
+
+// check returns a FilteredError if the given image should be skipped, or nil
+// if it should be downloaded.  `remoteInfo` may be nil if we haven't asked
+// the server about the image yet.  Anything we don't know yet - the size of
+// the image, or its type - is let through, so this should be called again
+// once we know more.
+func (filter *imageFilter) check(image *ImageMetadata, remoteInfo *download.RemoteFileInfo) error {
+	if filter == nil {
+		return nil
+	}
+
+	if remoteInfo == nil {
+		remoteInfo = image.RemoteInfo
+	}
+	if remoteInfo == nil {
+		remoteInfo = &download.RemoteFileInfo{Size: -1}
+	}
+
+	if !filter.subAlbums.matches(image.SubAlbum) {
+		return filtered("sub-album %q not selected", image.SubAlbum)
+	}
+
+	if image.Timestamp != nil {
+		if filter.since != nil && image.Timestamp.Before(*filter.since) {
+			return filtered("posted %s, before %s", image.Timestamp.Format(time.RFC3339), filter.since.Format(time.RFC3339))
+		}
+		if filter.until != nil && image.Timestamp.After(*filter.until) {
+			return filtered("posted %s, after %s", image.Timestamp.Format(time.RFC3339), filter.until.Format(time.RFC3339))
+		}
+	}
+
+	filename, _ := getDownloadFilename(image, remoteInfo)
+
+	if len(filter.include) > 0 {
+		included := false
+		for _, re := range filter.include {
+			if re.MatchString(image.URL) || re.MatchString(filename) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return filtered("does not match any include pattern")
+		}
+	}
+	for _, re := range filter.exclude {
+		if re.MatchString(image.URL) || re.MatchString(filename) {
+			return filtered("matches exclude pattern %q", re.String())
+		}
+	}
+
+	if err := filter.checkType(filename, remoteInfo.MimeType); err != nil {
+		return err
+	}
+
+	size := remoteInfo.Size
+	if size == -1 {
+		size = image.Size
+	}
+	if err := checkSize(size, filter.minSize, filter.maxSize); err != nil {
+		return err
+	}
+
+	return filter.checkDimensions(image.Width, image.Height)
+}
+
+// checkDimensions returns a FilteredError if the given width or height is
+// outside the limits in the filter.  A width or height of 0 is unknown, and
+// always passes.
+func (filter *imageFilter) checkDimensions(width int64, height int64) error {
+	if filter == nil {
+		return nil
+	}
+	if width > 0 && filter.minWidth > 0 && width < filter.minWidth {
+		return filtered("width %d is smaller than minimum %d", width, filter.minWidth)
+	}
+	if width > 0 && filter.maxWidth > 0 && width > filter.maxWidth {
+		return filtered("width %d is larger than maximum %d", width, filter.maxWidth)
+	}
+	if height > 0 && filter.minHeight > 0 && height < filter.minHeight {
+		return filtered("height %d is smaller than minimum %d", height, filter.minHeight)
+	}
+	if height > 0 && filter.maxHeight > 0 && height > filter.maxHeight {
+		return filtered("height %d is larger than maximum %d", height, filter.maxHeight)
+	}
+	return nil
+}
+
+// needsDimensions returns true if the filter has a limit on the width or
+// height of images, and we don't know the image's width or height.
+func (filter *imageFilter) needsDimensions(image *ImageMetadata) bool {
+	if filter == nil {
+		return false
+	}
+	needWidth := (filter.minWidth > 0 || filter.maxWidth > 0) && image.Width <= 0
+	needHeight := (filter.minHeight > 0 || filter.maxHeight > 0) && image.Height <= 0
+	return needWidth || needHeight
+}
+
+// checkType checks the extension of `filename` and `mimeType` against the
+// allowed and denied types.
+func (filter *imageFilter) checkType(filename string, mimeType string) error {
+	if len(filter.allowTypes) == 0 && len(filter.denyTypes) == 0 {
+		return nil
+	}
+
+	ext := strings.ToLower(path.Ext(filename))
+	mimeType = strings.ToLower(mimeType)
+	if mimeType == "" && ext != "" {
+		mimeType = mime.TypeByExtension(ext)
+	}
+	if index := strings.IndexByte(mimeType, ';'); index != -1 {
+		mimeType = strings.TrimSpace(mimeType[:index])
+	}
+
+	if ext == "" && mimeType == "" {
+		// Don't know what this is yet.
+		return nil
+	}
+
+	for _, t := range filter.denyTypes {
+		if typeMatches(t, ext, mimeType) {
+			return filtered("type %s is denied", describeType(ext, mimeType))
+		}
+	}
+	if len(filter.allowTypes) > 0 {
+		for _, t := range filter.allowTypes {
+			if typeMatches(t, ext, mimeType) {
+				return nil
+			}
+		}
+		return filtered("type %s is not allowed", describeType(ext, mimeType))
+	}
+
+	return nil
+}
+
+// typeMatches returns true if `t` (an extension like ".jpg", a MIME type like
+// "image/jpeg", or a wildcard like "image/*") matches the given extension or
+// MIME type.
+func typeMatches(t string, ext string, mimeType string) bool {
+	switch {
+	case strings.HasPrefix(t, "."):
+		return t == ext
+	case strings.HasSuffix(t, "/*"):
+		return mimeType != "" && strings.HasPrefix(mimeType, t[:len(t)-1])
+	default:
+		return t == mimeType
+	}
+}
+
+func describeType(ext string, mimeType string) string {
+	if mimeType != "" {
+		return mimeType
+	}
+	return ext
+}
+
+// checkSize returns a FilteredError if `size` is smaller than `minSize` or
+// larger than `maxSize`.  0 means no limit, and an unknown size of -1 always
+// passes.
+func checkSize(size int64, minSize int64, maxSize int64) error {
+	if size < 0 {
+		return nil
+	}
+	if minSize > 0 && size < minSize {
+		return filtered("size %d is smaller than minimum %d", size, minSize)
+	}
+	if maxSize > 0 && size > maxSize {
+		return filtered("size %d is larger than maximum %d", size, maxSize)
+	}
+	return nil
+}
+
+// subAlbumFilter matches sub-albums against a list of names and numeric
+// ranges, like "22,30-45".  A nil subAlbumFilter matches everything.
+type subAlbumFilter struct {
+	names  map[string]bool
+	ranges [][2]int64
+}
+
+// parseSubAlbumFilter parses a comma separated list of sub-album names and
+// numeric ranges.  Returns nil for an empty string.
+func parseSubAlbumFilter(value string) (*subAlbumFilter, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	result := &subAlbumFilter{names: map[string]bool{}}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if dash := strings.IndexByte(part, '-'); dash > 0 {
+			start, startErr := strconv.ParseInt(strings.TrimSpace(part[:dash]), 10, 64)
+			end, endErr := strconv.ParseInt(strings.TrimSpace(part[dash+1:]), 10, 64)
+			if startErr == nil && endErr == nil {
+				if start > end {
+					return nil, fmt.Errorf("invalid sub-album range %q", part)
+				}
+				result.ranges = append(result.ranges, [2]int64{start, end})
+				continue
+			}
+		}
+
+		result.names[part] = true
+	}
+
+	if len(result.names) == 0 && len(result.ranges) == 0 {
+		return nil, nil
+	}
+	return result, nil
+}
+
+func (filter *subAlbumFilter) matches(subAlbum string) bool {
+	if filter == nil || filter.names[subAlbum] {
+		return true
+	}
+
+	if len(filter.ranges) > 0 {
+		if number, err := strconv.ParseInt(subAlbum, 10, 64); err == nil {
+			for _, r := range filter.ranges {
+				if number >= r[0] && number <= r[1] {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,141 @@
+package pixdl
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jwalton/pixdl/pkg/download"
+	"github.com/stretchr/testify/assert"
+)
+
+func filterTestImage(url string, subAlbum string, size int64) *ImageMetadata {
+	return &ImageMetadata{URL: url, SubAlbum: subAlbum, Size: size}
+}
+
+func assertFiltered(t *testing.T, err error) {
+	var filteredErr *FilteredError
+	assert.True(t, errors.As(err, &filteredErr), "expected a FilteredError, got %v", err)
+}
+
+func TestSubAlbumFilter(t *testing.T) {
+	filter, err := parseSubAlbumFilter("22, 30-45,intro")
+	assert.NoError(t, err)
+
+	assert.True(t, filter.matches("22"))
+	assert.True(t, filter.matches("30"))
+	assert.True(t, filter.matches("38"))
+	assert.True(t, filter.matches("45"))
+	assert.True(t, filter.matches("intro"))
+	assert.False(t, filter.matches("23"))
+	assert.False(t, filter.matches("46"))
+	assert.False(t, filter.matches(""))
+
+	// Non-numeric names with a "-" are names, not ranges.
+	filter, err = parseSubAlbumFilter("part-one")
+	assert.NoError(t, err)
+	assert.True(t, filter.matches("part-one"))
+
+	filter, err = parseSubAlbumFilter("")
+	assert.NoError(t, err)
+	assert.True(t, filter.matches("anything"))
+
+	_, err = parseSubAlbumFilter("45-30")
+	assert.Error(t, err)
+}
+
+func TestImageFilterRegexps(t *testing.T) {
+	filter, err := newImageFilter(DownloadOptions{
+		Include: []string{`/photos/`},
+		Exclude: []string{`(?i)thumb`},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, filter.check(filterTestImage("https://example.com/photos/a.jpg", "", -1), nil))
+	assertFiltered(t, filter.check(filterTestImage("https://example.com/videos/a.jpg", "", -1), nil))
+	assertFiltered(t, filter.check(filterTestImage("https://example.com/photos/a_THUMB.jpg", "", -1), nil))
+
+	// Patterns should match against the filename too.
+	image := filterTestImage("https://example.com/photos/12345", "", -1)
+	image.Filename = "thumbnail.jpg"
+	assertFiltered(t, filter.check(image, nil))
+
+	_, err = newImageFilter(DownloadOptions{Include: []string{"("}})
+	assert.Error(t, err)
+}
+
+func TestImageFilterTypes(t *testing.T) {
+	filter, err := newImageFilter(DownloadOptions{
+		AllowTypes: []string{"JPG", "image/png"},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, filter.check(filterTestImage("https://example.com/a.jpg", "", -1), nil))
+	assert.NoError(t, filter.check(filterTestImage("https://example.com/a.png", "", -1), nil))
+	assertFiltered(t, filter.check(filterTestImage("https://example.com/a.gif", "", -1), nil))
+
+	// Type isn't known until we ask the server.
+	image := filterTestImage("https://example.com/download?id=1", "", -1)
+	assert.NoError(t, filter.check(image, nil))
+	assertFiltered(t, filter.check(image, &download.RemoteFileInfo{Size: -1, MimeType: "image/gif"}))
+	assert.NoError(t, filter.check(image, &download.RemoteFileInfo{Size: -1, MimeType: "image/png; charset=binary"}))
+
+	filter, err = newImageFilter(DownloadOptions{
+		DenyTypes: []string{"video/*", ".gif"},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, filter.check(filterTestImage("https://example.com/a.jpg", "", -1), nil))
+	assertFiltered(t, filter.check(filterTestImage("https://example.com/a.mp4", "", -1), nil))
+	assertFiltered(t, filter.check(filterTestImage("https://example.com/a.GIF", "", -1), nil))
+}
+
+func TestImageFilterSize(t *testing.T) {
+	filter, err := newImageFilter(DownloadOptions{MinSize: 100, MaxSize: 1000})
+	assert.NoError(t, err)
+
+	assert.NoError(t, filter.check(filterTestImage("https://example.com/a.jpg", "", 500), nil))
+	assert.NoError(t, filter.check(filterTestImage("https://example.com/a.jpg", "", -1), nil))
+	assertFiltered(t, filter.check(filterTestImage("https://example.com/a.jpg", "", 50), nil))
+	assertFiltered(t, filter.check(filterTestImage("https://example.com/a.jpg", "", 5000), nil))
+	assertFiltered(t, filter.check(filterTestImage("https://example.com/a.jpg", "", -1), &download.RemoteFileInfo{Size: 5000}))
+
+	_, err = newImageFilter(DownloadOptions{MinSize: 1000, MaxSize: 100})
+	assert.Error(t, err)
+}
+
+func TestImageFilterSubAlbum(t *testing.T) {
+	filter, err := newImageFilter(DownloadOptions{FilterSubAlbum: "22,30-45"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, filter.check(filterTestImage("https://example.com/a.jpg", "31", -1), nil))
+	err = filter.check(filterTestImage("https://example.com/a.jpg", "29", -1), nil)
+	assertFiltered(t, err)
+	assert.Equal(t, `sub-album "29" not selected`, err.Error())
+
+	// A nil filter lets everything through.
+	var nilFilter *imageFilter
+	assert.NoError(t, nilFilter.check(filterTestImage("https://example.com/a.jpg", "29", 1), nil))
+}
+
+func TestImageFilterDateRange(t *testing.T) {
+	since := time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2021, 5, 31, 0, 0, 0, 0, time.UTC)
+	filter, err := newImageFilter(DownloadOptions{Since: &since, Until: &until})
+	assert.NoError(t, err)
+
+	image := filterTestImage("https://example.com/a.jpg", "", -1)
+	assert.NoError(t, filter.check(image, nil), "images without a timestamp should pass")
+
+	timestamp := time.Date(2021, 5, 15, 0, 0, 0, 0, time.UTC)
+	image.Timestamp = &timestamp
+	assert.NoError(t, filter.check(image, nil))
+
+	timestamp = time.Date(2021, 4, 30, 0, 0, 0, 0, time.UTC)
+	assertFiltered(t, filter.check(image, nil))
+
+	timestamp = time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	assertFiltered(t, filter.check(image, nil))
+
+	_, err = newImageFilter(DownloadOptions{Since: &until, Until: &since})
+	assert.Error(t, err)
+}
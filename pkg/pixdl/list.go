@@ -0,0 +1,94 @@
+package pixdl
+
+import (
+	"context"
+
+	"github.com/jwalton/pixdl/pkg/download"
+)
+
+// ListedImage is an image which would be downloaded from an album.
+type ListedImage struct {
+	// Image is the image.
+	Image *ImageMetadata
+	// Size is the size of the image in bytes, or -1 if unknown.
+	Size int64
+	// Filename is the file the image would be saved to.  This is "" if Err
+	// is set.
+	Filename string
+	// Err is set if we can't work out where the image would be saved.
+	Err error
+}
+
+// listAlbum fetches every image in an album, and calls `callback` for each
+// image that would be downloaded.  Nothing is downloaded or written to disk.
+func listAlbum(
+	ctx context.Context,
+	downloader ImageDownloader,
+	url string,
+	options DownloadOptions,
+	callback func(image *ListedImage),
+) error {
+	if err := validateDownloadOptions(options); err != nil {
+		return err
+	}
+	filter, err := newImageFilter(options)
+	if err != nil {
+		return err
+	}
+
+	startAlbum := func(album *AlbumMetadata) (string, error) {
+		return getAlbumFolder(options, album)
+	}
+
+	reporter := &albumErrorReporter{}
+	walkAlbum(ctx, downloader.getEnv(), url, options, filter, reporter, startAlbum, func(image *ImageMetadata, toFolder string, done func(downloaded bool)) {
+		callback(getListedImage(image, toFolder, options.FilenameTemplate))
+		done(true)
+	})
+
+	return reporter.err
+}
+
+// getListedImage works out where an image would be saved.  The server isn't
+// asked for the name of the file, so if the provider doesn't know the name
+// it is taken from the URL.
+func getListedImage(image *ImageMetadata, toFolder string, filenameTemplate string) *ListedImage {
+	result := &ListedImage{Image: image, Size: image.Size}
+
+	remoteInfo := image.RemoteInfo
+	if remoteInfo == nil {
+		remoteInfo = &download.RemoteFileInfo{Size: -1}
+	}
+	if result.Size == -1 {
+		result.Size = remoteInfo.Size
+	}
+
+	downloadFilename, err := getDownloadFilename(image, remoteInfo)
+	if err == nil {
+		var templateFilename string
+		templateFilename, err = getTemplateFilename(filenameTemplate, downloadFilename, image.Album, image)
+		if err == nil {
+			result.Filename, err = resolvePath(toFolder, templateFilename)
+		}
+	}
+	result.Err = err
+
+	return result
+}
+
+// albumErrorReporter is a ProgressReporter which ignores everything except
+// the error an album ends with.
+type albumErrorReporter struct {
+	err error
+}
+
+func (r *albumErrorReporter) AlbumFetch(url string)                                           {}
+func (r *albumErrorReporter) AlbumStart(album *AlbumMetadata)                                 {}
+func (r *albumErrorReporter) ImageSkip(image *ImageMetadata, err error)                       {}
+func (r *albumErrorReporter) ImageStart(image *ImageMetadata)                                 {}
+func (r *albumErrorReporter) ImageProgress(image *ImageMetadata, progress *download.Progress) {}
+func (r *albumErrorReporter) ImageEnd(image *ImageMetadata, err error)                        {}
+
+func (r *albumErrorReporter) AlbumEnd(album *AlbumMetadata, err error) {
+	r.err = err
+}
@@ -0,0 +1,34 @@
+package pixdl
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jwalton/pixdl/pkg/download"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetListedImage(t *testing.T) {
+	album := &AlbumMetadata{URL: "https://example.com/album", Name: "Album"}
+	image := &ImageMetadata{
+		Album:    album,
+		SubAlbum: "22",
+		URL:      "https://example.com/images/photo.jpg?size=large",
+		Size:     -1,
+	}
+
+	listed := getListedImage(image, "out", "{{.Image.SubAlbum}}/{{.Filename}}")
+	assert.NoError(t, listed.Err)
+	assert.Equal(t, filepath.Join("out", "22", "photo.jpg"), listed.Filename)
+	assert.Equal(t, int64(-1), listed.Size)
+
+	// Size and filename from the provider should be used, if known.
+	image.RemoteInfo = &download.RemoteFileInfo{Size: 1234, Filename: "remote.jpg"}
+	listed = getListedImage(image, "out", "")
+	assert.Equal(t, filepath.Join("out", "remote.jpg"), listed.Filename)
+	assert.Equal(t, int64(1234), listed.Size)
+
+	listed = getListedImage(image, "out", "{{.Nope}}")
+	assert.Error(t, listed.Err)
+	assert.Equal(t, "", listed.Filename)
+}
@@ -0,0 +1,400 @@
+package pixdl
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ManifestDir is the name of the folder, inside an output folder, where pixdl
+// keeps track of what has been downloaded into that folder.
+const ManifestDir = ".pixdl"
+
+const manifestFilename = "manifest.json"
+const manifestLogFilename = "manifest.jsonl"
+const manifestVersion = 1
+
+// Manifest is a record of every album and image that has been downloaded into
+// a given output folder.  This lets us skip images we've downloaded before,
+// even if the filename template has changed or the file has since been moved.
+//
+// The manifest is stored in two files in the ManifestDir of the output folder.
+// As each image is downloaded it is appended to a log, with one JSON object
+// per line, so recording an image is cheap no matter how large the manifest
+// gets.  When an album starts or finishes, the whole manifest is written out
+// and the log is cleared.
+//
+// Methods on Manifest are safe to call from multiple goroutines.
+type Manifest struct {
+	mutex sync.Mutex
+	// folder is the output folder this manifest describes.
+	folder string
+
+	// Version is the version of the manifest file format.
+	Version int `json:"version"`
+	// Albums is a map of albums that have been downloaded into this folder,
+	// indexed by album URL.
+	Albums map[string]*AlbumManifest `json:"albums"`
+}
+
+// AlbumManifest is a record of an album that was downloaded into a folder.
+type AlbumManifest struct {
+	// URL is the URL the album was downloaded from.
+	URL string `json:"url"`
+	// Provider is the name of the provider used to download the album.
+	Provider string `json:"provider"`
+	// AlbumID is the provider's unique ID for this album.
+	AlbumID string `json:"albumId"`
+	// Name is the name of the album.
+	Name string `json:"name,omitempty"`
+	// LastDownloaded is the last time we started downloading this album.
+	LastDownloaded time.Time `json:"lastDownloaded"`
+	// Options are the options that were used to download this album.
+	Options ManifestOptions `json:"options"`
+	// Images is a map of images that have been downloaded from this album,
+	// indexed by image URL.
+	Images map[string]*ManifestImage `json:"images"`
+}
+
+// ManifestOptions is the subset of DownloadOptions that is stored in the
+// manifest, so we can download the album again with the same options.
+// Params are deliberately not stored, as they may contain credentials.
+type ManifestOptions struct {
+	MaxImages        int        `json:"maxImages,omitempty"`
+	MaxPages         int        `json:"maxPages,omitempty"`
+	FilenameTemplate string     `json:"filenameTemplate,omitempty"`
+	FilterSubAlbum   string     `json:"filterSubAlbum,omitempty"`
+	Include          []string   `json:"include,omitempty"`
+	Exclude          []string   `json:"exclude,omitempty"`
+	AllowTypes       []string   `json:"allowTypes,omitempty"`
+	DenyTypes        []string   `json:"denyTypes,omitempty"`
+	MinSize          int64      `json:"minSize,omitempty"`
+	MaxSize          int64      `json:"maxSize,omitempty"`
+	MinWidth         int64      `json:"minWidth,omitempty"`
+	MinHeight        int64      `json:"minHeight,omitempty"`
+	MaxWidth         int64      `json:"maxWidth,omitempty"`
+	MaxHeight        int64      `json:"maxHeight,omitempty"`
+	Since            *time.Time `json:"since,omitempty"`
+	Until            *time.Time `json:"until,omitempty"`
+}
+
+// DownloadOptions returns the DownloadOptions needed to download this album
+// into the given folder again.
+func (album *AlbumManifest) DownloadOptions(folder string) DownloadOptions {
+	return DownloadOptions{
+		ToFolder:         folder,
+		MaxImages:        album.Options.MaxImages,
+		MaxPages:         album.Options.MaxPages,
+		FilenameTemplate: album.Options.FilenameTemplate,
+		FilterSubAlbum:   album.Options.FilterSubAlbum,
+		Include:          album.Options.Include,
+		Exclude:          album.Options.Exclude,
+		AllowTypes:       album.Options.AllowTypes,
+		DenyTypes:        album.Options.DenyTypes,
+		MinSize:          album.Options.MinSize,
+		MaxSize:          album.Options.MaxSize,
+		MinWidth:         album.Options.MinWidth,
+		MinHeight:        album.Options.MinHeight,
+		MaxWidth:         album.Options.MaxWidth,
+		MaxHeight:        album.Options.MaxHeight,
+		Since:            album.Options.Since,
+		Until:            album.Options.Until,
+	}
+}
+
+// ManifestImage is a record of a single image that was downloaded.
+type ManifestImage struct {
+	// URL is the URL the image was downloaded from.
+	URL string `json:"url"`
+	// Index is the index of this image within the album.
+	Index int `json:"index"`
+	// SubAlbum is the sub-album this image came from.
+	SubAlbum string `json:"subAlbum,omitempty"`
+	// Page is the page number this image was on.
+	Page int `json:"page,omitempty"`
+	// Size is the size of the downloaded file, in bytes.
+	Size int64 `json:"size"`
+	// Path is the path the file was written to, relative to the output folder,
+	// using "/" as a separator.
+	Path string `json:"path"`
+	// Completed is the time the download finished.
+	Completed time.Time `json:"completed"`
+}
+
+// manifestLogEntry is a single line in the manifest log.
+type manifestLogEntry struct {
+	// Album is the URL of the album the image belongs to.
+	Album string         `json:"album"`
+	Image *ManifestImage `json:"image"`
+}
+
+// ManifestPath returns the path to the manifest file for the given output folder.
+func ManifestPath(folder string) string {
+	return filepath.Join(folder, ManifestDir, manifestFilename)
+}
+
+func manifestLogPath(folder string) string {
+	return filepath.Join(folder, ManifestDir, manifestLogFilename)
+}
+
+// ReadManifest reads the manifest for the given output folder.  If there is
+// no manifest in the folder, this returns a new, empty manifest.
+func ReadManifest(folder string) (*Manifest, error) {
+	manifest := &Manifest{
+		folder:  folder,
+		Version: manifestVersion,
+		Albums:  map[string]*AlbumManifest{},
+	}
+
+	data, err := os.ReadFile(ManifestPath(folder))
+	if err == nil {
+		if err = json.Unmarshal(data, manifest); err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", ManifestPath(folder), err)
+		}
+		if manifest.Albums == nil {
+			manifest.Albums = map[string]*AlbumManifest{}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if err = manifest.readLog(); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// readLog adds every image in the manifest log to the manifest.
+func (manifest *Manifest) readLog() error {
+	filename := manifestLogPath(manifest.folder)
+	file, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := &manifestLogEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil || entry.Image == nil {
+			// Probably a half-written line from a crash - skip it.
+			continue
+		}
+		manifest.getAlbum(&AlbumMetadata{URL: entry.Album}).Images[entry.Image.URL] = entry.Image
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("error reading %s: %w", filename, err)
+	}
+
+	return nil
+}
+
+// FindManifests searches the given folder and all of its subfolders for
+// manifests, and returns every manifest found.
+func FindManifests(root string) ([]*Manifest, error) {
+	result := []*Manifest{}
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() || entry.Name() != ManifestDir {
+			return nil
+		}
+
+		folder := filepath.Dir(path)
+		if _, err := os.Stat(ManifestPath(folder)); err == nil {
+			manifest, err := ReadManifest(folder)
+			if err != nil {
+				return err
+			}
+			result = append(result, manifest)
+		}
+
+		// No need to look inside the manifest folder.
+		return filepath.SkipDir
+	})
+
+	return result, err
+}
+
+// Folder returns the output folder this manifest describes.
+func (manifest *Manifest) Folder() string {
+	return manifest.folder
+}
+
+// Save writes the whole manifest to disk, and clears the log of images
+// recorded since the last save.
+func (manifest *Manifest) Save() error {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	return manifest.save()
+}
+
+func (manifest *Manifest) save() error {
+	filename := ManifestPath(manifest.folder)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and then rename it, so we never leave a
+	// half-written manifest behind.
+	tmpFilename := filename + ".tmp"
+	if err = os.WriteFile(tmpFilename, data, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpFilename, filename); err != nil {
+		return err
+	}
+
+	// Everything in the log is in the manifest now.
+	err = os.Remove(manifestLogPath(manifest.folder))
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	return err
+}
+
+// appendLog writes an image to the end of the manifest log.  Caller must hold
+// the mutex.
+func (manifest *Manifest) appendLog(albumURL string, image *ManifestImage) error {
+	filename := manifestLogPath(manifest.folder)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&manifestLogEntry{Album: albumURL, Image: image})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// GetImage returns the record for a previously downloaded image, or nil if
+// the image has not been downloaded into this folder.
+func (manifest *Manifest) GetImage(albumURL string, imageURL string) *ManifestImage {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	album := manifest.Albums[albumURL]
+	if album == nil {
+		return nil
+	}
+	return album.Images[imageURL]
+}
+
+// HasImage returns true if the given image has already been downloaded into
+// this folder.
+func (manifest *Manifest) HasImage(albumURL string, imageURL string) bool {
+	return manifest.GetImage(albumURL, imageURL) != nil
+}
+
+// getAlbum returns the record for the given album, creating one if it
+// does not exist.  Caller must hold the mutex.
+func (manifest *Manifest) getAlbum(album *AlbumMetadata) *AlbumManifest {
+	result := manifest.Albums[album.URL]
+	if result == nil {
+		result = &AlbumManifest{
+			URL:    album.URL,
+			Images: map[string]*ManifestImage{},
+		}
+		manifest.Albums[album.URL] = result
+	} else if result.Images == nil {
+		result.Images = map[string]*ManifestImage{}
+	}
+
+	if album.Provider != "" {
+		result.Provider = album.Provider
+	}
+	if album.AlbumID != "" {
+		result.AlbumID = album.AlbumID
+	}
+	if album.Name != "" {
+		result.Name = album.Name
+	}
+
+	return result
+}
+
+// startAlbum records that we've started downloading the given album with the
+// given options, and saves the manifest.
+func (manifest *Manifest) startAlbum(album *AlbumMetadata, options DownloadOptions) error {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	record := manifest.getAlbum(album)
+	record.LastDownloaded = time.Now()
+	record.Options = ManifestOptions{
+		MaxImages:        options.MaxImages,
+		MaxPages:         options.MaxPages,
+		FilenameTemplate: options.FilenameTemplate,
+		FilterSubAlbum:   options.FilterSubAlbum,
+		Include:          options.Include,
+		Exclude:          options.Exclude,
+		AllowTypes:       options.AllowTypes,
+		DenyTypes:        options.DenyTypes,
+		MinSize:          options.MinSize,
+		MaxSize:          options.MaxSize,
+		MinWidth:         options.MinWidth,
+		MinHeight:        options.MinHeight,
+		MaxWidth:         options.MaxWidth,
+		MaxHeight:        options.MaxHeight,
+		Since:            options.Since,
+		Until:            options.Until,
+	}
+	return manifest.save()
+}
+
+// addImage records that the given image has been written to `filename`,
+// and appends it to the manifest log.
+func (manifest *Manifest) addImage(image *ImageMetadata, filename string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	path, err := filepath.Rel(manifest.folder, filename)
+	if err != nil {
+		return err
+	}
+
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	record := &ManifestImage{
+		URL:       image.URL,
+		Index:     image.Index,
+		SubAlbum:  image.SubAlbum,
+		Page:      image.Page,
+		Size:      info.Size(),
+		Path:      filepath.ToSlash(path),
+		Completed: time.Now(),
+	}
+	manifest.getAlbum(image.Album).Images[image.URL] = record
+
+	return manifest.appendLog(image.Album.URL, record)
+}
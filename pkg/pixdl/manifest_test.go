@@ -0,0 +1,110 @@
+package pixdl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jwalton/pixdl/pkg/pixdl/meta"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifest(t *testing.T) {
+	folder := t.TempDir()
+
+	manifest, err := ReadManifest(folder)
+	assert.Nil(t, err)
+	assert.False(t, manifest.HasImage("https://example.com/album", "https://example.com/1.jpg"))
+
+	album := &AlbumMetadata{
+		URL:      "https://example.com/album",
+		Provider: "web",
+		AlbumID:  "album",
+	}
+	image := meta.NewImageMetadata(album, 3)
+	image.URL = "https://example.com/1.jpg"
+	image.SubAlbum = "22"
+
+	filename := filepath.Join(folder, "sub", "1.jpg")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(filename), 0755))
+	assert.Nil(t, os.WriteFile(filename, []byte("hello"), 0644))
+
+	assert.Nil(t, manifest.startAlbum(album, DownloadOptions{FilenameTemplate: "{{.Filename}}"}))
+	assert.Nil(t, manifest.addImage(image, filename))
+
+	// Read the manifest back from disk.
+	manifest, err = ReadManifest(folder)
+	assert.Nil(t, err)
+	assert.True(t, manifest.HasImage("https://example.com/album", "https://example.com/1.jpg"))
+	assert.False(t, manifest.HasImage("https://example.com/other", "https://example.com/1.jpg"))
+
+	albumRecord := manifest.Albums["https://example.com/album"]
+	assert.Equal(t, "web", albumRecord.Provider)
+	assert.Equal(t, "album", albumRecord.AlbumID)
+	assert.Equal(t, "{{.Filename}}", albumRecord.DownloadOptions(folder).FilenameTemplate)
+
+	imageRecord := manifest.GetImage("https://example.com/album", "https://example.com/1.jpg")
+	assert.Equal(t, "sub/1.jpg", imageRecord.Path)
+	assert.Equal(t, int64(5), imageRecord.Size)
+	assert.Equal(t, 3, imageRecord.Index)
+	assert.Equal(t, "22", imageRecord.SubAlbum)
+}
+
+func TestFindManifests(t *testing.T) {
+	root := t.TempDir()
+
+	album := &AlbumMetadata{URL: "https://example.com/album"}
+	for _, folder := range []string{"a", filepath.Join("b", "c")} {
+		manifest, err := ReadManifest(filepath.Join(root, folder))
+		assert.Nil(t, err)
+		assert.Nil(t, manifest.startAlbum(album, DownloadOptions{}))
+	}
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "d"), 0755))
+
+	manifests, err := FindManifests(root)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(manifests))
+	assert.Equal(t, filepath.Join(root, "a"), manifests[0].Folder())
+	assert.Equal(t, filepath.Join(root, "b", "c"), manifests[1].Folder())
+}
+
+func TestManifestLog(t *testing.T) {
+	folder := t.TempDir()
+	album := &AlbumMetadata{URL: "https://example.com/album"}
+
+	manifest, err := ReadManifest(folder)
+	assert.Nil(t, err)
+	assert.Nil(t, manifest.startAlbum(album, DownloadOptions{}))
+
+	for _, name := range []string{"1.jpg", "2.jpg"} {
+		image := meta.NewImageMetadata(album, 0)
+		image.URL = "https://example.com/" + name
+		filename := filepath.Join(folder, name)
+		assert.Nil(t, os.WriteFile(filename, []byte("hello"), 0644))
+		assert.Nil(t, manifest.addImage(image, filename))
+	}
+
+	// Images should only have been appended to the log.
+	snapshot, err := os.ReadFile(ManifestPath(folder))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(snapshot), "1.jpg")
+
+	// Simulate a crash part way through writing a line.
+	logFile, err := os.OpenFile(manifestLogPath(folder), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, _ = logFile.Write([]byte(`{"album":"https://example.com/album","ima`))
+	assert.Nil(t, logFile.Close())
+
+	manifest, err = ReadManifest(folder)
+	assert.Nil(t, err)
+	assert.True(t, manifest.HasImage(album.URL, "https://example.com/1.jpg"))
+	assert.True(t, manifest.HasImage(album.URL, "https://example.com/2.jpg"))
+
+	// Saving should fold the log into the manifest.
+	assert.Nil(t, manifest.Save())
+	_, err = os.Stat(manifestLogPath(folder))
+	assert.True(t, os.IsNotExist(err))
+	manifest, err = ReadManifest(folder)
+	assert.Nil(t, err)
+	assert.True(t, manifest.HasImage(album.URL, "https://example.com/2.jpg"))
+}
@@ -33,12 +33,22 @@ type ImageMetadata struct {
 	Title string
 	// Size is the length of the image in bytes, or -1 if unknown.
 	Size int64
+	// Width is the width of the image in pixels, or 0 if unknown.  This is
+	// the size of the image itself, not the size a page displays it at.
+	Width int64
+	// Height is the height of the image in pixels, or 0 if unknown.
+	Height int64
+	// MD5 is the hex-encoded MD5 hash of the image, or "" if unknown.
+	MD5 string
 	// Timestamp is the creation time of this image, or nil if unknown.
 	Timestamp *time.Time
 	// Index of this image within the album
 	Index int
 	// Page is the page number (1 based) this image was on.
 	Page int
+	// SourceURL is the URL of the forum post or page this image was found on,
+	// if it's more specific than the album's URL.
+	SourceURL string
 	// RemoteInfo is information about this file, obtained from DownloadClient.GetFileInfo().
 	// This is optional - you only need to provide it when creating an image if
 	// you already have it, so download doesn't need to get it again.
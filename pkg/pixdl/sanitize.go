@@ -0,0 +1,140 @@
+package pixdl
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxComponentLength is the maximum length, in bytes, of a single file or
+// folder name.  Most filesystems allow 255 bytes - we leave some room for
+// suffixes like ".part.meta" which get added while downloading.
+const maxComponentLength = 200
+
+// maxExtensionLength is the longest extension we'll try to preserve when
+// truncating a long filename.
+const maxExtensionLength = 16
+
+// isWindows is true if we need to follow Windows' rules for filenames.
+var isWindows = runtime.GOOS == "windows"
+
+// isDarwin is true if we're running on macOS.
+var isDarwin = runtime.GOOS == "darwin"
+
+// windowsReservedNames are names which can't be used for a file on Windows,
+// with or without an extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeFilename makes a string safe to use as a single file or folder
+// name.  Path separators, control characters, and any characters that aren't
+// allowed in filenames on this platform are replaced with "_", and long names
+// are truncated.
+func sanitizeFilename(name string) string {
+	return sanitizeComponent(name, isWindows)
+}
+
+func sanitizeComponent(name string, windows bool) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == '/' || r < 0x20 || r == 0x7f || r == utf8.RuneError:
+			b.WriteRune('_')
+		case windows && strings.ContainsRune(`\<>:"|?*`, r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	result := strings.TrimSpace(b.String())
+	if windows {
+		// Windows quietly drops trailing dots and spaces.
+		result = strings.TrimRight(result, ". ")
+	}
+
+	if result == "" || result == "." || result == ".." {
+		return "_"
+	}
+
+	if windows {
+		stem := strings.ToUpper(strings.SplitN(result, ".", 2)[0])
+		if windowsReservedNames[strings.TrimSpace(stem)] {
+			result = "_" + result
+		}
+	}
+
+	return truncateFilename(result, maxComponentLength)
+}
+
+// truncateFilename shortens a filename to at most `maxBytes` bytes, keeping
+// the extension if possible.
+func truncateFilename(name string, maxBytes int) string {
+	if len(name) <= maxBytes {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) > maxExtensionLength || len(ext) >= maxBytes {
+		ext = ""
+	}
+	return truncateBytes(name[:len(name)-len(ext)], maxBytes-len(ext)) + ext
+}
+
+// truncateBytes shortens a string to at most `maxBytes` bytes, without
+// splitting a UTF-8 character in half.
+func truncateBytes(str string, maxBytes int) string {
+	if len(str) <= maxBytes {
+		return str
+	}
+	for maxBytes > 0 && !utf8.RuneStart(str[maxBytes]) {
+		maxBytes--
+	}
+	return str[:maxBytes]
+}
+
+// sanitizePath makes a relative path, such as the output of a filename
+// template, safe to use.  The path is split on "/" (and on "\" on Windows),
+// and each component is sanitized.  Empty and "." components are removed,
+// and ".." components are replaced, so the result can never refer to
+// something outside the folder it is relative to.
+func sanitizePath(path string, windows bool) string {
+	parts := strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || (windows && r == '\\')
+	})
+
+	result := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if strings.TrimSpace(part) == "." {
+			continue
+		}
+		result = append(result, sanitizeComponent(part, windows))
+	}
+
+	return filepath.Join(result...)
+}
+
+// resolvePath sanitizes the relative path `path`, and joins it to `folder`.
+// Returns an error if the result would be outside of `folder`.
+func resolvePath(folder string, path string) (string, error) {
+	relPath := sanitizePath(path, isWindows)
+	if relPath == "" {
+		return "", fmt.Errorf("empty filename")
+	}
+
+	result := filepath.Join(folder, relPath)
+
+	rel, err := filepath.Rel(folder, result)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("refusing to write %s outside of %s", path, folder)
+	}
+
+	return result, nil
+}
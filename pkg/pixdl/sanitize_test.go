@@ -0,0 +1,65 @@
+package pixdl
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeComponent(t *testing.T) {
+	assert.Equal(t, "foo.jpg", sanitizeComponent("foo.jpg", false))
+	assert.Equal(t, "a_b.jpg", sanitizeComponent("a/b.jpg", false))
+	assert.Equal(t, "a_b.jpg", sanitizeComponent("a\x00b.jpg", false))
+	assert.Equal(t, "_", sanitizeComponent("..", false))
+	assert.Equal(t, "_", sanitizeComponent("", false))
+	assert.Equal(t, `a\b:c.jpg`, sanitizeComponent(`a\b:c.jpg`, false))
+
+	assert.Equal(t, "a_b_c.jpg", sanitizeComponent(`a\b:c.jpg`, true))
+	assert.Equal(t, "what_", sanitizeComponent("what?. ", true))
+	assert.Equal(t, "_CON", sanitizeComponent("CON", true))
+	assert.Equal(t, "_nul.txt", sanitizeComponent("nul.txt", true))
+	assert.Equal(t, "console.txt", sanitizeComponent("console.txt", true))
+
+	long := sanitizeComponent(strings.Repeat("é", 300)+".jpg", false)
+	assert.True(t, len(long) <= maxComponentLength)
+	assert.True(t, strings.HasSuffix(long, "é.jpg"))
+}
+
+func TestSanitizePath(t *testing.T) {
+	assert.Equal(t, filepath.Join("a", "b", "c.jpg"), sanitizePath("a/b/c.jpg", false))
+	assert.Equal(t, filepath.Join("_", "_", "etc", "passwd"), sanitizePath("../../etc/passwd", false))
+	assert.Equal(t, filepath.Join("etc", "passwd"), sanitizePath("/etc/passwd", false))
+	assert.Equal(t, filepath.Join("a", "b.jpg"), sanitizePath("./a//b.jpg", false))
+	assert.Equal(t, filepath.Join("_", "x.jpg"), sanitizePath(`..\x.jpg`, true))
+	assert.Equal(t, filepath.Join("C_", "x.jpg"), sanitizePath(`C:\x.jpg`, true))
+}
+
+func TestResolvePath(t *testing.T) {
+	folder := filepath.Join("out", "album")
+
+	result, err := resolvePath(folder, "../../../etc/passwd")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(folder, "_", "_", "_", "etc", "passwd"), result)
+
+	_, err = resolvePath(folder, "/./")
+	assert.NotNil(t, err)
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	album := &AlbumMetadata{Name: "My Trip / Part 2 - Électrique"}
+	image := &ImageMetadata{}
+
+	filename, err := getTemplateFilename(`{{safe .Album.Name}}/{{.Filename}}`, "a.jpg", album, image)
+	assert.Nil(t, err)
+	assert.Equal(t, "My Trip _ Part 2 - Électrique/a.jpg", filename)
+
+	filename, err = getTemplateFilename(`{{slug .Album.Name}}/{{.Filename}}`, "a.jpg", album, image)
+	assert.Nil(t, err)
+	assert.Equal(t, "my-trip-part-2-électrique/a.jpg", filename)
+
+	filename, err = getTemplateFilename(`{{.Album.Name | truncate 7}}-{{.Filename}}`, "a.jpg", album, image)
+	assert.Nil(t, err)
+	assert.Equal(t, "My Trip-a.jpg", filename)
+}
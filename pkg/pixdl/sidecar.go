@@ -0,0 +1,404 @@
+package pixdl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SidecarMode controls which metadata "sidecar" files are written alongside
+// downloaded images.
+type SidecarMode string
+
+const (
+	// SidecarsNone doesn't write any sidecar files.  This is the default.
+	SidecarsNone SidecarMode = "none"
+	// SidecarsAlbum writes an "album.json" file into the folder for each
+	// album, describing the album and every image downloaded from it.
+	SidecarsAlbum SidecarMode = "album"
+	// SidecarsAll writes "album.json", and also writes a "<file>.json" next
+	// to each downloaded image, describing that image.
+	SidecarsAll SidecarMode = "all"
+)
+
+// sidecarModes is every valid SidecarMode.
+var sidecarModes = []SidecarMode{SidecarsNone, SidecarsAlbum, SidecarsAll}
+
+// AlbumSidecarFilename is the name of the album sidecar file written into
+// each album's folder.  If several albums are downloaded into the same folder,
+// the others are named "album-<hash>.json", where "<hash>" is derived from the
+// album's URL.
+const AlbumSidecarFilename = "album.json"
+
+// ImageSidecarSuffix is added to the name of a downloaded image to get the
+// name of its sidecar file.
+const ImageSidecarSuffix = ".json"
+
+// sidecarFlushImages is the number of images which can be added to an album
+// sidecar before it is written out.  Album sidecars are otherwise only
+// written when the album starts and ends.
+const sidecarFlushImages = 100
+
+// ParseSidecarMode converts a string into a SidecarMode.  An empty string is
+// treated as SidecarsNone.
+func ParseSidecarMode(value string) (SidecarMode, error) {
+	if value == "" {
+		return SidecarsNone, nil
+	}
+
+	names := make([]string, 0, len(sidecarModes))
+	for _, mode := range sidecarModes {
+		if string(mode) == value {
+			return mode, nil
+		}
+		names = append(names, string(mode))
+	}
+
+	return SidecarsNone, fmt.Errorf("unknown sidecar mode %q (expected one of %s)", value, strings.Join(names, ", "))
+}
+
+// AlbumSidecar is the contents of an album sidecar file.
+type AlbumSidecar struct {
+	// Album describes the album.
+	Album SidecarAlbum `json:"album"`
+	// Images is every image downloaded from the album, sorted by index.
+	Images []*SidecarImage `json:"images"`
+}
+
+// ImageSidecar is the contents of an image sidecar file.
+type ImageSidecar struct {
+	// Album describes the album the image came from.
+	Album SidecarAlbum `json:"album"`
+	// Image describes the image.
+	Image *SidecarImage `json:"image"`
+}
+
+// SidecarAlbum describes an album in a sidecar file.
+type SidecarAlbum struct {
+	URL             string    `json:"url"`
+	AlbumID         string    `json:"albumId,omitempty"`
+	Name            string    `json:"name,omitempty"`
+	Author          string    `json:"author,omitempty"`
+	Provider        string    `json:"provider,omitempty"`
+	TotalImageCount int       `json:"totalImageCount"`
+	Updated         time.Time `json:"updated"`
+}
+
+// SidecarImage describes a downloaded image in a sidecar file.
+type SidecarImage struct {
+	// URL is the URL the image was downloaded from.
+	URL string `json:"url"`
+	// SourceURL is the URL of the forum post or page the image was found on.
+	// If the provider doesn't know, this is the URL of the album.
+	SourceURL string `json:"sourceUrl"`
+	// File is the path of the downloaded file, relative to the folder the
+	// sidecar file is in, using "/" as a separator.
+	File string `json:"file"`
+	// Filename is the name of the image, as reported by the provider.
+	Filename string `json:"filename,omitempty"`
+	// Title is the title of the image.
+	Title string `json:"title,omitempty"`
+	// SubAlbum is the sub-album the image came from.  For forums, this is
+	// the post number.
+	SubAlbum  string     `json:"subAlbum,omitempty"`
+	Index     int        `json:"index"`
+	Page      int        `json:"page"`
+	Size      int64      `json:"size"`
+	MD5       string     `json:"md5,omitempty"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	// Downloaded is the time the download finished.
+	Downloaded time.Time `json:"downloaded"`
+}
+
+func newSidecarAlbum(album *AlbumMetadata) SidecarAlbum {
+	return SidecarAlbum{
+		URL:             album.URL,
+		AlbumID:         album.AlbumID,
+		Name:            album.Name,
+		Author:          album.Author,
+		Provider:        album.Provider,
+		TotalImageCount: album.TotalImageCount,
+		Updated:         time.Now(),
+	}
+}
+
+// newSidecarImage describes an image which was downloaded to `filename`.
+// `folder` is the folder the sidecar will be written to.
+func newSidecarImage(image *ImageMetadata, folder string, filename string) (*SidecarImage, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	relPath, err := filepath.Rel(folder, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceURL := image.SourceURL
+	if sourceURL == "" && image.Album != nil {
+		sourceURL = image.Album.URL
+	}
+
+	return &SidecarImage{
+		URL:        image.URL,
+		SourceURL:  sourceURL,
+		File:       filepath.ToSlash(relPath),
+		Filename:   image.Filename,
+		Title:      image.Title,
+		SubAlbum:   image.SubAlbum,
+		Index:      image.Index,
+		Page:       image.Page,
+		Size:       info.Size(),
+		MD5:        image.MD5,
+		Timestamp:  image.Timestamp,
+		Downloaded: time.Now(),
+	}, nil
+}
+
+// sidecarWriter writes sidecar files.  Image sidecars are written as soon as
+// the image is downloaded, but changes to album sidecars are saved up and
+// written when the album ends, or every sidecarFlushImages images.
+//
+// Methods on sidecarWriter are safe to call from multiple goroutines.
+type sidecarWriter struct {
+	mutex sync.Mutex
+	mode  SidecarMode
+	// albums is a map of album sidecars, indexed by folder and album URL.
+	albums map[string]*albumSidecarFile
+	// claimed is the set of album sidecar files in use by an album.
+	claimed map[string]bool
+}
+
+// albumSidecarFile is an album sidecar, and the file it is stored in.
+type albumSidecarFile struct {
+	filename string
+	sidecar  *AlbumSidecar
+	// images is a map of every image in the sidecar, indexed by URL.
+	images map[string]*SidecarImage
+	// pending is the number of images added since the sidecar was saved.
+	pending int
+}
+
+func newSidecarWriter(mode SidecarMode) *sidecarWriter {
+	return &sidecarWriter{
+		mode:    mode,
+		albums:  map[string]*albumSidecarFile{},
+		claimed: map[string]bool{},
+	}
+}
+
+func (writer *sidecarWriter) enabled() bool {
+	return writer.mode == SidecarsAlbum || writer.mode == SidecarsAll
+}
+
+// startAlbum writes the album sidecar for an album that's about to be
+// downloaded into `folder`.  Any images recorded in an existing sidecar from
+// an earlier download are kept.
+func (writer *sidecarWriter) startAlbum(folder string, album *AlbumMetadata) error {
+	if !writer.enabled() || album == nil {
+		return nil
+	}
+
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	file, err := writer.getAlbum(folder, album)
+	if err != nil {
+		return err
+	}
+	file.sidecar.Album = newSidecarAlbum(album)
+	return file.save()
+}
+
+// addImage records that `image` has been downloaded to `filename`, in the
+// album sidecar for `folder` and, if enabled, in an image sidecar.  Pass false
+// for `imageSidecar` to skip the image sidecar (e.g. if `filename` is a file
+// that was downloaded earlier, which already has one).  The album sidecar
+// isn't written until endAlbum is called, or enough images have been added.
+func (writer *sidecarWriter) addImage(folder string, image *ImageMetadata, filename string, imageSidecar bool) error {
+	if !writer.enabled() || image.Album == nil {
+		return nil
+	}
+
+	folder, err := filepath.Abs(folder)
+	if err != nil {
+		return err
+	}
+	filename, err = filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+
+	if writer.mode == SidecarsAll && imageSidecar {
+		entry, err := newSidecarImage(image, filepath.Dir(filename), filename)
+		if err != nil {
+			return err
+		}
+		err = writeJSONFile(filename+ImageSidecarSuffix, &ImageSidecar{
+			Album: newSidecarAlbum(image.Album),
+			Image: entry,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	entry, err := newSidecarImage(image, folder, filename)
+	if err != nil {
+		return err
+	}
+
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	file, err := writer.getAlbum(folder, image.Album)
+	if err != nil {
+		return err
+	}
+
+	file.images[entry.URL] = entry
+	file.pending++
+	if file.pending >= sidecarFlushImages {
+		return file.save()
+	}
+	return nil
+}
+
+// endAlbum writes the album sidecar for `album` in `folder`, if any images
+// have been added since it was last written.
+func (writer *sidecarWriter) endAlbum(folder string, album *AlbumMetadata) error {
+	if !writer.enabled() || album == nil {
+		return nil
+	}
+
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	file, err := writer.getAlbum(folder, album)
+	if err != nil || file.pending == 0 {
+		return err
+	}
+	return file.save()
+}
+
+// flush writes every album sidecar which has images that haven't been
+// written yet.
+func (writer *sidecarWriter) flush() error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	var result error
+	for _, file := range writer.albums {
+		if file.pending > 0 {
+			if err := file.save(); err != nil && result == nil {
+				result = err
+			}
+		}
+	}
+	return result
+}
+
+// getAlbum returns the sidecar for the given album in the given folder,
+// reading it from disk if it exists.  Caller must hold the mutex.
+func (writer *sidecarWriter) getAlbum(folder string, album *AlbumMetadata) (*albumSidecarFile, error) {
+	folder, err := filepath.Abs(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	key := folder + "\n" + album.URL
+	if file := writer.albums[key]; file != nil {
+		return file, nil
+	}
+
+	// If another album is using "album.json" in this folder, pick a
+	// different name.
+	filename := filepath.Join(folder, AlbumSidecarFilename)
+	existing, err := readAlbumSidecar(filename)
+	if err != nil {
+		return nil, err
+	}
+	if writer.claimed[filename] || (existing != nil && existing.Album.URL != album.URL) {
+		filename = filepath.Join(folder, "album-"+truncateString(8, hashString(album.URL))+".json")
+		if existing, err = readAlbumSidecar(filename); err != nil {
+			return nil, err
+		}
+	}
+
+	if existing == nil {
+		existing = &AlbumSidecar{Album: newSidecarAlbum(album), Images: []*SidecarImage{}}
+	}
+
+	file := &albumSidecarFile{filename: filename, sidecar: existing, images: map[string]*SidecarImage{}}
+	for _, image := range existing.Images {
+		file.images[image.URL] = image
+	}
+	writer.albums[key] = file
+	writer.claimed[filename] = true
+	return file, nil
+}
+
+// save writes the sidecar to disk, with the images sorted by index.
+func (file *albumSidecarFile) save() error {
+	images := make([]*SidecarImage, 0, len(file.images))
+	for _, image := range file.images {
+		images = append(images, image)
+	}
+	sort.Slice(images, func(i int, j int) bool {
+		if images[i].Index != images[j].Index {
+			return images[i].Index < images[j].Index
+		}
+		return images[i].URL < images[j].URL
+	})
+	file.sidecar.Images = images
+
+	if err := writeJSONFile(file.filename, file.sidecar); err != nil {
+		return err
+	}
+	file.pending = 0
+	return nil
+}
+
+// readAlbumSidecar reads an album sidecar file.  Returns nil if the file
+// doesn't exist.
+func readAlbumSidecar(filename string) (*AlbumSidecar, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	result := &AlbumSidecar{}
+	if err = json.Unmarshal(data, result); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", filename, err)
+	}
+	return result, nil
+}
+
+// writeJSONFile writes `value` to a file as JSON.  The data is written to a
+// temporary file which is then renamed, so we never leave a half-written
+// file behind.
+func writeJSONFile(filename string, value interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFilename := filename + ".tmp"
+	if err = os.WriteFile(tmpFilename, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
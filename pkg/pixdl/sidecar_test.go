@@ -0,0 +1,89 @@
+package pixdl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSidecarWriter(t *testing.T) {
+	dir := t.TempDir()
+	album := &AlbumMetadata{URL: "https://example.com/threads/1", Name: "Bikes", Author: "jwalton"}
+	image := &ImageMetadata{
+		Album:     album,
+		URL:       "https://example.com/images/1.jpg",
+		SourceURL: "https://example.com/threads/1/post-22",
+		SubAlbum:  "22",
+		Index:     1,
+		Page:      2,
+	}
+	filename := filepath.Join(dir, "22", "1.jpg")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(filename), 0755))
+	assert.NoError(t, os.WriteFile(filename, []byte("hello"), 0644))
+
+	writer := newSidecarWriter(SidecarsAll)
+	assert.NoError(t, writer.startAlbum(dir, album))
+	assert.NoError(t, writer.addImage(dir, image, filename, true))
+
+	// The album sidecar shouldn't be written until the album ends.
+	sidecar, err := readAlbumSidecar(filepath.Join(dir, AlbumSidecarFilename))
+	assert.NoError(t, err)
+	assert.Len(t, sidecar.Images, 0)
+
+	assert.NoError(t, writer.endAlbum(dir, album))
+	sidecar, err = readAlbumSidecar(filepath.Join(dir, AlbumSidecarFilename))
+	assert.NoError(t, err)
+	assert.Equal(t, "Bikes", sidecar.Album.Name)
+	assert.Equal(t, "jwalton", sidecar.Album.Author)
+	if assert.Len(t, sidecar.Images, 1) {
+		assert.Equal(t, "22/1.jpg", sidecar.Images[0].File)
+		assert.Equal(t, "https://example.com/threads/1/post-22", sidecar.Images[0].SourceURL)
+		assert.Equal(t, int64(5), sidecar.Images[0].Size)
+		assert.Equal(t, 2, sidecar.Images[0].Page)
+	}
+
+	_, err = os.Stat(filename + ImageSidecarSuffix)
+	assert.NoError(t, err)
+
+	// A new writer should keep images from the existing sidecar.
+	writer = newSidecarWriter(SidecarsAlbum)
+	assert.NoError(t, writer.startAlbum(dir, album))
+	sidecar, err = readAlbumSidecar(filepath.Join(dir, AlbumSidecarFilename))
+	assert.NoError(t, err)
+	assert.Len(t, sidecar.Images, 1)
+
+	// A second album in the same folder should get its own sidecar.
+	other := &AlbumMetadata{URL: "https://example.com/threads/2"}
+	assert.NoError(t, writer.startAlbum(dir, other))
+	sidecar, err = readAlbumSidecar(filepath.Join(dir, "album-"+hashString(other.URL)[:8]+".json"))
+	assert.NoError(t, err)
+	if assert.NotNil(t, sidecar) {
+		assert.Equal(t, other.URL, sidecar.Album.URL)
+	}
+}
+
+func TestSidecarWriterFlushesLargeAlbums(t *testing.T) {
+	dir := t.TempDir()
+	album := &AlbumMetadata{URL: "https://example.com/threads/1"}
+
+	writer := newSidecarWriter(SidecarsAlbum)
+	assert.NoError(t, writer.startAlbum(dir, album))
+	for index := sidecarFlushImages - 1; index >= 0; index-- {
+		filename := filepath.Join(dir, fmt.Sprintf("%d.jpg", index))
+		assert.NoError(t, os.WriteFile(filename, []byte("hello"), 0644))
+		image := &ImageMetadata{Album: album, URL: fmt.Sprintf("https://example.com/%d.jpg", index), Index: index}
+		assert.NoError(t, writer.addImage(dir, image, filename, true))
+	}
+
+	// Should have written the sidecar once enough images were added, sorted
+	// by index.
+	sidecar, err := readAlbumSidecar(filepath.Join(dir, AlbumSidecarFilename))
+	assert.NoError(t, err)
+	if assert.Len(t, sidecar.Images, sidecarFlushImages) {
+		assert.Equal(t, 0, sidecar.Images[0].Index)
+		assert.Equal(t, sidecarFlushImages-1, sidecar.Images[sidecarFlushImages-1].Index)
+	}
+}
@@ -0,0 +1,246 @@
+package pixdl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// templateFuncs are the functions available in filename and album folder
+// templates.
+//
+//   - `safe` makes a value safe to use as a single file or folder name, by
+//     replacing "/" and other characters that aren't allowed in filenames.
+//     For example, `{{safe .Album.Name}}`.
+//   - `slug` converts a value to lowercase, and replaces anything other than
+//     letters and numbers with "-".  For example, `{{slug .Album.Name}}`.
+//   - `truncate` shortens a value to at most the given number of characters.
+//     For example, `{{truncate 20 .Album.Name}}` or `{{.Album.Name | truncate 20}}`.
+//   - `pad` zero-pads a number to the given width, e.g. `{{pad 3 .Image.Index}}`
+//     gives "007".
+//   - `date` formats a time using a Go layout, e.g.
+//     `{{date "2006-01-02" .Image.Timestamp}}`.  Gives "" if the time is unknown.
+//   - `ext` returns the extension of a filename, including the ".", e.g.
+//     `{{ext .Filename}}`.
+//   - `stem` returns a filename without its extension.
+//   - `base` returns the last element of a path or URL, e.g. `{{base .Image.URL}}`.
+//   - `lower`, `upper`, and `trim` change case and trim whitespace.
+//   - `default` returns a fallback if a value is empty, e.g.
+//     `{{default "misc" .Image.SubAlbum}}`.
+//   - `replace` replaces all occurrences of a string, e.g.
+//     `{{replace " " "_" .Album.Name}}`.
+//   - `hash` returns the hex encoded SHA-256 hash of a value, e.g.
+//     `{{hash .Image.URL | truncate 8}}`.
+//   - `hostname` returns the host name from a URL, e.g. `{{hostname .Album.URL}}`.
+var templateFuncs = template.FuncMap{
+	"safe":     sanitizeFilename,
+	"slug":     slugify,
+	"truncate": truncateString,
+	"pad":      pad,
+	"date":     formatDate,
+	"ext":      path.Ext,
+	"stem":     stem,
+	"base":     baseName,
+	"lower":    strings.ToLower,
+	"upper":    strings.ToUpper,
+	"trim":     strings.TrimSpace,
+	"default":  defaultValue,
+	"replace":  replace,
+	"hash":     hashString,
+	"hostname": hostname,
+}
+
+// sampleImage is used to try out templates before we download anything, so
+// mistakes in templates are caught early.
+var sampleImage = func() *ImageMetadata {
+	timestamp := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	album := &AlbumMetadata{
+		URL:             "https://example.com/album/1",
+		AlbumID:         "1",
+		Name:            "Album",
+		Author:          "Author",
+		Provider:        "web",
+		TotalImageCount: 1,
+	}
+	return &ImageMetadata{
+		Album:     album,
+		SubAlbum:  "1",
+		URL:       "https://example.com/images/image.jpg",
+		Filename:  "image.jpg",
+		Title:     "Image",
+		Size:      1024,
+		Timestamp: &timestamp,
+		Index:     0,
+		Page:      1,
+	}
+}()
+
+// newTemplate parses a filename or album folder template.
+func newTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// executeTemplate parses and executes a template.
+func executeTemplate(name string, text string, data map[string]interface{}) (string, error) {
+	tmpl, err := newTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// getTemplateData returns the data passed to a filename template.
+func getTemplateData(downloadFilename string, album *AlbumMetadata, image *ImageMetadata) map[string]interface{} {
+	imageURL := ""
+	if image != nil {
+		imageURL = image.URL
+	}
+
+	return map[string]interface{}{
+		"Filename": downloadFilename,
+		"Ext":      path.Ext(downloadFilename),
+		"Stem":     stem(downloadFilename),
+		"Host":     hostname(imageURL),
+		"Now":      time.Now(),
+		"Album":    album,
+		"Image":    image,
+	}
+}
+
+// getAlbumTemplateData returns the data passed to an album folder template.
+func getAlbumTemplateData(album *AlbumMetadata) map[string]interface{} {
+	albumURL := ""
+	if album != nil {
+		albumURL = album.URL
+	}
+
+	return map[string]interface{}{
+		"Host":  hostname(albumURL),
+		"Now":   time.Now(),
+		"Album": album,
+	}
+}
+
+// slugify converts a string to lowercase, and replaces every run of
+// characters that aren't letters or numbers with a single "-".
+func slugify(str string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(str) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteRune('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// truncateString shortens a string to at most `length` characters.
+func truncateString(length int, str string) string {
+	if length < 0 {
+		length = 0
+	}
+	runes := []rune(str)
+	if len(runes) <= length {
+		return str
+	}
+	return string(runes[:length])
+}
+
+// pad zero-pads a number (or a string) to the given width.
+func pad(width int, value interface{}) string {
+	switch v := value.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%0*d", width, v)
+	default:
+		str := fmt.Sprint(value)
+		if len(str) >= width {
+			return str
+		}
+		return strings.Repeat("0", width-len(str)) + str
+	}
+}
+
+// formatDate formats a time.Time or *time.Time with the given layout.
+// Returns "" for a nil time.
+func formatDate(layout string, value interface{}) (string, error) {
+	switch t := value.(type) {
+	case time.Time:
+		return t.Format(layout), nil
+	case *time.Time:
+		if t == nil {
+			return "", nil
+		}
+		return t.Format(layout), nil
+	case nil:
+		return "", nil
+	default:
+		return "", fmt.Errorf("date: expected a time, got %T", value)
+	}
+}
+
+// stem returns a filename without its extension.
+func stem(filename string) string {
+	return strings.TrimSuffix(filename, path.Ext(filename))
+}
+
+// baseName returns the last element of a path or URL.
+func baseName(str string) string {
+	if u, err := url.Parse(str); err == nil && u.Scheme != "" {
+		str = u.Path
+	}
+	return path.Base(str)
+}
+
+// defaultValue returns `value`, or `def` if `value` is empty.
+func defaultValue(def interface{}, value interface{}) interface{} {
+	if value == nil {
+		return def
+	}
+	v := reflect.ValueOf(value)
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return def
+	}
+	if v.IsZero() {
+		return def
+	}
+	return value
+}
+
+// replace replaces every occurrence of `old` in `str` with `new`.
+func replace(old string, new string, str string) string {
+	return strings.ReplaceAll(str, old, new)
+}
+
+// hashString returns the hex-encoded SHA-256 hash of a string.
+func hashString(str string) string {
+	sum := sha256.Sum256([]byte(str))
+	return hex.EncodeToString(sum[:])
+}
+
+// hostname returns the host name from a URL, or "" if the URL can't be parsed.
+func hostname(str string) string {
+	u, err := url.Parse(str)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
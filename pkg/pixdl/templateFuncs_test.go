@@ -0,0 +1,54 @@
+package pixdl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateFuncLibrary(t *testing.T) {
+	timestamp := time.Date(2020, 5, 6, 0, 0, 0, 0, time.UTC)
+	album := &AlbumMetadata{URL: "https://www.example.com/threads/1", Name: "Bikes"}
+	image := &ImageMetadata{Album: album, URL: "https://cdn.example.com/a/b/photo.jpeg?x=1", Index: 7, Timestamp: &timestamp}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{`{{pad 3 .Image.Index}}`, "007"},
+		{`{{pad 3 .Image.SubAlbum}}`, "000"},
+		{`{{date "2006-01-02" .Image.Timestamp}}`, "2020-05-06"},
+		{`{{.Ext}} {{.Stem}} {{ext .Filename}} {{stem .Filename}}`, ".png img .png img"},
+		{`{{base .Image.URL}}`, "photo.jpeg"},
+		{`{{lower .Album.Name}} {{upper .Album.Name}}`, "bikes BIKES"},
+		{`{{default "misc" .Image.SubAlbum}}/{{.Filename}}`, "misc/img.png"},
+		{`{{replace "i" "1" .Album.Name}}`, "B1kes"},
+		{`{{hash "hello" | truncate 8}}`, "2cf24dba"},
+		{`{{.Host}} {{hostname .Album.URL}}`, "cdn.example.com www.example.com"},
+	}
+
+	for _, test := range tests {
+		result, err := getTemplateFilename(test.template, "img.png", album, image)
+		assert.Nil(t, err, test.template)
+		assert.Equal(t, test.expected, result, test.template)
+	}
+
+	// Unknown time should give an empty string.
+	image.Timestamp = nil
+	result, err := getTemplateFilename(`{{date "2006" .Image.Timestamp}}`, "img.png", album, image)
+	assert.Nil(t, err)
+	assert.Equal(t, "", result)
+}
+
+func TestValidateTemplate(t *testing.T) {
+	assert.Nil(t, validateTemplate(""))
+	assert.Nil(t, validateTemplate(`{{.Image.SubAlbum}}/{{pad 4 .Image.Index}}-{{.Filename}}`))
+	assert.NotNil(t, validateTemplate(`{{.Imag.SubAlbum}}/{{.Filename}}`))
+	assert.NotNil(t, validateTemplate(`{{.Image.Subalbum}}/{{.Filename}}`))
+	assert.NotNil(t, validateTemplate(`{{padd 3 .Image.Index}}`))
+	assert.NotNil(t, validateTemplate(`{{.Filename`))
+
+	assert.Nil(t, validateAlbumFolderTemplate(`{{.Album.Provider}}/{{safe .Album.Name}}`))
+	assert.NotNil(t, validateAlbumFolderTemplate(`{{.Filename}}`))
+}
@@ -1,7 +1,9 @@
 package providers
 
 import (
+	"context"
 	"net/http"
+	"time"
 
 	"github.com/jwalton/pixdl/pkg/download"
 	"golang.org/x/net/html"
@@ -13,17 +15,79 @@ type Env struct {
 	// DownloadClient is the client that wil be used to download files.
 	// This must be provided.
 	DownloadClient *download.Client
+	// HTTPClient is the client used to make requests via `Do()`, `Get()`, and
+	// `GetHTML()`.  If nil, http.DefaultClient is used.  To limit the rate of
+	// page fetches, set this to a client from `Scheduler.Client()`, using the
+	// same Scheduler as DownloadClient so the limits apply to page fetches and
+	// downloads alike.
+	HTTPClient *http.Client
+	// Since and Until, if set, are the range of image timestamps the user is
+	// interested in.  Providers don't need to filter images themselves, but a
+	// provider which returns images in chronological order can use these to
+	// stop fetching pages early.  See `IsAfterUntil()`.
+	Since *time.Time
+	Until *time.Time
+	// ctx is the context for requests made via this Env.  Use `WithContext()`
+	// to set this.
+	ctx context.Context
 }
 
-// NewGetRequest creates a new http GET request.
-func (*Env) NewGetRequest(url string) (*http.Request, error) {
-	req, err := http.NewRequest("GET", url, nil)
+// Context returns the context for this Env.  Providers should stop fetching
+// images once this context is done.  This will never return nil.
+func (env *Env) Context() context.Context {
+	if env.ctx != nil {
+		return env.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of the Env with its context changed to ctx.
+// All requests made via the returned Env will be aborted when ctx is cancelled.
+func (env *Env) WithContext(ctx context.Context) *Env {
+	if ctx == nil {
+		panic("nil context")
+	}
+	result := *env
+	result.ctx = ctx
+	return &result
+}
+
+// IsDone returns true if this Env's context has been cancelled, and providers
+// should stop fetching more images.
+func (env *Env) IsDone() bool {
+	return env.Context().Err() != nil
+}
+
+// IsAfterUntil returns true if the given timestamp is after `Until`.  For a
+// provider that returns images in chronological order, this means there's no
+// need to fetch any more images.  Returns false if either is nil.
+func (env *Env) IsAfterUntil(timestamp *time.Time) bool {
+	return env.Until != nil && timestamp != nil && timestamp.After(*env.Until)
+}
+
+// NewGetRequest creates a new http GET request.  The request will use the
+// Env's context.
+func (env *Env) NewGetRequest(url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(env.Context(), "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	req.Header.Set("User-Agent", "pixdl")
 
 	return req, err
 }
 
+// Do sends an HTTP request and returns the response.  Providers should use
+// this instead of `http.DefaultClient.Do()`, so requests are made via the
+// Env's HTTPClient.
+func (env *Env) Do(req *http.Request) (*http.Response, error) {
+	if env.HTTPClient != nil {
+		return env.HTTPClient.Do(req)
+	}
+	return http.DefaultClient.Do(req)
+}
+
 // Get will fetch the contents of a URL via HTTP GET.
 func (env *Env) Get(url string) (*http.Response, error) {
 	req, err := env.NewGetRequest(url)
@@ -31,7 +95,7 @@ func (env *Env) Get(url string) (*http.Response, error) {
 		return nil, err
 	}
 
-	return http.DefaultClient.Do(req)
+	return env.Do(req)
 }
 
 // GetHTML will fetch the HTML contents of a URL via HTTP GET, and return the parsed HTML.
@@ -34,6 +34,8 @@ type gofileFile struct {
 	Name string `json:"name"`
 	// Size is the size of this file, in bytes.
 	Size int64 `json:"size"`
+	// MD5 is the hex-encoded MD5 hash of this file.
+	MD5 string `json:"md5"`
 	// Mimetype is the MIME type for this file.
 	Mimetype string `json:"mimetype"`
 	// Link is the URL to download this file from.
@@ -62,7 +64,7 @@ func (gofileProvider) gofileAPIRequest(env *Env, apiURL string) (*http.Response,
 	req.Header.Add("Accept", "*/*")
 	req.Header.Add("Origin", "https://gofile.io")
 	req.Header.Add("Referer", "https://gofile.io/")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := env.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -128,7 +130,7 @@ func (provider gofileProvider) sortFiles(fileMap map[string]gofileFile) []gofile
 
 func (provider gofileProvider) parseImages(album *meta.AlbumMetadata, images []gofileFile, callback ImageCallback) {
 	for index, image := range images {
-		callback(
+		wantMore := callback(
 			album,
 			&meta.ImageMetadata{
 				Album:    album,
@@ -136,11 +138,15 @@ func (provider gofileProvider) parseImages(album *meta.AlbumMetadata, images []g
 				Filename: image.Name,
 				Title:    image.Name,
 				Size:     image.Size,
+				MD5:      image.MD5,
 				Index:    index,
 				Page:     1,
 			},
 			nil,
 		)
+		if !wantMore {
+			return
+		}
 	}
 
 	callback(album, nil, nil)
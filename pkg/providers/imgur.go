@@ -62,7 +62,7 @@ func (provider imgurProvider) Get(env *Env, url string) (*http.Response, error)
 	}
 
 	req.Header.Set("Authorization", "Client-ID "+imgurClientId)
-	return http.DefaultClient.Do(req)
+	return env.Do(req)
 }
 
 func (provider imgurProvider) FetchAlbum(env *Env, params map[string]string, url string, callback ImageCallback) {
@@ -79,13 +79,13 @@ func (provider imgurProvider) FetchAlbum(env *Env, params map[string]string, url
 		callback(nil, nil, fmt.Errorf("unable to fetch album: %s: %v", url, err))
 		return
 	}
+	defer resp.Body.Close()
+
 	if resp.StatusCode != 200 {
 		callback(nil, nil, fmt.Errorf("unexpected response from server: %d", resp.StatusCode))
 		return
 	}
 
-	defer resp.Body.Close()
-
 	provider.parseAlbum(url, albumID, resp.Body, callback)
 }
 
@@ -127,7 +127,7 @@ func (provider imgurProvider) parseImages(album *meta.AlbumMetadata, images []im
 			filename = image.ID + image.Ext
 		}
 
-		callback(
+		wantMore := callback(
 			album,
 			&meta.ImageMetadata{
 				Album:     album,
@@ -135,12 +135,17 @@ func (provider imgurProvider) parseImages(album *meta.AlbumMetadata, images []im
 				Filename:  filename,
 				Title:     image.Name,
 				Size:      image.Size,
+				Width:     image.Width,
+				Height:    image.Height,
 				Timestamp: timestamp,
 				Index:     index,
 				Page:      1,
 			},
 			nil,
 		)
+		if !wantMore {
+			return
+		}
 	}
 
 	callback(album, nil, nil)
@@ -136,6 +136,8 @@ func TestImgurParseAlbum(t *testing.T) {
 			Filename:  "IMG_1364.jpeg",
 			Title:     "IMG_1364",
 			Size:      2081928,
+			Width:     4683,
+			Height:    3746,
 			Timestamp: &t1,
 			Index:     0,
 			Page:      1,
@@ -146,6 +148,8 @@ func TestImgurParseAlbum(t *testing.T) {
 			Filename:  "IMG_1873.jpeg",
 			Title:     "IMG_1873",
 			Size:      2632628,
+			Width:     5121,
+			Height:    3414,
 			Timestamp: &t2,
 			Index:     1,
 			Page:      1,
@@ -13,7 +13,7 @@ import (
 // Skip tiny images.
 const minImageSize = 5000
 
-// TODO: Add options for min size, CSS selector, min dimensions.
+// TODO: Add an option for a CSS selector.
 
 type webProvider struct{}
 
@@ -32,6 +32,7 @@ func (webProvider) FetchAlbumFromHTML(env *Env, params map[string]string, url st
 	}
 
 	index := 0
+	running := true
 
 	seenURLs := map[string]bool{}
 
@@ -48,6 +49,15 @@ func (webProvider) FetchAlbumFromHTML(env *Env, params map[string]string, url st
 			return callback(album, nil, err), true
 		}
 
+		// Stop checking links if we've been cancelled.
+		if env.IsDone() {
+			running = false
+			if index != 0 {
+				callback(album, nil, env.Context().Err())
+			}
+			return false, false
+		}
+
 		// Don't visit the same URL twice.
 		if _, seen := seenURLs[url]; seen {
 			return true, false
@@ -63,7 +73,8 @@ func (webProvider) FetchAlbumFromHTML(env *Env, params map[string]string, url st
 			}
 
 			index++
-			return callback(album, image, nil), true
+			running = callback(album, image, nil)
+			return running, true
 		}
 
 		// Not an image... keep going.
@@ -72,6 +83,11 @@ func (webProvider) FetchAlbumFromHTML(env *Env, params map[string]string, url st
 
 	findPossibleImageLinks(url, node, linkHandler)
 
+	// Let the caller know there are no more images.
+	if running && index != 0 {
+		callback(album, nil, nil)
+	}
+
 	return index != 0
 }
 
@@ -5,6 +5,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jwalton/pixdl/pkg/pixdl/meta"
 	"github.com/jwalton/pixdl/pkg/providers/internal/htmlutils"
@@ -77,13 +78,21 @@ func (xenforoProvider) FetchAlbumFromHTML(env *Env, params map[string]string, ur
 		}
 	}
 
+	// Threads are in chronological order, so once we find a post after
+	// `env.Until` we can stop.
+	pastUntil := false
+
 	var albumErr error
 	var handleNextPage func(nextLink string)
 	var walkDocument func(node *html.Node, getAlbum bool)
 
 	// Go fetch the next page, and read all the images from it.
 	handleNextPage = func(nextLink string) {
-		if !running {
+		if !running || pastUntil {
+			return
+		}
+		if env.IsDone() {
+			albumErr = env.Context().Err()
 			return
 		}
 
@@ -106,13 +115,42 @@ func (xenforoProvider) FetchAlbumFromHTML(env *Env, params map[string]string, ur
 		page int,
 	) {
 		subAlbum := ""
+		postURL := ""
+		var postTime *time.Time
+		sendPostImage := func(image *meta.ImageMetadata) {
+			if image != nil {
+				image.SourceURL = postURL
+				if image.Timestamp == nil {
+					image.Timestamp = postTime
+				}
+			}
+			sendImage(image)
+		}
+
 		htmlutils.WalkNodesPreOrder(node, func(node *html.Node) bool {
-			// Grab the post number from the upper right corner.
-			if node.Type == html.ElementNode && node.Data == "a" && strings.HasPrefix(htmlutils.GetAttr(node.Attr, "href"), "/threads") {
+			if pastUntil {
+				return false
+			}
+
+			// Grab the time the post was made.  This is usually inside the
+			// link to the post, so check links too.
+			if postTime == nil && node.Type == html.ElementNode && (node.Data == "time" || node.Data == "a") {
+				postTime = findPostTime(node)
+				if env.IsAfterUntil(postTime) {
+					pastUntil = true
+					return false
+				}
+			}
+
+			// Grab the post number from the upper right corner.  The time the
+			// post was made and the "share" button link to the post too, so
+			// only use the link whose text is the post number (e.g. "#22").
+			if node.Type == html.ElementNode && node.Data == "a" && isPostNumberLink(node) {
 				post := htmlutils.GetNodeTextContent(node)
 				post = strings.TrimSpace(post)
 				post = strings.TrimPrefix(post, "#")
 				subAlbum = post
+				postURL = htmlutils.ResolveURL(parsedURL, htmlutils.GetAttr(node.Attr, "href"))
 				return false
 			}
 
@@ -126,7 +164,7 @@ func (xenforoProvider) FetchAlbumFromHTML(env *Env, params map[string]string, ur
 						image.Index = index
 						image.SubAlbum = subAlbum
 						image.Page = page
-						sendImage(image)
+						sendPostImage(image)
 					}
 				}
 				return false
@@ -134,19 +172,19 @@ func (xenforoProvider) FetchAlbumFromHTML(env *Env, params map[string]string, ur
 
 			if node.Type == html.ElementNode && node.Data == "li" && htmlutils.HasClass(node.Attr, "attachment") {
 				image := parseAttachment(parsedURL, node, album, subAlbum, page, index)
-				sendImage(image)
+				sendPostImage(image)
 				return false
 			}
 			if node.Type == html.ElementNode && node.Data == "img" && htmlutils.HasClass(node.Attr, "bbImage") {
 				image := parseInlineImage(parsedURL, node, album, subAlbum, page, index)
-				sendImage(image)
+				sendPostImage(image)
 				return false
 			}
 			if node.Type == html.ElementNode && node.Data == "a" && htmlutils.HasClass(node.Attr, "js-lbImage") {
 				// js-lbImage can show up in an attachment, but also in a `bbWrapper` div, where there's just
 				// a whole bunch of js-lbImage with no other metadata.
 				image := parseLBImage(parsedURL, node, album, subAlbum, page, index)
-				sendImage(image)
+				sendPostImage(image)
 				return false
 			}
 
@@ -157,7 +195,7 @@ func (xenforoProvider) FetchAlbumFromHTML(env *Env, params map[string]string, ur
 	// Find all the images in a given page.
 	walkDocument = func(node *html.Node, getAlbum bool) {
 		htmlutils.WalkNodesPreOrder(node, func(node *html.Node) bool {
-			if !running {
+			if !running || pastUntil {
 				return false
 			}
 			if node.Type == html.ElementNode && node.Data == "a" && htmlutils.HasClass(node.Attr, "p-body-header") {
@@ -217,19 +255,62 @@ func parseDescriptionBlock(node *html.Node, album *meta.AlbumMetadata) {
 			album.Author = htmlutils.GetNodeTextContent(node)
 			return false
 		}
-		// if node.Type == html.ElementNode && node.Data == "time" {
-		// 	timestampStr := htmlutils.GetAttr(node.Attr, "data-time")
-		// 	unixTimestamp, err := strconv.ParseInt(timestampStr, 10, 64)
-		// 	if err != nil {
-		// 		timestamp := time.Unix(unixTimestamp, 0)
-		// 	}
-		// 	return false
-		// }
 
 		return true
 	})
 }
 
+// isPostNumberLink returns true if the given `<a>` is the link to a post
+// which shows the post's number, like `<a href="/threads/x.1/post-2">#2</a>`.
+func isPostNumberLink(node *html.Node) bool {
+	href := htmlutils.GetAttr(node.Attr, "href")
+	if !strings.HasPrefix(href, "/threads") || !strings.Contains(href, "/post-") {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimSpace(htmlutils.GetNodeTextContent(node)), "#")
+}
+
+// xenforoTimeFormats are the formats we accept for the `datetime` attribute
+// of a `<time>` element.  XenForo writes the timezone offset without a colon.
+var xenforoTimeFormats = []string{time.RFC3339, "2006-01-02T15:04:05-0700"}
+
+// findPostTime returns the time from the first `<time>` element in the given
+// node, or nil if there isn't one.  The time is read from `data-time`, which
+// is a unix timestamp, or from `datetime` if there's no `data-time`.
+func findPostTime(node *html.Node) *time.Time {
+	var result *time.Time
+
+	htmlutils.WalkNodesPreOrder(node, func(node *html.Node) bool {
+		if result != nil {
+			return false
+		}
+		if node.Type == html.ElementNode && node.Data == "time" {
+			result = parseTimeElement(node)
+			return false
+		}
+		return true
+	})
+
+	return result
+}
+
+// parseTimeElement returns the time from a `<time>` element's `data-time` or
+// `datetime` attribute, or nil if neither can be parsed.
+func parseTimeElement(node *html.Node) *time.Time {
+	if unixTimestamp, err := strconv.ParseInt(htmlutils.GetAttr(node.Attr, "data-time"), 10, 64); err == nil {
+		timestamp := time.Unix(unixTimestamp, 0)
+		return &timestamp
+	}
+
+	datetime := htmlutils.GetAttr(node.Attr, "datetime")
+	for _, format := range xenforoTimeFormats {
+		if timestamp, err := time.Parse(format, datetime); err == nil {
+			return &timestamp
+		}
+	}
+	return nil
+}
+
 func parseAttachment(
 	parsedURL *url.URL,
 	node *html.Node,
@@ -0,0 +1,141 @@
+package providers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/jwalton/pixdl/pkg/download"
+	"github.com/jwalton/pixdl/pkg/pixdl/meta"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/html"
+)
+
+var xenforoSample = heredoc.Doc(`
+	<html><body>
+	<div id="top" class="p-pageWrapper">
+		<article class="message">
+			<ul class="message-attribution-main">
+				<li><a href="/threads/bikes.123/post-1"><time class="u-dt" datetime="2020-09-13T13:26:40+0100" data-time="1600000000">Sep 13, 2020</time></a></li>
+			</ul>
+			<ul class="message-attribution-opposite">
+				<li><a href="/threads/bikes.123/post-1">#1</a></li>
+			</ul>
+			<div class="bbWrapper"><img class="bbImage" src="/data/one.jpg" alt="one.jpg"></div>
+		</article>
+		<article class="message">
+			<ul class="message-attribution-main">
+				<li><a href="/threads/bikes.123/post-2"><time class="u-dt" datetime="2023-11-14T22:13:20Z" data-time="1700000000">Nov 14, 2023</time></a></li>
+			</ul>
+			<ul class="message-attribution-opposite">
+				<li><a href="/threads/bikes.123/post-2">#2</a></li>
+			</ul>
+			<div class="bbWrapper"><img class="bbImage" src="/data/two.jpg" alt="two.jpg"></div>
+		</article>
+	</div>
+	</body></html>
+`)
+
+// xenforoReversedSample has the post number before the time of each post,
+// and a "share" link to the post with no text.
+var xenforoReversedSample = heredoc.Doc(`
+	<html><body>
+	<div id="top" class="p-pageWrapper">
+		<article class="message">
+			<ul class="message-attribution-opposite">
+				<li><a href="/threads/bikes.123/post-7" class="message-attribution-gadget"><i class="fa-share-alt"></i></a></li>
+				<li><a href="/threads/bikes.123/post-7">#7</a></li>
+			</ul>
+			<ul class="message-attribution-main">
+				<li><a href="/threads/bikes.123/post-7"><time class="u-dt" datetime="2020-09-13T12:26:40Z">Sep 13, 2020</time></a></li>
+			</ul>
+			<div class="bbWrapper"><img class="bbImage" src="/data/seven.jpg" alt="seven.jpg"></div>
+		</article>
+	</div>
+	</body></html>
+`)
+
+func fetchXenforoSample(t *testing.T, env *Env) []*meta.ImageMetadata {
+	return fetchXenforoHTML(t, env, xenforoSample)
+}
+
+func fetchXenforoHTML(t *testing.T, env *Env, page string) []*meta.ImageMetadata {
+	node, err := html.Parse(strings.NewReader(page))
+	assert.NoError(t, err)
+
+	images := []*meta.ImageMetadata{}
+	done := false
+	handled := xenforoProvider{}.FetchAlbumFromHTML(env, map[string]string{}, "https://example.com/threads/bikes.123/", node,
+		func(album *meta.AlbumMetadata, image *meta.ImageMetadata, err error) bool {
+			assert.NoError(t, err)
+			if image == nil {
+				done = true
+			} else {
+				images = append(images, image)
+			}
+			return true
+		},
+	)
+	assert.True(t, handled)
+	assert.True(t, done, "should end the album")
+
+	return images
+}
+
+func TestXenforoPostTimestamps(t *testing.T) {
+	images := fetchXenforoSample(t, &Env{DownloadClient: download.NewClient()})
+
+	assert.Equal(t, 2, len(images))
+	assert.Equal(t, "1", images[0].SubAlbum)
+	assert.Equal(t, "https://example.com/data/one.jpg", images[0].URL)
+	assert.Equal(t, int64(1600000000), images[0].Timestamp.Unix())
+	assert.Equal(t, "https://example.com/threads/bikes.123/post-1", images[0].SourceURL)
+	assert.Equal(t, "2", images[1].SubAlbum)
+	assert.Equal(t, int64(1700000000), images[1].Timestamp.Unix())
+}
+
+func TestXenforoPostNumberBeforeTime(t *testing.T) {
+	images := fetchXenforoHTML(t, &Env{DownloadClient: download.NewClient()}, xenforoReversedSample)
+
+	if assert.Equal(t, 1, len(images)) {
+		assert.Equal(t, "7", images[0].SubAlbum)
+		assert.Equal(t, "https://example.com/threads/bikes.123/post-7", images[0].SourceURL)
+		if assert.NotNil(t, images[0].Timestamp) {
+			assert.Equal(t, int64(1600000000), images[0].Timestamp.Unix())
+		}
+	}
+}
+
+func TestFindPostTime(t *testing.T) {
+	for _, test := range []struct {
+		html     string
+		expected int64
+	}{
+		// data-time only.
+		{`<a href="/threads/bikes.123/post-1"><time data-time="1600000000">Sep 13, 2020</time></a>`, 1600000000},
+		// datetime only.
+		{`<a href="/threads/bikes.123/post-1"><time datetime="2020-09-13T13:26:40+0100">Sep 13, 2020</time></a>`, 1600000000},
+		// data-time wins over datetime.
+		{`<time data-time="1700000000" datetime="2020-09-13T12:26:40Z">Nov 14, 2023</time>`, 1700000000},
+	} {
+		node, err := html.Parse(strings.NewReader(test.html))
+		assert.NoError(t, err)
+		result := findPostTime(node)
+		if assert.NotNil(t, result, test.html) {
+			assert.Equal(t, test.expected, result.Unix(), test.html)
+		}
+	}
+
+	node, err := html.Parse(strings.NewReader(`<time>Sep 13, 2020</time>`))
+	assert.NoError(t, err)
+	assert.Nil(t, findPostTime(node))
+}
+
+func TestXenforoStopsAfterUntil(t *testing.T) {
+	until := time.Unix(1650000000, 0)
+	images := fetchXenforoSample(t, &Env{DownloadClient: download.NewClient(), Until: &until})
+
+	assert.Equal(t, 1, len(images))
+	assert.Equal(t, "https://example.com/data/one.jpg", images[0].URL)
+}